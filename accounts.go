@@ -0,0 +1,460 @@
+package main
+
+import (
+	"bytes"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"mime"
+	"net/http"
+	"net/mail"
+	"net/url"
+	"slices"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	sessionCookie = "jb_session"
+	loginLinkTTL  = 15 * time.Minute
+	// visitGap is how long a reader has to be away before their next visit
+	// counts as a new one for the "new since your last visit" feed.
+	visitGap = time.Hour
+	// maxHistory caps how many reading history entries we keep per account.
+	maxHistory = 200
+)
+
+var errNoAccount = errors.New("account not found")
+
+// Account is an optional reader account. Accounts have no password; readers
+// sign in with a link sent to their email address.
+type Account struct {
+	Email     string         `json:"email"`
+	Created   time.Time      `json:"created"`
+	LastSeen  time.Time      `json:"last_seen"`
+	LastVisit time.Time      `json:"last_visit"`
+	Bookmarks []string       `json:"bookmarks"`
+	History   []HistoryEntry `json:"history"`
+	Tags      []string       `json:"tags"`
+}
+
+type HistoryEntry struct {
+	Slug string    `json:"slug"`
+	Read time.Time `json:"read"`
+}
+
+type accountData struct {
+	Accounts map[string]*Account `json:"accounts"`
+}
+
+type AccountStore struct {
+	Config Config
+
+	file    *JSONFile[accountData]
+	limiter *RateLimiter
+
+	// used holds login links that have been used and haven't expired yet, so
+	// each link only works once.
+	mu   sync.Mutex
+	used map[string]time.Time
+}
+
+func NewAccountStore(path string, cfg Config) (*AccountStore, error) {
+	file, err := OpenJSONFile[accountData](path)
+	if err != nil {
+		return nil, err
+	}
+	return &AccountStore{
+		Config:  cfg,
+		file:    file,
+		limiter: &RateLimiter{Limit: 5, Window: time.Hour},
+		used:    make(map[string]time.Time),
+	}, nil
+}
+
+// Get returns a copy of the account for email.
+func (as *AccountStore) Get(email string) (Account, error) {
+	var acct Account
+	err := errNoAccount
+	as.file.View(func(data *accountData) {
+		if a, ok := data.Accounts[email]; ok {
+			acct = *a
+			err = nil
+		}
+	})
+	return acct, err
+}
+
+// update calls fn with the account for email. The account is created first
+// if create is true.
+func (as *AccountStore) update(email string, create bool, fn func(a *Account)) error {
+	return as.file.Update(func(data *accountData) error {
+		if data.Accounts == nil {
+			data.Accounts = make(map[string]*Account)
+		}
+		a, ok := data.Accounts[email]
+		if !ok {
+			if !create {
+				return errNoAccount
+			}
+			now := time.Now()
+			a = &Account{Email: email, Created: now, LastSeen: now, LastVisit: now}
+			data.Accounts[email] = a
+		}
+		fn(a)
+		return nil
+	})
+}
+
+func (as *AccountStore) Delete(email string) error {
+	return as.file.Update(func(data *accountData) error {
+		if _, ok := data.Accounts[email]; !ok {
+			return errNoAccount
+		}
+		delete(data.Accounts, email)
+		return nil
+	})
+}
+
+// currentEmail returns the email of the signed in reader, or "" if there is
+// none.
+func (as *AccountStore) currentEmail(r *http.Request) string {
+	c, err := r.Cookie(sessionCookie)
+	if err != nil {
+		return ""
+	}
+	encoded, sig, ok := strings.Cut(c.Value, ".")
+	if !ok {
+		return ""
+	}
+	b, err := base64.RawURLEncoding.DecodeString(encoded)
+	if err != nil || !verify(as.Config.Secret, "session:"+string(b), sig) {
+		return ""
+	}
+	return string(b)
+}
+
+func (as *AccountStore) setSession(w http.ResponseWriter, email string, maxAge int) {
+	value := ""
+	if email != "" {
+		value = base64.RawURLEncoding.EncodeToString([]byte(email)) + "." + sign(as.Config.Secret, "session:"+email)
+	}
+	http.SetCookie(w, &http.Cookie{
+		Name:     sessionCookie,
+		Value:    value,
+		Path:     "/",
+		MaxAge:   maxAge,
+		HttpOnly: true,
+		Secure:   strings.HasPrefix(as.Config.BaseURL, "https://"),
+		SameSite: http.SameSiteLaxMode,
+	})
+}
+
+// TrackReading records successful post views in the reading history of the
+// signed in reader.
+func (as *AccountStore) TrackReading(next http.Handler) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		email := as.currentEmail(r)
+		if email == "" {
+			next.ServeHTTP(w, r)
+			return
+		}
+		sw := &statusWriter{ResponseWriter: w, status: http.StatusOK}
+		next.ServeHTTP(sw, r)
+		if sw.status != http.StatusOK {
+			return
+		}
+		slug := r.PathValue("slug")
+		err := as.update(email, false, func(a *Account) {
+			a.History = append(a.History, HistoryEntry{Slug: slug, Read: time.Now()})
+			if len(a.History) > maxHistory {
+				a.History = a.History[len(a.History)-maxHistory:]
+			}
+		})
+		if err != nil && !errors.Is(err, errNoAccount) {
+			log.Printf("accounts: recording history: %v", err)
+		}
+	}
+}
+
+type statusWriter struct {
+	http.ResponseWriter
+	status int
+}
+
+func (sw *statusWriter) WriteHeader(status int) {
+	sw.status = status
+	sw.ResponseWriter.WriteHeader(status)
+}
+
+// AccountPage is the data passed to the account template.
+type AccountPage struct {
+	Account *Account
+	// New lists posts published since the reader's previous visit, limited to
+	// the tags they follow if they follow any.
+	New       []Post
+	Bookmarks []Post
+	History   []HistoryPost
+	Sent      bool
+	Error     string
+}
+
+type HistoryPost struct {
+	Post
+	Read time.Time
+}
+
+func renderAccount(w http.ResponseWriter, page AccountPage) {
+	tpl, err := parseTemplate("account.gohtml")
+	if err != nil {
+		http.Error(w, "Error parsing template", http.StatusInternalServerError)
+		return
+	}
+	err = tpl.Execute(w, page)
+}
+
+// AccountHandler shows the sign in form, or the reader's account when they
+// are signed in.
+func AccountHandler(fsr FileReader, as *AccountStore) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		email := as.currentEmail(r)
+		if email == "" {
+			renderAccount(w, AccountPage{Sent: r.URL.Query().Has("sent")})
+			return
+		}
+		var prevVisit time.Time
+		err := as.update(email, false, func(a *Account) {
+			now := time.Now()
+			if now.Sub(a.LastSeen) > visitGap {
+				a.LastVisit = a.LastSeen
+			}
+			a.LastSeen = now
+			prevVisit = a.LastVisit
+		})
+		if errors.Is(err, errNoAccount) {
+			// The account was deleted, so the session is no longer valid.
+			as.setSession(w, "", -1)
+			renderAccount(w, AccountPage{})
+			return
+		}
+		if err != nil {
+			http.Error(w, "Error loading account", http.StatusInternalServerError)
+			return
+		}
+		acct, err := as.Get(email)
+		if err != nil {
+			http.Error(w, "Error loading account", http.StatusInternalServerError)
+			return
+		}
+		posts, err := listPosts(fsr)
+		if err != nil {
+			http.Error(w, "Error loading posts", http.StatusInternalServerError)
+			return
+		}
+		page := AccountPage{Account: &acct}
+		bySlug := make(map[string]Post, len(posts))
+		for _, p := range posts {
+			bySlug[p.Slug] = p
+			if !p.Date.After(prevVisit) {
+				continue
+			}
+			if len(acct.Tags) > 0 && !slices.ContainsFunc(p.Tags, func(t string) bool {
+				return slices.Contains(acct.Tags, t)
+			}) {
+				continue
+			}
+			page.New = append(page.New, p)
+		}
+		for _, slug := range acct.Bookmarks {
+			if p, ok := bySlug[slug]; ok {
+				page.Bookmarks = append(page.Bookmarks, p)
+			}
+		}
+		for i := len(acct.History) - 1; i >= 0 && len(page.History) < 20; i-- {
+			h := acct.History[i]
+			if p, ok := bySlug[h.Slug]; ok {
+				page.History = append(page.History, HistoryPost{Post: p, Read: h.Read})
+			}
+		}
+		renderAccount(w, page)
+	}
+}
+
+// LoginHandler emails a single use sign in link to the reader.
+func LoginHandler(as *AccountStore) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		addr, err := mail.ParseAddress(r.FormValue("email"))
+		if err != nil {
+			renderAccount(w, AccountPage{Error: "Please enter a valid email address."})
+			return
+		}
+		email := strings.ToLower(addr.Address)
+		if !as.limiter.Allow("ip:"+clientIP(r)) || !as.limiter.Allow("email:"+email) {
+			http.Error(w, "Too many requests", http.StatusTooManyRequests)
+			return
+		}
+		exp := strconv.FormatInt(time.Now().Add(loginLinkTTL).Unix(), 10)
+		q := url.Values{
+			"email": {email},
+			"exp":   {exp},
+			"sig":   {sign(as.Config.Secret, "login:"+email+":"+exp)},
+		}
+		link := strings.TrimSuffix(as.Config.BaseURL, "/") + "/account/verify?" + q.Encode()
+		err = as.sendLoginLink(email, link)
+		if err != nil {
+			log.Printf("accounts: sending login link: %v", err)
+			http.Error(w, "Error sending email", http.StatusInternalServerError)
+			return
+		}
+		http.Redirect(w, r, "/account?sent", http.StatusSeeOther)
+	}
+}
+
+func (as *AccountStore) sendLoginLink(email, link string) error {
+	mc := as.Config.Mail
+	if mc.Addr == "" {
+		log.Printf("accounts: login link for %s: %s", email, link)
+		return nil
+	}
+	var msg bytes.Buffer
+	fmt.Fprintf(&msg, "From: %s\r\n", mc.From)
+	fmt.Fprintf(&msg, "To: %s\r\n", email)
+	fmt.Fprintf(&msg, "Subject: %s\r\n", mime.QEncoding.Encode("utf-8", "Your sign in link for Jon's Blog"))
+	fmt.Fprintf(&msg, "Content-Type: text/plain; charset=utf-8\r\n\r\n")
+	fmt.Fprintf(&msg, "Click the link below to sign in. It expires in %d minutes.\r\n\r\n%s\r\n", int(loginLinkTTL.Minutes()), link)
+	return sendMail(mc, []string{email}, msg.Bytes())
+}
+
+// VerifyHandler signs a reader in from an emailed link, creating their account
+// if this is their first time.
+func VerifyHandler(as *AccountStore) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		q := r.URL.Query()
+		email, exp, sig := q.Get("email"), q.Get("exp"), q.Get("sig")
+		expUnix, err := strconv.ParseInt(exp, 10, 64)
+		expires := time.Unix(expUnix, 0)
+		if err != nil || time.Now().After(expires) || !verify(as.Config.Secret, "login:"+email+":"+exp, sig) {
+			renderAccount(w, AccountPage{Error: "That sign in link is invalid or has expired."})
+			return
+		}
+		as.mu.Lock()
+		for k, t := range as.used {
+			if time.Now().After(t) {
+				delete(as.used, k)
+			}
+		}
+		_, used := as.used[sig]
+		as.used[sig] = expires
+		as.mu.Unlock()
+		if used {
+			renderAccount(w, AccountPage{Error: "That sign in link has already been used."})
+			return
+		}
+		err = as.update(email, true, func(a *Account) {})
+		if err != nil {
+			http.Error(w, "Error creating account", http.StatusInternalServerError)
+			return
+		}
+		as.setSession(w, email, 365*24*60*60)
+		http.Redirect(w, r, "/account", http.StatusSeeOther)
+	}
+}
+
+func LogoutHandler(as *AccountStore) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		as.setSession(w, "", -1)
+		http.Redirect(w, r, "/account", http.StatusSeeOther)
+	}
+}
+
+// requireAccount redirects readers that aren't signed in to the sign in page.
+func (as *AccountStore) requireAccount(next func(w http.ResponseWriter, r *http.Request, email string)) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		email := as.currentEmail(r)
+		if email == "" {
+			http.Redirect(w, r, "/account", http.StatusSeeOther)
+			return
+		}
+		next(w, r, email)
+	}
+}
+
+// toggle adds v to list, or removes it when remove is true.
+func toggle(list []string, v string, remove bool) []string {
+	list = slices.DeleteFunc(list, func(s string) bool { return s == v })
+	if !remove {
+		list = append(list, v)
+	}
+	return list
+}
+
+// BookmarkHandler adds or removes a saved post.
+func BookmarkHandler(sl SlugReader, as *AccountStore) http.HandlerFunc {
+	return as.requireAccount(func(w http.ResponseWriter, r *http.Request, email string) {
+		slug := r.FormValue("slug")
+		if _, err := sl.Read(slug); err != nil {
+			http.Error(w, "Post not found", http.StatusNotFound)
+			return
+		}
+		err := as.update(email, false, func(a *Account) {
+			a.Bookmarks = toggle(a.Bookmarks, slug, r.FormValue("action") == "remove")
+		})
+		if err != nil {
+			http.Error(w, "Error saving bookmark", http.StatusInternalServerError)
+			return
+		}
+		http.Redirect(w, r, "/account", http.StatusSeeOther)
+	})
+}
+
+// FollowTagHandler follows or unfollows a tag.
+func FollowTagHandler(as *AccountStore) http.HandlerFunc {
+	return as.requireAccount(func(w http.ResponseWriter, r *http.Request, email string) {
+		tag := strings.TrimSpace(r.FormValue("tag"))
+		if tag == "" || len(tag) > 100 {
+			http.Error(w, "Invalid tag", http.StatusBadRequest)
+			return
+		}
+		err := as.update(email, false, func(a *Account) {
+			a.Tags = toggle(a.Tags, tag, r.FormValue("action") == "remove")
+		})
+		if err != nil {
+			http.Error(w, "Error saving tag", http.StatusInternalServerError)
+			return
+		}
+		http.Redirect(w, r, "/account", http.StatusSeeOther)
+	})
+}
+
+// ExportHandler downloads everything we store about the reader as JSON.
+func ExportHandler(as *AccountStore) http.HandlerFunc {
+	return as.requireAccount(func(w http.ResponseWriter, r *http.Request, email string) {
+		acct, err := as.Get(email)
+		if err != nil {
+			http.Error(w, "Account not found", http.StatusNotFound)
+			return
+		}
+		w.Header().Set("Content-Type", "application/json")
+		w.Header().Set("Content-Disposition", `attachment; filename="jonblog-account.json"`)
+		enc := json.NewEncoder(w)
+		enc.SetIndent("", "  ")
+		enc.Encode(acct)
+	})
+}
+
+// DeleteAccountHandler permanently deletes the reader's account.
+func DeleteAccountHandler(as *AccountStore) http.HandlerFunc {
+	return as.requireAccount(func(w http.ResponseWriter, r *http.Request, email string) {
+		err := as.Delete(email)
+		if err != nil && !errors.Is(err, errNoAccount) {
+			http.Error(w, "Error deleting account", http.StatusInternalServerError)
+			return
+		}
+		as.setSession(w, "", -1)
+		http.Redirect(w, r, "/account", http.StatusSeeOther)
+	})
+}
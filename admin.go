@@ -0,0 +1,31 @@
+package main
+
+import (
+	"crypto/subtle"
+	"net/http"
+	"net/url"
+)
+
+// RequireAdmin protects next with HTTP basic auth. Requests that change state
+// must also come from our own pages, since browsers will happily resend basic
+// auth credentials on cross-site form posts.
+func RequireAdmin(cfg AdminConfig, next http.Handler) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		user, pass, ok := r.BasicAuth()
+		if !ok ||
+			subtle.ConstantTimeCompare([]byte(user), []byte(cfg.Username)) != 1 ||
+			subtle.ConstantTimeCompare([]byte(pass), []byte(cfg.Password)) != 1 {
+			w.Header().Set("WWW-Authenticate", `Basic realm="jonblog admin"`)
+			http.Error(w, "Unauthorized", http.StatusUnauthorized)
+			return
+		}
+		if r.Method != http.MethodGet && r.Method != http.MethodHead {
+			origin, err := url.Parse(r.Header.Get("Origin"))
+			if r.Header.Get("Origin") != "" && (err != nil || origin.Host != r.Host) {
+				http.Error(w, "Forbidden", http.StatusForbidden)
+				return
+			}
+		}
+		next.ServeHTTP(w, r)
+	}
+}
@@ -0,0 +1,365 @@
+package main
+
+import (
+	"bytes"
+	"encoding/xml"
+	"errors"
+	"html/template"
+	"io/fs"
+	"net/http"
+	"net/url"
+	"os"
+	"path"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/BurntSushi/toml"
+)
+
+// An album is a directory of images inside the albums directory. An optional
+// captions.toml file in the directory adds a title, description and captions:
+//
+//	title = "Iceland"
+//	description = "Two weeks around the ring road."
+//	sort = "date" # or "name"
+//	gps = false   # set to true to publish photo locations
+//
+//	[captions]
+//	"IMG_0001.jpg" = "Skógafoss in the rain"
+const captionsFile = "captions.toml"
+
+const (
+	thumbSize = 400
+	photoSize = 1600
+)
+
+type Album struct {
+	Name        string            `toml:"-"`
+	Title       string            `toml:"title"`
+	Description string            `toml:"description"`
+	Date        time.Time         `toml:"date"`
+	Sort        string            `toml:"sort"`
+	GPS         bool              `toml:"gps"`
+	Captions    map[string]string `toml:"captions"`
+	Photos      []Photo           `toml:"-"`
+}
+
+// Cover returns the photo used to represent the album in listings.
+func (a Album) Cover() *Photo {
+	if len(a.Photos) == 0 {
+		return nil
+	}
+	return &a.Photos[0]
+}
+
+type Photo struct {
+	Album   string
+	File    string
+	Caption string
+	EXIF    EXIF
+	// Date is when the photo was taken, or the file's modification time if
+	// the photo has no EXIF date.
+	Date time.Time
+}
+
+func (p Photo) URL() string { return path.Join("/albums", p.Album, "photos", url.PathEscape(p.File)) }
+func (p Photo) ImageURL() string {
+	return path.Join("/albums", p.Album, "images", url.PathEscape(p.File))
+}
+func (p Photo) ThumbURL() string {
+	return path.Join("/albums", p.Album, "thumbs", url.PathEscape(p.File))
+}
+
+// AlbumReader reads albums from Dir.
+type AlbumReader struct {
+	Dir string
+}
+
+func isImage(name string) bool {
+	switch strings.ToLower(filepath.Ext(name)) {
+	case ".jpg", ".jpeg", ".png":
+		return true
+	}
+	return false
+}
+
+func (ar AlbumReader) Read(name string) (Album, error) {
+	album := Album{Name: name, Title: name}
+	if !validSlug(name) {
+		return album, os.ErrNotExist
+	}
+	dir := filepath.Join(ar.Dir, name)
+	_, err := toml.DecodeFile(filepath.Join(dir, captionsFile), &album)
+	if err != nil && !errors.Is(err, fs.ErrNotExist) {
+		return album, err
+	}
+	entries, err := os.ReadDir(dir)
+	if err != nil {
+		return album, err
+	}
+	for _, entry := range entries {
+		if entry.IsDir() || !isImage(entry.Name()) {
+			continue
+		}
+		info, err := entry.Info()
+		if err != nil {
+			// The photo was removed while we were reading the album.
+			continue
+		}
+		photo := Photo{Album: name, File: entry.Name(), Caption: album.Captions[entry.Name()], Date: info.ModTime()}
+		if e, err := photoEXIF(filepath.Join(dir, entry.Name()), info); err == nil {
+			if !album.GPS {
+				e.HasGPS, e.Lat, e.Lon = false, 0, 0
+			}
+			photo.EXIF = e
+			if !e.Taken.IsZero() {
+				photo.Date = e.Taken
+			}
+		}
+		album.Photos = append(album.Photos, photo)
+	}
+	switch album.Sort {
+	case "name":
+		sort.Slice(album.Photos, func(i, j int) bool { return album.Photos[i].File < album.Photos[j].File })
+	default:
+		sort.SliceStable(album.Photos, func(i, j int) bool { return album.Photos[i].Date.Before(album.Photos[j].Date) })
+	}
+	if album.Date.IsZero() {
+		for _, p := range album.Photos {
+			if p.Date.After(album.Date) {
+				album.Date = p.Date
+			}
+		}
+	}
+	return album, nil
+}
+
+// exifCache holds the EXIF data of every photo read so far, so albums don't
+// open each photo on every request. An entry is used as long as the file's
+// size and modification time are unchanged.
+var exifCache = struct {
+	sync.Mutex
+	photos map[string]cachedEXIF
+}{photos: make(map[string]cachedEXIF)}
+
+type cachedEXIF struct {
+	size    int64
+	modTime time.Time
+	exif    EXIF
+	err     error
+}
+
+// maxCachedEXIF bounds exifCache. Deleted photos stay in it, so it is simply
+// emptied when full.
+const maxCachedEXIF = 20000
+
+func photoEXIF(path string, info fs.FileInfo) (EXIF, error) {
+	exifCache.Lock()
+	c, ok := exifCache.photos[path]
+	exifCache.Unlock()
+	if ok && c.size == info.Size() && c.modTime.Equal(info.ModTime()) {
+		return c.exif, c.err
+	}
+	c = cachedEXIF{size: info.Size(), modTime: info.ModTime()}
+	c.exif, c.err = readEXIFFile(path)
+	exifCache.Lock()
+	if len(exifCache.photos) >= maxCachedEXIF {
+		clear(exifCache.photos)
+	}
+	exifCache.photos[path] = c
+	exifCache.Unlock()
+	return c.exif, c.err
+}
+
+// List returns every album, newest first.
+func (ar AlbumReader) List() ([]Album, error) {
+	entries, err := os.ReadDir(ar.Dir)
+	if errors.Is(err, fs.ErrNotExist) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	var albums []Album
+	for _, entry := range entries {
+		if !entry.IsDir() {
+			continue
+		}
+		album, err := ar.Read(entry.Name())
+		if err != nil {
+			return nil, err
+		}
+		albums = append(albums, album)
+	}
+	sort.SliceStable(albums, func(i, j int) bool { return albums[i].Date.After(albums[j].Date) })
+	return albums, nil
+}
+
+// photo returns the photo and its index within the album.
+func (a Album) photo(file string) (Photo, int, bool) {
+	for i, p := range a.Photos {
+		if p.File == file {
+			return p, i, true
+		}
+	}
+	return Photo{}, 0, false
+}
+
+func AlbumsHandler(ar AlbumReader) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		albums, err := ar.List()
+		if err != nil {
+			http.Error(w, "Error reading albums", http.StatusInternalServerError)
+			return
+		}
+		renderTemplate(w, "albums.gohtml", albums)
+	}
+}
+
+func AlbumHandler(ar AlbumReader) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		album, err := ar.Read(r.PathValue("album"))
+		if err != nil {
+			http.Error(w, "Album not found", http.StatusNotFound)
+			return
+		}
+		renderTemplate(w, "album.gohtml", album)
+	}
+}
+
+// PhotoPage is the data passed to the photo template.
+type PhotoPage struct {
+	Album Album
+	Photo Photo
+	Prev  *Photo
+	Next  *Photo
+}
+
+func PhotoHandler(ar AlbumReader) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		album, err := ar.Read(r.PathValue("album"))
+		if err != nil {
+			http.Error(w, "Album not found", http.StatusNotFound)
+			return
+		}
+		photo, i, ok := album.photo(r.PathValue("photo"))
+		if !ok {
+			http.Error(w, "Photo not found", http.StatusNotFound)
+			return
+		}
+		page := PhotoPage{Album: album, Photo: photo}
+		if i > 0 {
+			page.Prev = &album.Photos[i-1]
+		}
+		if i < len(album.Photos)-1 {
+			page.Next = &album.Photos[i+1]
+		}
+		renderTemplate(w, "photo.gohtml", page)
+	}
+}
+
+// PhotoImageHandler serves a photo resized to size. Resizing re-encodes the
+// image, which drops its metadata. Albums that opt in to GPS are served the
+// original file at full size.
+func PhotoImageHandler(ar AlbumReader, ic ImageCache, size int) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		album, err := ar.Read(r.PathValue("album"))
+		if err != nil {
+			http.Error(w, "Album not found", http.StatusNotFound)
+			return
+		}
+		photo, _, ok := album.photo(r.PathValue("photo"))
+		if !ok {
+			http.Error(w, "Photo not found", http.StatusNotFound)
+			return
+		}
+		src := filepath.Join(ar.Dir, album.Name, photo.File)
+		if size == photoSize && album.GPS {
+			http.ServeFile(w, r, src)
+			return
+		}
+		resized, err := ic.Resized(src, album.Name+"/"+photo.File, size, size)
+		if err != nil {
+			http.Error(w, "Error resizing photo", http.StatusInternalServerError)
+			return
+		}
+		w.Header().Set("Cache-Control", "public, max-age=86400")
+		http.ServeFile(w, r, resized)
+	}
+}
+
+// AlbumsFeedHandler serves an Atom feed of albums.
+func AlbumsFeedHandler(ar AlbumReader, baseURL string) http.HandlerFunc {
+	type link struct {
+		Href string `xml:"href,attr"`
+		Rel  string `xml:"rel,attr,omitempty"`
+	}
+	type entry struct {
+		Title   string `xml:"title"`
+		ID      string `xml:"id"`
+		Link    link   `xml:"link"`
+		Updated string `xml:"updated"`
+		Summary string `xml:"summary,omitempty"`
+		Content struct {
+			Type string `xml:"type,attr"`
+			Body string `xml:",chardata"`
+		} `xml:"content"`
+	}
+	type feed struct {
+		XMLName xml.Name `xml:"http://www.w3.org/2005/Atom feed"`
+		Title   string   `xml:"title"`
+		ID      string   `xml:"id"`
+		Links   []link   `xml:"link"`
+		Updated string   `xml:"updated"`
+		Entries []entry  `xml:"entry"`
+	}
+	return func(w http.ResponseWriter, r *http.Request) {
+		albums, err := ar.List()
+		if err != nil {
+			http.Error(w, "Error reading albums", http.StatusInternalServerError)
+			return
+		}
+		base := strings.TrimSuffix(baseURL, "/")
+		f := feed{
+			Title: "Jon's Blog: Albums",
+			ID:    base + "/albums",
+			Links: []link{
+				{Href: base + "/albums"},
+				{Href: base + "/albums/feed.xml", Rel: "self"},
+			},
+			Updated: time.Now().UTC().Format(time.RFC3339),
+		}
+		if len(albums) > 0 {
+			f.Updated = albums[0].Date.UTC().Format(time.RFC3339)
+		}
+		for _, a := range albums {
+			e := entry{
+				Title:   a.Title,
+				ID:      base + "/albums/" + a.Name,
+				Link:    link{Href: base + "/albums/" + a.Name},
+				Updated: a.Date.UTC().Format(time.RFC3339),
+				Summary: a.Description,
+			}
+			var body bytes.Buffer
+			for _, p := range a.Photos {
+				body.WriteString(`<p><a href="` + base + p.URL() + `"><img src="` + base + p.ThumbURL() + `" alt=""></a>`)
+				if p.Caption != "" {
+					body.WriteString("<br>")
+					template.HTMLEscape(&body, []byte(p.Caption))
+				}
+				body.WriteString("</p>")
+			}
+			e.Content.Type = "html"
+			e.Content.Body = body.String()
+			f.Entries = append(f.Entries, e)
+		}
+		w.Header().Set("Content-Type", "application/atom+xml; charset=utf-8")
+		w.Write([]byte(xml.Header))
+		enc := xml.NewEncoder(w)
+		enc.Indent("", "  ")
+		enc.Encode(f)
+	}
+}
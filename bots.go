@@ -0,0 +1,292 @@
+package main
+
+import (
+	"fmt"
+	"log"
+	"net/http"
+	"net/netip"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// aiCrawlers are the user agents of crawlers collecting training data or
+// answering questions for AI products. Rules can refer to all of them with the
+// agent "ai".
+var aiCrawlers = []string{
+	"GPTBot",
+	"ChatGPT-User",
+	"OAI-SearchBot",
+	"ClaudeBot",
+	"Claude-Web",
+	"anthropic-ai",
+	"CCBot",
+	"Google-Extended",
+	"PerplexityBot",
+	"Bytespider",
+	"Amazonbot",
+	"Applebot-Extended",
+	"meta-externalagent",
+	"cohere-ai",
+	"Diffbot",
+	"YouBot",
+}
+
+// Bot filter decisions. Every request gets exactly one, which is counted in
+// the metrics.
+const (
+	botAllowed  = "allowed"
+	botAllowIP  = "allow_list"
+	botDenyIP   = "deny_list"
+	botAgent    = "agent_rule"
+	botNotFound = "not_found_rate"
+)
+
+// BotFilter decides which requests to serve, in this order:
+//
+//  1. Addresses in the allow list are always served.
+//  2. Addresses in the deny list are refused.
+//  3. Addresses that were recently blocked for requesting too many missing
+//     pages are refused, even if a user agent rule would allow them. Paths
+//     the site has no route for, which scanners probing for /wp-login.php and
+//     the like request, have a lower limit than missing posts or photos,
+//     which readers following stale links request too.
+//  4. The first user agent rule matching the request decides.
+//
+// Anything else is served. The paths in unfilteredPaths are always served, so
+// the load balancer and other replicas can't be blocked.
+type BotFilter struct {
+	allow []netip.Prefix
+	deny  []netip.Prefix
+	rules []BotRule
+
+	notFound *RateLimiter
+	missing  *RateLimiter
+	block    time.Duration
+
+	mu      sync.Mutex
+	blocked map[string]time.Time
+	counts  map[string]int64
+}
+
+// NewBotFilter checks cfg and returns a filter using it.
+func NewBotFilter(cfg BotConfig) (*BotFilter, error) {
+	bf := &BotFilter{
+		block:   time.Duration(cfg.BlockMinutes) * time.Minute,
+		blocked: make(map[string]time.Time),
+		counts:  make(map[string]int64),
+	}
+	var err error
+	bf.allow, err = parsePrefixes(cfg.Allow)
+	if err != nil {
+		return nil, fmt.Errorf("bots: allow: %w", err)
+	}
+	bf.deny, err = parsePrefixes(cfg.Deny)
+	if err != nil {
+		return nil, fmt.Errorf("bots: deny: %w", err)
+	}
+	for i, rule := range cfg.Rules {
+		if rule.Action != "allow" && rule.Action != "deny" {
+			return nil, fmt.Errorf("bots: rule %d: unknown action %q", i+1, rule.Action)
+		}
+		if len(rule.Agents) == 0 {
+			return nil, fmt.Errorf("bots: rule %d: no agents", i+1)
+		}
+	}
+	bf.rules = cfg.Rules
+	if cfg.NotFoundLimit > 0 {
+		bf.notFound = &RateLimiter{Limit: cfg.NotFoundLimit, Window: time.Minute}
+	}
+	if cfg.MissingLimit > 0 {
+		bf.missing = &RateLimiter{Limit: cfg.MissingLimit, Window: time.Minute}
+	}
+	return bf, nil
+}
+
+// unfilteredPaths are served without any checks.
+var unfilteredPaths = map[string]bool{
+	"/readyz":           true,
+	"/replicas/version": true,
+}
+
+// parsePrefixes parses a list of addresses and CIDR ranges.
+func parsePrefixes(list []string) ([]netip.Prefix, error) {
+	var prefixes []netip.Prefix
+	for _, s := range list {
+		if addr, err := netip.ParseAddr(s); err == nil {
+			prefixes = append(prefixes, netip.PrefixFrom(addr, addr.BitLen()))
+			continue
+		}
+		prefix, err := netip.ParsePrefix(s)
+		if err != nil {
+			return nil, fmt.Errorf("invalid address or range %q", s)
+		}
+		prefixes = append(prefixes, prefix.Masked())
+	}
+	return prefixes, nil
+}
+
+func containsAddr(prefixes []netip.Prefix, addr netip.Addr) bool {
+	for _, p := range prefixes {
+		if p.Contains(addr) {
+			return true
+		}
+	}
+	return false
+}
+
+// matches reports whether rule applies to a request for path from ua.
+func (rule BotRule) matches(ua, path string) bool {
+	pathOK := len(rule.Paths) == 0
+	for _, p := range rule.Paths {
+		if strings.HasPrefix(path, p) {
+			pathOK = true
+			break
+		}
+	}
+	if !pathOK {
+		return false
+	}
+	ua = strings.ToLower(ua)
+	for _, agent := range rule.Agents {
+		if agent == "ai" {
+			for _, crawler := range aiCrawlers {
+				if strings.Contains(ua, strings.ToLower(crawler)) {
+					return true
+				}
+			}
+			continue
+		}
+		if strings.Contains(ua, strings.ToLower(agent)) {
+			return true
+		}
+	}
+	return false
+}
+
+// decide returns the decision for r and whether to serve it.
+func (bf *BotFilter) decide(r *http.Request) (string, bool) {
+	ip := clientIP(r)
+	addr, err := netip.ParseAddr(ip)
+	if err == nil {
+		addr = addr.Unmap()
+		if containsAddr(bf.allow, addr) {
+			return botAllowIP, true
+		}
+		if containsAddr(bf.deny, addr) {
+			return botDenyIP, false
+		}
+	}
+	bf.mu.Lock()
+	until, ok := bf.blocked[ip]
+	if ok && time.Now().After(until) {
+		delete(bf.blocked, ip)
+		ok = false
+	}
+	bf.mu.Unlock()
+	if ok {
+		return botNotFound, false
+	}
+	for _, rule := range bf.rules {
+		if rule.matches(r.UserAgent(), r.URL.Path) {
+			return botAgent, rule.Action == "allow"
+		}
+	}
+	return botAllowed, true
+}
+
+func (bf *BotFilter) count(decision string, served bool) {
+	bf.mu.Lock()
+	defer bf.mu.Unlock()
+	bf.counts[decision+" "+strconv.FormatBool(served)]++
+}
+
+// notFoundResponse records a 404 for ip, and blocks it if it has had too many
+// recently. limiter is bf.notFound or bf.missing, depending on whether the
+// path has a route.
+func (bf *BotFilter) notFoundResponse(limiter *RateLimiter, ip string) {
+	if limiter == nil || limiter.Allow(ip) {
+		return
+	}
+	bf.mu.Lock()
+	defer bf.mu.Unlock()
+	if _, ok := bf.blocked[ip]; !ok {
+		log.Printf("bots: blocking %s for %v after too many requests for missing pages", ip, bf.block)
+	}
+	bf.blocked[ip] = time.Now().Add(bf.block)
+}
+
+// Middleware filters requests to next. Refused requests are logged. When next
+// is a ServeMux, 404s for paths it has a route for count towards the missing
+// limit, and the rest towards the not found limit; otherwise every 404 counts
+// towards the not found limit.
+func (bf *BotFilter) Middleware(next http.Handler) http.HandlerFunc {
+	mux, _ := next.(*http.ServeMux)
+	return func(w http.ResponseWriter, r *http.Request) {
+		if unfilteredPaths[r.URL.Path] {
+			next.ServeHTTP(w, r)
+			return
+		}
+		decision, served := bf.decide(r)
+		bf.count(decision, served)
+		if !served {
+			log.Printf("bots: refused %s %s %s %q: %s", clientIP(r), r.Method, r.URL.Path, r.UserAgent(), decision)
+			if decision == botNotFound {
+				w.Header().Set("Retry-After", strconv.Itoa(int(bf.block.Seconds())))
+				http.Error(w, "Too many requests", http.StatusTooManyRequests)
+				return
+			}
+			http.Error(w, "Forbidden", http.StatusForbidden)
+			return
+		}
+		if decision == botAllowIP {
+			next.ServeHTTP(w, r)
+			return
+		}
+		sw := &statusWriter{ResponseWriter: w, status: http.StatusOK}
+		next.ServeHTTP(sw, r)
+		if sw.status != http.StatusNotFound {
+			return
+		}
+		limiter := bf.notFound
+		if mux != nil {
+			if _, pattern := mux.Handler(r); pattern != "" {
+				limiter = bf.missing
+			}
+		}
+		bf.notFoundResponse(limiter, clientIP(r))
+	}
+}
+
+// MetricsHandler serves the filter's counters in the Prometheus text format.
+func (bf *BotFilter) MetricsHandler() http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		bf.mu.Lock()
+		keys := make([]string, 0, len(bf.counts))
+		for k := range bf.counts {
+			keys = append(keys, k)
+		}
+		sort.Strings(keys)
+		var b strings.Builder
+		b.WriteString("# HELP jonblog_bot_decisions_total Requests by bot filter decision.\n")
+		b.WriteString("# TYPE jonblog_bot_decisions_total counter\n")
+		for _, k := range keys {
+			decision, served, _ := strings.Cut(k, " ")
+			fmt.Fprintf(&b, "jonblog_bot_decisions_total{decision=%q,served=%q} %d\n", decision, served, bf.counts[k])
+		}
+		b.WriteString("# HELP jonblog_bot_blocked_addresses Addresses blocked for requesting missing pages.\n")
+		b.WriteString("# TYPE jonblog_bot_blocked_addresses gauge\n")
+		blocked := 0
+		for _, until := range bf.blocked {
+			if time.Now().Before(until) {
+				blocked++
+			}
+		}
+		fmt.Fprintf(&b, "jonblog_bot_blocked_addresses %d\n", blocked)
+		bf.mu.Unlock()
+		w.Header().Set("Content-Type", "text/plain; version=0.0.4")
+		w.Write([]byte(b.String()))
+	}
+}
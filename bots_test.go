@@ -0,0 +1,93 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"net/netip"
+	"testing"
+)
+
+func TestBotFilterNotFound(t *testing.T) {
+	bf, err := NewBotFilter(BotConfig{
+		Rules:         []BotRule{{Agents: []string{"friendly"}, Action: "allow"}},
+		NotFoundLimit: 2,
+		MissingLimit:  4,
+		BlockMinutes:  10,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	mux := http.NewServeMux()
+	mux.HandleFunc("GET /posts/{slug}", func(w http.ResponseWriter, r *http.Request) {
+		http.Error(w, "Post not found", http.StatusNotFound)
+	})
+	mux.HandleFunc("GET /readyz", func(w http.ResponseWriter, r *http.Request) {})
+	handler := bf.Middleware(mux)
+	get := func(addr, path, ua string) int {
+		r := httptest.NewRequest(http.MethodGet, path, nil)
+		r.RemoteAddr = addr + ":1234"
+		r.Header.Set("User-Agent", ua)
+		rec := httptest.NewRecorder()
+		handler.ServeHTTP(rec, r)
+		return rec.Code
+	}
+
+	tests := []struct {
+		name string
+		addr string
+		path string
+		ua   string
+		want int
+	}{
+		{"missing posts", "192.0.2.1", "/posts/a", "", http.StatusNotFound},
+		{"missing posts", "192.0.2.1", "/posts/b", "", http.StatusNotFound},
+		{"missing posts", "192.0.2.1", "/posts/c", "", http.StatusNotFound},
+		{"missing posts", "192.0.2.1", "/posts/d", "", http.StatusNotFound},
+		{"missing posts over the limit", "192.0.2.1", "/posts/e", "", http.StatusNotFound},
+		{"guessing slugs", "192.0.2.1", "/posts/f", "", http.StatusTooManyRequests},
+		{"no route", "192.0.2.2", "/wp-login.php", "", http.StatusNotFound},
+		{"no route", "192.0.2.2", "/.env", "", http.StatusNotFound},
+		{"no route", "192.0.2.2", "/xmlrpc.php", "", http.StatusNotFound},
+		{"blocked", "192.0.2.2", "/posts/a", "", http.StatusTooManyRequests},
+		{"blocked despite an allow rule", "192.0.2.2", "/posts/a", "friendly", http.StatusTooManyRequests},
+		{"readyz while blocked", "192.0.2.2", "/readyz", "", http.StatusOK},
+		{"other addresses", "192.0.2.3", "/posts/a", "", http.StatusNotFound},
+	}
+	for _, tt := range tests {
+		if got := get(tt.addr, tt.path, tt.ua); got != tt.want {
+			t.Errorf("%s: GET %s from %s = %d, want %d", tt.name, tt.path, tt.addr, got, tt.want)
+		}
+	}
+}
+
+func TestClientIP(t *testing.T) {
+	trustedProxies = []netip.Prefix{netip.MustParsePrefix("10.0.0.0/8"), netip.MustParsePrefix("192.0.2.10/32")}
+	t.Cleanup(func() { trustedProxies = nil })
+	tests := []struct {
+		name       string
+		remoteAddr string
+		forwarded  []string
+		want       string
+	}{
+		{"direct", "198.51.100.7:1234", nil, "198.51.100.7"},
+		{"untrusted proxy", "198.51.100.7:1234", []string{"203.0.113.5"}, "198.51.100.7"},
+		{"trusted proxy", "10.0.0.2:1234", []string{"203.0.113.5"}, "203.0.113.5"},
+		{"spoofed hop", "10.0.0.2:1234", []string{"1.2.3.4, 203.0.113.5"}, "203.0.113.5"},
+		{"chain of trusted proxies", "10.0.0.2:1234", []string{"203.0.113.5, 192.0.2.10", "10.0.0.3"}, "203.0.113.5"},
+		{"trusted proxy without header", "10.0.0.2:1234", nil, "10.0.0.2"},
+		{"invalid hop", "10.0.0.2:1234", []string{"203.0.113.5, unknown"}, "10.0.0.2"},
+		{"ipv4 mapped proxy", "[::ffff:10.0.0.2]:1234", []string{"203.0.113.5"}, "203.0.113.5"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			r := httptest.NewRequest(http.MethodGet, "/", nil)
+			r.RemoteAddr = tt.remoteAddr
+			for _, v := range tt.forwarded {
+				r.Header.Add("X-Forwarded-For", v)
+			}
+			if got := clientIP(r); got != tt.want {
+				t.Errorf("clientIP() = %q, want %q", got, tt.want)
+			}
+		})
+	}
+}
@@ -0,0 +1,113 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"os"
+	"strings"
+
+	"github.com/alecthomas/chroma/v2/styles"
+)
+
+// runCheck implements `jonblog check [slug...]`. It prints the effective
+// frontmatter of each post, after section defaults are applied, and reports
+// anything that would stop a post from rendering correctly. It returns the
+// number of problems found; warnings are printed but not counted.
+func runCheck(w io.Writer, fsr FileReader, slugs []string) int {
+	if len(slugs) == 0 {
+		var err error
+		slugs, err = fsr.List()
+		if err != nil {
+			fmt.Fprintln(w, "error:", err)
+			return 1
+		}
+	}
+	problems := 0
+	report := func(format string, args ...any) {
+		problems++
+		fmt.Fprintf(w, "  error: "+format+"\n", args...)
+	}
+	warn := func(format string, args ...any) {
+		fmt.Fprintf(w, "  warning: "+format+"\n", args...)
+	}
+	dups, err := fsr.duplicates()
+	if err != nil {
+		fmt.Fprintln(w, "error:", err)
+		return 1
+	}
+	for _, slug := range slugs {
+		path, err := fsr.path(slug)
+		if err != nil {
+			fmt.Fprintf(w, "%s\n", slug)
+			report("post not found")
+			continue
+		}
+		fmt.Fprintf(w, "%s (%s)\n", slug, path)
+		for _, dup := range dups[slug] {
+			report("%s has the same slug and is hidden", dup)
+		}
+		postMarkdown, err := fsr.Read(slug)
+		if err != nil {
+			report("%v", err)
+			continue
+		}
+		defaults, err := fsr.Defaults(slug)
+		if err != nil {
+			report("%v", err)
+			continue
+		}
+		post, rest, err := parsePost(fsr, slug, postMarkdown)
+		if err != nil {
+			report("%v", err)
+			continue
+		}
+
+		var sections []string
+		for _, d := range defaults {
+			sections = append(sections, d.Path)
+		}
+		author := post.Author.Name
+		if post.Author.Email != "" {
+			author += " <" + post.Author.Email + ">"
+		}
+		visibility := post.Visibility
+		if visibility == "" {
+			visibility = VisibilityPublic
+		}
+		style := post.HighlightStyle
+		if style == "" {
+			style = defaultHighlightStyle
+		}
+		fmt.Fprintf(w, "  sections:        %s\n", strings.Join(sections, ", "))
+		fmt.Fprintf(w, "  title:           %s\n", post.Title)
+		fmt.Fprintf(w, "  author:          %s\n", author)
+		fmt.Fprintf(w, "  tags:            %s\n", strings.Join(post.Tags, ", "))
+		fmt.Fprintf(w, "  layout:          %s\n", post.layout())
+		fmt.Fprintf(w, "  series:          %s\n", post.Series)
+		fmt.Fprintf(w, "  highlight_style: %s\n", style)
+		fmt.Fprintf(w, "  visibility:      %s\n", visibility)
+		fmt.Fprintf(w, "  draft:           %t\n", post.Draft)
+
+		if post.Title == "" {
+			report("missing title")
+		}
+		if post.Layout != "" && post.layout() != post.Layout {
+			report("invalid layout %q", post.Layout)
+		}
+		if _, err := os.Stat(post.layout()); err != nil {
+			report("layout %q: %v", post.layout(), err)
+		}
+		if _, ok := styles.Registry[style]; !ok {
+			report("unknown highlight_style %q", style)
+		}
+		switch visibility {
+		case VisibilityPublic, VisibilityUnlisted, VisibilityPrivate:
+		default:
+			report("unknown visibility %q", visibility)
+		}
+		if !post.Draft && hasPrivate(rest) {
+			warn("private block in a published post")
+		}
+	}
+	return problems
+}
@@ -0,0 +1,216 @@
+package main
+
+import (
+	"archive/zip"
+	"bytes"
+	"net/http"
+	"path"
+	"strconv"
+	"strings"
+
+	"github.com/yuin/goldmark/ast"
+	"github.com/yuin/goldmark/text"
+)
+
+// CodeBlock is a fenced code block from a post. Filename is set when the
+// block's info string has a filename attribute, such as:
+//
+//	```go filename="main.go"
+type CodeBlock struct {
+	Language string
+	Filename string
+	Code     []byte
+}
+
+// codeBlocks returns every fenced code block in the markdown, in order.
+// Blocks inside private blocks are skipped.
+func codeBlocks(src []byte) []CodeBlock {
+	src = blankPrivate(src)
+	doc := newMarkdown("").Parser().Parse(text.NewReader(src))
+	var blocks []CodeBlock
+	ast.Walk(doc, func(n ast.Node, entering bool) (ast.WalkStatus, error) {
+		fcb, ok := n.(*ast.FencedCodeBlock)
+		if !ok || !entering {
+			return ast.WalkContinue, nil
+		}
+		block := CodeBlock{Language: string(fcb.Language(src))}
+		if fcb.Info != nil {
+			block.Filename = infoAttrs(string(fcb.Info.Segment.Value(src)))["filename"]
+		}
+		lines := fcb.Lines()
+		for i := 0; i < lines.Len(); i++ {
+			seg := lines.At(i)
+			block.Code = append(block.Code, seg.Value(src)...)
+		}
+		blocks = append(blocks, block)
+		return ast.WalkSkipChildren, nil
+	})
+	return blocks
+}
+
+// infoAttrs parses the key=value pairs that follow the language in a fenced
+// code block's info string. Values may be quoted.
+func infoAttrs(info string) map[string]string {
+	attrs := make(map[string]string)
+	_, rest, _ := strings.Cut(strings.TrimSpace(info), " ")
+	rest = strings.Trim(strings.TrimSpace(rest), "{}")
+	for rest != "" {
+		rest = strings.TrimLeft(rest, " ,")
+		key, value, ok := strings.Cut(rest, "=")
+		if !ok {
+			break
+		}
+		key = strings.TrimSpace(key)
+		value = strings.TrimLeft(value, " ")
+		if strings.HasPrefix(value, `"`) {
+			end := strings.Index(value[1:], `"`)
+			if end < 0 {
+				break
+			}
+			attrs[key] = value[1 : end+1]
+			rest = value[end+2:]
+		} else {
+			v, r, _ := strings.Cut(value, " ")
+			attrs[key] = v
+			rest = r
+		}
+	}
+	return attrs
+}
+
+// cleanFilename returns a relative, slash separated path for name, or "" if
+// it would escape the directory it is placed in.
+func cleanFilename(name string) string {
+	name = path.Clean(strings.ReplaceAll(name, `\`, "/"))
+	if name == "." || path.IsAbs(name) || name == ".." || strings.HasPrefix(name, "../") {
+		return ""
+	}
+	return name
+}
+
+// codeContentTypes maps languages and file extensions to the content type we
+// serve them with. Anything a browser might execute, such as HTML or SVG, is
+// served as plain text instead.
+var codeContentTypes = map[string]string{
+	"go":   "text/x-go",
+	"sh":   "text/x-shellscript",
+	"bash": "text/x-shellscript",
+	"md":   "text/markdown",
+	"css":  "text/css",
+	"json": "application/json",
+	"toml": "application/toml",
+	"yaml": "application/yaml",
+	"yml":  "application/yaml",
+	"sql":  "application/sql",
+}
+
+func codeContentType(block CodeBlock) string {
+	ct, ok := codeContentTypes[strings.TrimPrefix(path.Ext(block.Filename), ".")]
+	if !ok {
+		ct, ok = codeContentTypes[block.Language]
+	}
+	if !ok {
+		ct = "text/plain"
+	}
+	return ct + "; charset=utf-8"
+}
+
+// CodeHandler serves the raw contents of a code block. Blocks can be
+// requested by their 1-based position in the post or by filename.
+func CodeHandler(sl SlugReader) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		slug := r.PathValue("slug")
+		postMarkdown, err := sl.Read(slug)
+		if err != nil {
+			http.Error(w, "Post not found", http.StatusNotFound)
+			return
+		}
+		post, rest, err := parsePost(sl, slug, postMarkdown)
+		if err != nil {
+			http.Error(w, "Error parsing frontmatter", http.StatusInternalServerError)
+			return
+		}
+		if post.Visibility == VisibilityPrivate && !isPreview(r) {
+			http.Error(w, "Post not found", http.StatusNotFound)
+			return
+		}
+		blocks := codeBlocks(rest)
+		name := r.PathValue("name")
+		var block *CodeBlock
+		if n, err := strconv.Atoi(name); err == nil {
+			if n >= 1 && n <= len(blocks) {
+				block = &blocks[n-1]
+			}
+		} else {
+			// Later blocks win, since posts tend to build up a file over time.
+			for i := range blocks {
+				if blocks[i].Filename != "" && cleanFilename(blocks[i].Filename) == cleanFilename(name) {
+					block = &blocks[i]
+				}
+			}
+		}
+		if block == nil {
+			http.Error(w, "Code block not found", http.StatusNotFound)
+			return
+		}
+		w.Header().Set("Content-Type", codeContentType(*block))
+		w.Header().Set("X-Content-Type-Options", "nosniff")
+		w.Write(block.Code)
+	}
+}
+
+// ExamplesHandler serves a zip containing every code block in a post that has
+// a filename, laid out as a project directory named after the post.
+func ExamplesHandler(sl SlugReader) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		slug := r.PathValue("slug")
+		postMarkdown, err := sl.Read(slug)
+		if err != nil {
+			http.Error(w, "Post not found", http.StatusNotFound)
+			return
+		}
+		post, rest, err := parsePost(sl, slug, postMarkdown)
+		if err != nil {
+			http.Error(w, "Error parsing frontmatter", http.StatusInternalServerError)
+			return
+		}
+		if post.Visibility == VisibilityPrivate && !isPreview(r) {
+			http.Error(w, "Post not found", http.StatusNotFound)
+			return
+		}
+		files := make(map[string][]byte)
+		var order []string
+		for _, block := range codeBlocks(rest) {
+			name := cleanFilename(block.Filename)
+			if name == "" {
+				continue
+			}
+			if _, ok := files[name]; !ok {
+				order = append(order, name)
+			}
+			files[name] = block.Code
+		}
+		if len(files) == 0 {
+			http.Error(w, "This post has no examples", http.StatusNotFound)
+			return
+		}
+		var buf bytes.Buffer
+		zw := zip.NewWriter(&buf)
+		for _, name := range order {
+			f, err := zw.Create(path.Join(slug, name))
+			if err != nil {
+				http.Error(w, "Error building zip", http.StatusInternalServerError)
+				return
+			}
+			f.Write(files[name])
+		}
+		err = zw.Close()
+		if err != nil {
+			http.Error(w, "Error building zip", http.StatusInternalServerError)
+			return
+		}
+		w.Header().Set("Content-Type", "application/zip")
+		w.Header().Set("Content-Disposition", `attachment; filename="`+slug+`-examples.zip"`)
+		w.Write(buf.Bytes())
+	}
+}
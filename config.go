@@ -0,0 +1,193 @@
+package main
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"errors"
+	"io/fs"
+	"log"
+
+	"github.com/BurntSushi/toml"
+)
+
+// Config holds the site wide settings read from jonblog.toml. Every field is
+// optional; a missing config file results in the defaults below.
+type Config struct {
+	Addr    string `toml:"addr"`
+	BaseURL string `toml:"base_url"`
+	// Secret is used to sign preview links, cookies and messages between
+	// replicas. It should be a long random string, the same on every replica.
+	// Without one a random secret is used, so anything signed stops working
+	// on restart, and replicas can't use peers.
+	Secret string `toml:"secret"`
+	// randomSecret is set when Secret was made up on startup.
+	randomSecret bool
+	// Dev shows private blocks on every page. It is meant for writing
+	// locally and must not be set in production.
+	Dev bool `toml:"dev"`
+	// DraftsDir is where unpublished posts live. Drafts are only viewable via
+	// a signed preview link.
+	DraftsDir string `toml:"drafts_dir"`
+	MediaDir  string `toml:"media_dir"`
+	// AlbumsDir holds photo albums, one directory per album.
+	AlbumsDir string `toml:"albums_dir"`
+	// CacheDir holds files we can always recreate, such as embed thumbnails.
+	CacheDir string `toml:"cache_dir"`
+	// DataDir holds the data collected from readers, such as reactions.
+	DataDir string `toml:"data_dir"`
+	// TrustedProxies are the addresses and CIDR ranges of reverse proxies in
+	// front of the server. Requests from them are attributed to the client
+	// in their X-Forwarded-For header, for rate limits and the bot filter.
+	TrustedProxies []string `toml:"trusted_proxies"`
+	// Reactions is the set of emoji readers can react to posts with.
+	Reactions []string      `toml:"reactions"`
+	SMTP      SMTPConfig    `toml:"smtp"`
+	Mail      MailConfig    `toml:"mail"`
+	Admin     AdminConfig   `toml:"admin"`
+	Previews  PreviewConfig `toml:"previews"`
+	Plugins   PluginConfig  `toml:"plugins"`
+	Bots      BotConfig     `toml:"bots"`
+	Icons     IconConfig    `toml:"icons"`
+	Replicas  ReplicaConfig `toml:"replicas"`
+	Static    StaticConfig  `toml:"static"`
+}
+
+// StaticConfig sets where `jonblog build` writes releases of the static site
+// and how many of them are kept for rollbacks.
+type StaticConfig struct {
+	Dir  string `toml:"dir"`
+	Keep int    `toml:"keep"`
+}
+
+// ReplicaConfig sets how servers sharing the same content tell each other
+// about content changes. Set at most one of Dir and Peers.
+type ReplicaConfig struct {
+	// Dir is a directory every replica can read and write.
+	Dir string `toml:"dir"`
+	// Peers are the base URLs of every replica, this one included.
+	Peers []string `toml:"peers"`
+}
+
+// IconConfig sets the image favicons and app icons are generated from. Icons
+// are only served when Source is set.
+type IconConfig struct {
+	// Source should be a square PNG or JPEG, at least 512 pixels wide.
+	Source string `toml:"source"`
+	// Background fills the icons that can't be transparent, as #rrggbb.
+	Background string `toml:"background"`
+}
+
+// BotConfig sets which clients are served. Addresses are single IPs or CIDR
+// ranges. For example, to keep AI crawlers to the docs:
+//
+//	[[bots.rules]]
+//	agents = ["ai"]
+//	paths = ["/docs/"]
+//	action = "allow"
+//
+//	[[bots.rules]]
+//	agents = ["ai"]
+//	action = "deny"
+type BotConfig struct {
+	Allow []string  `toml:"allow"`
+	Deny  []string  `toml:"deny"`
+	Rules []BotRule `toml:"rules"`
+	// NotFoundLimit is how many paths without a route an address may request
+	// in a minute before it is blocked for BlockMinutes. Zero disables the
+	// check.
+	NotFoundLimit int `toml:"not_found_limit"`
+	// MissingLimit is the same for paths that have a route but nothing to
+	// serve, such as posts that don't exist. It is higher, since readers
+	// follow stale links, but still catches bots guessing slugs.
+	MissingLimit int `toml:"missing_limit"`
+	BlockMinutes int `toml:"block_minutes"`
+}
+
+// BotRule allows or denies requests whose user agent contains one of Agents,
+// ignoring case. The agent "ai" matches every known AI crawler. When Paths is
+// set, the rule only applies to paths starting with one of them.
+type BotRule struct {
+	Agents []string `toml:"agents"`
+	Paths  []string `toml:"paths"`
+	Action string   `toml:"action"`
+}
+
+// PluginConfig sets where WebAssembly plugins are loaded from and the limits
+// each plugin call runs under. Limits of zero or less mean the defaults,
+// defaultPluginMemoryMB and defaultPluginTimeoutMS.
+type PluginConfig struct {
+	Dir       string `toml:"dir"`
+	MemoryMB  int    `toml:"memory_mb"`
+	TimeoutMS int    `toml:"timeout_ms"`
+}
+
+// PreviewConfig enables admin only previews of any branch of the content
+// repository at /preview/{ref}/. Previews are disabled unless Repo is set.
+type PreviewConfig struct {
+	// Repo is the path to the git repository holding the content.
+	Repo string `toml:"repo"`
+	// IdleMinutes is how long a preview is kept after it was last viewed.
+	IdleMinutes int `toml:"idle_minutes"`
+}
+
+// AdminConfig holds the credentials for the /admin pages, which are disabled
+// unless a password is set.
+type AdminConfig struct {
+	Username string `toml:"username"`
+	Password string `toml:"password"`
+}
+
+// SMTPConfig configures the optional SMTP listener that turns incoming email
+// into drafts. The listener is only started when Addr is set.
+type SMTPConfig struct {
+	Addr string `toml:"addr"`
+	// Allowed is the list of sender addresses that may create drafts.
+	Allowed []string `toml:"allowed"`
+	// Secret must appear either as the +tag of the recipient address
+	// (drafts+SECRET@example.com) or in square brackets in the subject.
+	Secret string `toml:"secret"`
+}
+
+// MailConfig is the outgoing mail server used to notify authors. When Addr is
+// empty, notifications are written to the log instead.
+type MailConfig struct {
+	Addr     string `toml:"addr"`
+	Username string `toml:"username"`
+	Password string `toml:"password"`
+	From     string `toml:"from"`
+}
+
+func LoadConfig(path string) (Config, error) {
+	cfg := Config{
+		Addr:      ":3030",
+		BaseURL:   "http://localhost:3030",
+		DraftsDir: "drafts",
+		MediaDir:  "media",
+		DataDir:   "data",
+		CacheDir:  "cache",
+		AlbumsDir: "albums",
+		Reactions: []string{"👍", "❤️", "🎉", "🤔"},
+		Previews:  PreviewConfig{IdleMinutes: 30},
+		Plugins:   PluginConfig{Dir: "plugins", MemoryMB: defaultPluginMemoryMB, TimeoutMS: defaultPluginTimeoutMS},
+		Bots:      BotConfig{NotFoundLimit: 30, MissingLimit: 60, BlockMinutes: 10},
+		Icons:     IconConfig{Background: "#ffffff"},
+		Static:    StaticConfig{Dir: "static", Keep: 5},
+	}
+	_, err := toml.DecodeFile(path, &cfg)
+	if err != nil && !errors.Is(err, fs.ErrNotExist) {
+		return cfg, err
+	}
+	if cfg.Secret == "" {
+		// Anything signed with this secret stops working on restart.
+		log.Printf("config: no secret set, using a random one; set one so links and sign-ins survive restarts")
+		cfg.Secret = randomSecret()
+		cfg.randomSecret = true
+	}
+	return cfg, nil
+}
+
+func randomSecret() string {
+	b := make([]byte, 32)
+	rand.Read(b)
+	return hex.EncodeToString(b)
+}
@@ -0,0 +1,40 @@
+package main
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestLoadConfigSecret(t *testing.T) {
+	tests := []struct {
+		name       string
+		config     string
+		wantRandom bool
+	}{
+		{"no config", "", true},
+		{"no secret", `addr = ":8080"`, true},
+		{"secret", `secret = "s3"`, false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			path := filepath.Join(t.TempDir(), "jonblog.toml")
+			if tt.config != "" {
+				err := os.WriteFile(path, []byte(tt.config), 0644)
+				if err != nil {
+					t.Fatal(err)
+				}
+			}
+			cfg, err := LoadConfig(path)
+			if err != nil {
+				t.Fatalf("LoadConfig() error = %v", err)
+			}
+			if cfg.Secret == "" {
+				t.Errorf("LoadConfig() left the secret empty")
+			}
+			if cfg.randomSecret != tt.wantRandom {
+				t.Errorf("randomSecret = %t, want %t", cfg.randomSecret, tt.wantRandom)
+			}
+		})
+	}
+}
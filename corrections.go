@@ -0,0 +1,385 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/yuin/goldmark/ast"
+	"github.com/yuin/goldmark/parser"
+	"github.com/yuin/goldmark/text"
+	"github.com/yuin/goldmark/util"
+)
+
+// paragraphAnchors gives every paragraph an id of the form p-N, numbered in
+// document order starting at 1, so readers can link to and correct them.
+type paragraphAnchors struct{}
+
+func (paragraphAnchors) Transform(doc *ast.Document, reader text.Reader, pc parser.Context) {
+	n := 0
+	ast.Walk(doc, func(node ast.Node, entering bool) (ast.WalkStatus, error) {
+		if p, ok := node.(*ast.Paragraph); ok && entering {
+			if p.Lines().Len() == 1 {
+				seg := p.Lines().At(0)
+				if isPlaceholder(seg.Value(reader.Source())) {
+					return ast.WalkContinue, nil
+				}
+			}
+			n++
+			p.SetAttributeString("id", []byte("p-"+strconv.Itoa(n)))
+		}
+		return ast.WalkContinue, nil
+	})
+}
+
+var paragraphAnchorsTransformer = parser.WithASTTransformers(util.Prioritized(paragraphAnchors{}, 100))
+
+// Paragraph maps a rendered paragraph back to the lines of the markdown file
+// it came from. Line numbers are 1-based and include the frontmatter.
+type Paragraph struct {
+	N         int
+	StartLine int
+	EndLine   int
+	Source    string
+}
+
+// Excerpt returns the start of the paragraph for use in a list of choices.
+func (p Paragraph) Excerpt() string {
+	s := strings.Join(strings.Fields(p.Source), " ")
+	if r := []rune(s); len(r) > 60 {
+		s = string(r[:60]) + "…"
+	}
+	return s
+}
+
+// paragraphs returns the paragraphs of a post in the same order they are
+// numbered by paragraphAnchors. Shortcodes are skipped.
+func paragraphs(postMarkdown string, rest []byte) []Paragraph {
+	offset := 0
+	if strings.HasSuffix(postMarkdown, string(rest)) {
+		offset = strings.Count(postMarkdown[:len(postMarkdown)-len(rest)], "\n")
+	}
+	lines := strings.SplitAfter(string(rest), "\n")
+	src := blankShortcodes(rest)
+	doc := newMarkdown("").Parser().Parse(text.NewReader(src))
+	var paras []Paragraph
+	ast.Walk(doc, func(node ast.Node, entering bool) (ast.WalkStatus, error) {
+		p, ok := node.(*ast.Paragraph)
+		if !ok || !entering || p.Lines().Len() == 0 {
+			return ast.WalkContinue, nil
+		}
+		first, last := p.Lines().At(0), p.Lines().At(p.Lines().Len()-1)
+		start := strings.Count(string(src[:first.Start]), "\n")
+		end := strings.Count(string(src[:last.Stop-1]), "\n")
+		paras = append(paras, Paragraph{
+			N:         len(paras) + 1,
+			StartLine: start + offset + 1,
+			EndLine:   end + offset + 1,
+			Source:    strings.Join(lines[start:end+1], ""),
+		})
+		return ast.WalkContinue, nil
+	})
+	return paras
+}
+
+// Correction is a reader's proposed change to a paragraph of a post, stored
+// as a patch against the lines of the markdown source.
+type Correction struct {
+	ID        int       `json:"id"`
+	Slug      string    `json:"slug"`
+	Paragraph int       `json:"paragraph"`
+	StartLine int       `json:"start_line"`
+	EndLine   int       `json:"end_line"`
+	Original  string    `json:"original"`
+	Suggested string    `json:"suggested"`
+	Note      string    `json:"note,omitempty"`
+	Status    string    `json:"status"`
+	Created   time.Time `json:"created"`
+}
+
+const (
+	CorrectionPending  = "pending"
+	CorrectionApplied  = "applied"
+	CorrectionRejected = "rejected"
+)
+
+// Diff returns a word level diff between the original and suggested text.
+func (c Correction) Diff() []DiffOp {
+	return wordDiff(c.Original, c.Suggested)
+}
+
+type correctionData struct {
+	NextID      int          `json:"next_id"`
+	Corrections []Correction `json:"corrections"`
+}
+
+type CorrectionStore struct {
+	file *JSONFile[correctionData]
+}
+
+func NewCorrectionStore(path string) (*CorrectionStore, error) {
+	file, err := OpenJSONFile[correctionData](path)
+	if err != nil {
+		return nil, err
+	}
+	return &CorrectionStore{file: file}, nil
+}
+
+func (cs *CorrectionStore) Add(c Correction) error {
+	return cs.file.Update(func(data *correctionData) error {
+		data.NextID++
+		c.ID = data.NextID
+		c.Status = CorrectionPending
+		c.Created = time.Now()
+		data.Corrections = append(data.Corrections, c)
+		return nil
+	})
+}
+
+// Pending returns every correction that hasn't been applied or rejected.
+func (cs *CorrectionStore) Pending() []Correction {
+	var pending []Correction
+	cs.file.View(func(data *correctionData) {
+		for _, c := range data.Corrections {
+			if c.Status == CorrectionPending {
+				pending = append(pending, c)
+			}
+		}
+	})
+	return pending
+}
+
+// Resolve calls fn with the pending correction and, if fn succeeds, marks the
+// correction with status.
+func (cs *CorrectionStore) Resolve(id int, status string, fn func(c Correction) error) error {
+	return cs.file.Update(func(data *correctionData) error {
+		for i, c := range data.Corrections {
+			if c.ID != id || c.Status != CorrectionPending {
+				continue
+			}
+			err := fn(c)
+			if err != nil {
+				return err
+			}
+			data.Corrections[i].Status = status
+			return nil
+		}
+		return errors.New("correction not found")
+	})
+}
+
+// ParagraphHandler serves the markdown source of a paragraph, which the
+// correction form starts from. Posts only list their paragraphs' numbers so
+// that every page view doesn't carry a second copy of the post.
+func ParagraphHandler(sl SlugReader) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		slug := r.PathValue("slug")
+		postMarkdown, err := sl.Read(slug)
+		if err != nil {
+			http.Error(w, "Post not found", http.StatusNotFound)
+			return
+		}
+		post, rest, err := parsePost(sl, slug, postMarkdown)
+		if err != nil {
+			http.Error(w, "Error parsing frontmatter", http.StatusInternalServerError)
+			return
+		}
+		if post.Visibility == VisibilityPrivate && !isPreview(r) {
+			http.Error(w, "Post not found", http.StatusNotFound)
+			return
+		}
+		n, _ := strconv.Atoi(r.PathValue("n"))
+		paras := paragraphs(postMarkdown, rest)
+		if n < 1 || n > len(paras) {
+			http.Error(w, "Paragraph not found", http.StatusNotFound)
+			return
+		}
+		w.Header().Set("Content-Type", "text/plain; charset=utf-8")
+		w.Header().Set("X-Content-Type-Options", "nosniff")
+		w.Write([]byte(paras[n-1].Source))
+	}
+}
+
+// CorrectionHandler accepts a reader's suggested correction to a paragraph.
+func CorrectionHandler(sl SlugReader, cs *CorrectionStore) http.HandlerFunc {
+	limiter := &RateLimiter{Limit: 5, Window: time.Minute}
+	return func(w http.ResponseWriter, r *http.Request) {
+		slug := r.PathValue("slug")
+		postMarkdown, err := sl.Read(slug)
+		if err != nil {
+			http.Error(w, "Post not found", http.StatusNotFound)
+			return
+		}
+		post, rest, err := parsePost(sl, slug, postMarkdown)
+		if err != nil {
+			http.Error(w, "Error parsing frontmatter", http.StatusInternalServerError)
+			return
+		}
+		if post.Visibility == VisibilityPrivate && !isPreview(r) {
+			http.Error(w, "Post not found", http.StatusNotFound)
+			return
+		}
+		if !limiter.Allow(clientIP(r)) {
+			http.Error(w, "Too many requests", http.StatusTooManyRequests)
+			return
+		}
+		n, _ := strconv.Atoi(r.FormValue("paragraph"))
+		paras := paragraphs(postMarkdown, rest)
+		if n < 1 || n > len(paras) {
+			http.Error(w, "Unknown paragraph", http.StatusBadRequest)
+			return
+		}
+		suggested := strings.ReplaceAll(r.FormValue("text"), "\r\n", "\n")
+		if strings.TrimSpace(suggested) == "" || len(suggested) > 10000 {
+			http.Error(w, "Invalid correction", http.StatusBadRequest)
+			return
+		}
+		if !strings.HasSuffix(suggested, "\n") {
+			suggested += "\n"
+		}
+		p := paras[n-1]
+		if suggested == p.Source {
+			http.Redirect(w, r, "/posts/"+slug+"#p-"+strconv.Itoa(n), http.StatusSeeOther)
+			return
+		}
+		err = cs.Add(Correction{
+			Slug:      slug,
+			Paragraph: n,
+			StartLine: p.StartLine,
+			EndLine:   p.EndLine,
+			Original:  p.Source,
+			Suggested: suggested,
+			Note:      r.FormValue("note"),
+		})
+		if err != nil {
+			http.Error(w, "Error saving correction", http.StatusInternalServerError)
+			return
+		}
+		http.Redirect(w, r, "/posts/"+slug+"#p-"+strconv.Itoa(n), http.StatusSeeOther)
+	}
+}
+
+// applyCorrection replaces the lines the correction was made against, but only
+// if they haven't changed since the correction was submitted.
+func applyCorrection(fsr FileReader, c Correction) error {
+	postMarkdown, err := fsr.Read(c.Slug)
+	if err != nil {
+		return err
+	}
+	lines := strings.SplitAfter(postMarkdown, "\n")
+	if c.EndLine > len(lines) || strings.Join(lines[c.StartLine-1:c.EndLine], "") != c.Original {
+		return fmt.Errorf("post %q has changed since the correction was submitted", c.Slug)
+	}
+	updated := strings.Join(lines[:c.StartLine-1], "") + c.Suggested + strings.Join(lines[c.EndLine:], "")
+	return fsr.Write(c.Slug, updated)
+}
+
+// AdminCorrectionsHandler lists pending corrections with a diff of each.
+func AdminCorrectionsHandler(cs *CorrectionStore) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		tpl, err := parseTemplate("admin_corrections.gohtml")
+		if err != nil {
+			http.Error(w, "Error parsing template", http.StatusInternalServerError)
+			return
+		}
+		err = tpl.Execute(w, cs.Pending())
+	}
+}
+
+// AdminResolveCorrectionHandler applies or rejects a correction.
+func AdminResolveCorrectionHandler(fsr FileReader, cs *CorrectionStore, status string) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		id, err := strconv.Atoi(r.PathValue("id"))
+		if err != nil {
+			http.Error(w, "Correction not found", http.StatusNotFound)
+			return
+		}
+		err = cs.Resolve(id, status, func(c Correction) error {
+			if status == CorrectionApplied {
+				return applyCorrection(fsr, c)
+			}
+			return nil
+		})
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusConflict)
+			return
+		}
+		http.Redirect(w, r, "/admin/corrections", http.StatusSeeOther)
+	}
+}
+
+// DiffOp is one piece of a diff. Op is "=", "-" or "+".
+type DiffOp struct {
+	Op   string
+	Text string
+}
+
+// wordDiff diffs two strings word by word (keeping whitespace attached to the
+// preceding word) using the longest common subsequence.
+func wordDiff(a, b string) []DiffOp {
+	x, y := splitWords(a), splitWords(b)
+	lcs := make([][]int, len(x)+1)
+	for i := range lcs {
+		lcs[i] = make([]int, len(y)+1)
+	}
+	for i := len(x) - 1; i >= 0; i-- {
+		for j := len(y) - 1; j >= 0; j-- {
+			if x[i] == y[j] {
+				lcs[i][j] = lcs[i+1][j+1] + 1
+			} else {
+				lcs[i][j] = max(lcs[i+1][j], lcs[i][j+1])
+			}
+		}
+	}
+	var ops []DiffOp
+	add := func(op, s string) {
+		if len(ops) > 0 && ops[len(ops)-1].Op == op {
+			ops[len(ops)-1].Text += s
+			return
+		}
+		ops = append(ops, DiffOp{Op: op, Text: s})
+	}
+	i, j := 0, 0
+	for i < len(x) && j < len(y) {
+		switch {
+		case x[i] == y[j]:
+			add("=", x[i])
+			i++
+			j++
+		case lcs[i+1][j] >= lcs[i][j+1]:
+			add("-", x[i])
+			i++
+		default:
+			add("+", y[j])
+			j++
+		}
+	}
+	for ; i < len(x); i++ {
+		add("-", x[i])
+	}
+	for ; j < len(y); j++ {
+		add("+", y[j])
+	}
+	return ops
+}
+
+func splitWords(s string) []string {
+	var words []string
+	start := 0
+	inSpace := false
+	for i, r := range s {
+		space := r == ' ' || r == '\t' || r == '\n'
+		if !space && inSpace {
+			words = append(words, s[start:i])
+			start = i
+		}
+		inSpace = space
+	}
+	if start < len(s) {
+		words = append(words, s[start:])
+	}
+	return words
+}
@@ -0,0 +1,77 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestCorrectionsPrivate(t *testing.T) {
+	dir := t.TempDir()
+	writeFiles(t, dir, map[string]string{
+		"public.md": `+++
+title = "Public"
++++
+Some *markdown* here.
+
+Second paragraph, which is long enough for its excerpt to leave out the
+[link](/at-the-end) at the end.
+`,
+		"secret.md": `+++
+title = "Secret"
+visibility = "private"
++++
+Not for *readers*.
+`,
+	})
+	fsr := FileReader{Dir: dir}
+	cs, err := NewCorrectionStore(filepath.Join(t.TempDir(), "corrections.json"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	mux := http.NewServeMux()
+	mux.HandleFunc("GET /posts/{slug}/paragraphs/{n}", ParagraphHandler(fsr))
+	mux.HandleFunc("POST /posts/{slug}/corrections", CorrectionHandler(fsr, cs))
+	do := func(method, target string) *httptest.ResponseRecorder {
+		form := url.Values{"paragraph": {"1"}, "text": {"Fixed."}}
+		r := httptest.NewRequest(method, target, strings.NewReader(form.Encode()))
+		r.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+		rec := httptest.NewRecorder()
+		mux.ServeHTTP(rec, r)
+		return rec
+	}
+
+	tests := []struct {
+		method, target string
+		wantCode       int
+		wantBody       string
+	}{
+		{http.MethodGet, "/posts/public/paragraphs/1", http.StatusOK, "Some *markdown* here.\n"},
+		{http.MethodGet, "/posts/public/paragraphs/2", http.StatusOK, "Second paragraph, which is long enough for its excerpt to leave out the\n[link](/at-the-end) at the end.\n"},
+		{http.MethodGet, "/posts/public/paragraphs/3", http.StatusNotFound, ""},
+		{http.MethodGet, "/posts/secret/paragraphs/1", http.StatusNotFound, ""},
+		{http.MethodPost, "/posts/secret/corrections", http.StatusNotFound, ""},
+		{http.MethodPost, "/posts/public/corrections", http.StatusSeeOther, ""},
+	}
+	for _, tt := range tests {
+		rec := do(tt.method, tt.target)
+		if rec.Code != tt.wantCode {
+			t.Errorf("%s %s: status = %d, want %d", tt.method, tt.target, rec.Code, tt.wantCode)
+		}
+		if tt.wantBody != "" && rec.Body.String() != tt.wantBody {
+			t.Errorf("%s %s: body = %q, want %q", tt.method, tt.target, rec.Body, tt.wantBody)
+		}
+	}
+	pending := cs.Pending()
+	if len(pending) != 1 || pending[0].Slug != "public" {
+		t.Errorf("Pending() = %+v, want just the correction to public", pending)
+	}
+
+	page := serve(t, "GET /posts/{slug}", "/posts/public", PostHandler(fsr, "https://example.com", nil, nil))
+	if strings.Contains(page, "[link](/at-the-end)") {
+		t.Errorf("post page contains the markdown source of its paragraphs")
+	}
+}
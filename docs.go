@@ -0,0 +1,461 @@
+package main
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"html/template"
+	"io/fs"
+	"net/http"
+	"os"
+	"path"
+	"path/filepath"
+	"sort"
+	"strings"
+
+	"github.com/BurntSushi/toml"
+	"github.com/adrg/frontmatter"
+	"github.com/yuin/goldmark/ast"
+	"github.com/yuin/goldmark/parser"
+	"github.com/yuin/goldmark/text"
+	"github.com/yuin/goldmark/util"
+)
+
+// Docs sections hold project guides rather than blog posts. A section is a
+// docs section when its index file sets its type:
+//
+//	type = "docs"
+//	title = "Widget Guide"
+//
+// Docs pages are served under /docs/ by their path rather than by slug, so
+// page names only need to be unique within a directory, and they never show
+// up in the list of posts. Each page has a sidebar of every page in the
+// section, ordered by weight and then title, with subsections as groups. A
+// subsection whose index sets version = "v2" is a version of the docs, and
+// readers can switch between versions from any page.
+const docsType = "docs"
+
+// sectionIndex is the part of an index file that describes the section
+// itself.
+type sectionIndex struct {
+	Type    string `toml:"type"`
+	Title   string `toml:"title"`
+	Weight  int    `toml:"weight"`
+	Version string `toml:"version"`
+}
+
+// readIndex reads the index file of dir. ok is false if dir has no index
+// file. body is the markdown following the frontmatter of an _index.md file.
+func readIndex(dir string) (idx sectionIndex, body []byte, ok bool, err error) {
+	_, err = toml.DecodeFile(filepath.Join(dir, indexTOML), &idx)
+	if err == nil {
+		return idx, nil, true, nil
+	}
+	if !errors.Is(err, fs.ErrNotExist) {
+		return idx, nil, false, err
+	}
+	b, err := os.ReadFile(filepath.Join(dir, indexMD))
+	if errors.Is(err, fs.ErrNotExist) {
+		return idx, nil, false, nil
+	}
+	if err != nil {
+		return idx, nil, false, err
+	}
+	body, err = frontmatter.Parse(bytes.NewReader(b), &idx)
+	return idx, body, err == nil, err
+}
+
+// DocsReader reads docs pages from Dir. The slug of a page is its path
+// relative to Dir without the .md extension, such as "guides/v2/install".
+// The slug of a subsection is its directory, and reads its _index.md.
+type DocsReader struct {
+	Dir string
+}
+
+func (dr DocsReader) dir(slug string) string {
+	return filepath.Join(dr.Dir, filepath.FromSlash(slug))
+}
+
+func (dr DocsReader) file(slug string) string {
+	if isSection(dr.dir(slug)) {
+		return filepath.Join(dr.dir(slug), indexMD)
+	}
+	return dr.dir(slug) + ".md"
+}
+
+// root returns the slug of the docs section containing slug. As with posts,
+// every directory on the way must be a section.
+func (dr DocsReader) root(slug string) (string, error) {
+	parts := strings.Split(slug, "/")
+	for _, part := range parts {
+		if !validSlug(part) {
+			return "", os.ErrNotExist
+		}
+	}
+	if !isSection(dr.dir(slug)) {
+		// A page, so only the directories above it need to be sections.
+		parts = parts[:len(parts)-1]
+	}
+	root := ""
+	for i := range parts {
+		dir := dr.dir(path.Join(parts[:i+1]...))
+		if !isSection(dir) {
+			return "", os.ErrNotExist
+		}
+		if root == "" && isDocs(dir) {
+			root = path.Join(parts[:i+1]...)
+		}
+	}
+	if root == "" {
+		return "", os.ErrNotExist
+	}
+	return root, nil
+}
+
+func (dr DocsReader) Read(slug string) (string, error) {
+	_, err := dr.root(slug)
+	if err != nil {
+		return "", err
+	}
+	b, err := os.ReadFile(dr.file(slug))
+	if err != nil {
+		return "", err
+	}
+	return string(b), nil
+}
+
+// Sections returns the slug of every docs section.
+func (dr DocsReader) Sections() ([]string, error) {
+	root := dr.Dir
+	if root == "" {
+		root = "."
+	}
+	var slugs []string
+	err := filepath.WalkDir(root, func(path string, d fs.DirEntry, err error) error {
+		if err != nil {
+			return err
+		}
+		if !d.IsDir() || path == root {
+			return nil
+		}
+		if !isSection(path) {
+			return filepath.SkipDir
+		}
+		if isDocs(path) {
+			rel, err := filepath.Rel(root, path)
+			if err != nil {
+				return err
+			}
+			slugs = append(slugs, filepath.ToSlash(rel))
+			return filepath.SkipDir
+		}
+		return nil
+	})
+	return slugs, err
+}
+
+func (dr DocsReader) Defaults(slug string) ([]Defaults, error) {
+	_, err := dr.root(slug)
+	if err != nil {
+		return nil, err
+	}
+	return sectionDefaults(dr.Dir, filepath.Dir(dr.file(slug)))
+}
+
+// DocNode is a page or subsection in a docs sidebar.
+type DocNode struct {
+	Title   string
+	Slug    string
+	Weight  int
+	Version string
+	// Page is true if the node has content of its own. Subsections only do
+	// when their _index.md has a body.
+	Page     bool
+	Children []*DocNode
+	// Current is set on the page being viewed, and Open on the subsections
+	// containing it.
+	Current bool
+	Open    bool
+}
+
+func (n *DocNode) URL() string {
+	return "/docs/" + n.Slug
+}
+
+// find returns the node for slug beneath n, or nil.
+func (n *DocNode) find(slug string) *DocNode {
+	if n.Slug == slug {
+		return n
+	}
+	for _, child := range n.Children {
+		if found := child.find(slug); found != nil {
+			return found
+		}
+	}
+	return nil
+}
+
+// mark sets Current and Open for the page at slug, and reports whether it
+// was found beneath n.
+func (n *DocNode) mark(slug string) bool {
+	n.Current = n.Slug == slug
+	for _, child := range n.Children {
+		if child.mark(slug) {
+			n.Open = true
+		}
+	}
+	return n.Current || n.Open
+}
+
+// docPages returns the pages in nodes, in sidebar order.
+func docPages(nodes []*DocNode) []*DocNode {
+	var pages []*DocNode
+	for _, n := range nodes {
+		if n.Page {
+			pages = append(pages, n)
+		}
+		pages = append(pages, docPages(n.Children)...)
+	}
+	return pages
+}
+
+// tree reads the section at slug and everything beneath it. Only the
+// frontmatter of each page is read. Pages that are not public are left out.
+func (dr DocsReader) tree(slug string) (*DocNode, error) {
+	dir := dr.dir(slug)
+	idx, body, _, err := readIndex(dir)
+	if err != nil {
+		return nil, err
+	}
+	node := &DocNode{
+		Title:   idx.Title,
+		Slug:    slug,
+		Weight:  idx.Weight,
+		Version: idx.Version,
+		Page:    len(bytes.TrimSpace(body)) > 0,
+	}
+	if node.Title == "" {
+		node.Title = path.Base(slug)
+	}
+	entries, err := os.ReadDir(dir)
+	if err != nil {
+		return nil, err
+	}
+	for _, entry := range entries {
+		name := entry.Name()
+		if entry.IsDir() {
+			if !isSection(filepath.Join(dir, name)) {
+				continue
+			}
+			child, err := dr.tree(slug + "/" + name)
+			if err != nil {
+				return nil, err
+			}
+			node.Children = append(node.Children, child)
+			continue
+		}
+		if filepath.Ext(name) != ".md" || name == indexMD {
+			continue
+		}
+		b, err := os.ReadFile(filepath.Join(dir, name))
+		if err != nil {
+			return nil, err
+		}
+		var page Post
+		_, err = frontmatter.Parse(bytes.NewReader(b), &page)
+		if err != nil {
+			return nil, fmt.Errorf("%s: %w", filepath.Join(dir, name), err)
+		}
+		if page.Visibility != "" && page.Visibility != VisibilityPublic {
+			continue
+		}
+		child := &DocNode{Title: page.Title, Slug: slug + "/" + strings.TrimSuffix(name, ".md"), Weight: page.Weight, Page: true}
+		if child.Title == "" {
+			child.Title = strings.TrimSuffix(name, ".md")
+		}
+		node.Children = append(node.Children, child)
+	}
+	sort.SliceStable(node.Children, func(i, j int) bool {
+		a, b := node.Children[i], node.Children[j]
+		if a.Weight != b.Weight {
+			return a.Weight < b.Weight
+		}
+		return a.Title < b.Title
+	})
+	return node, nil
+}
+
+// Heading is an entry in a docs page's "On this page" list.
+type Heading struct {
+	Level int
+	ID    string
+	Text  string
+}
+
+// headingTOC collects the h2 and h3 headings of a page. It runs after the
+// parser has given headings their ids.
+type headingTOC struct {
+	headings *[]Heading
+}
+
+func (t headingTOC) Transform(doc *ast.Document, reader text.Reader, pc parser.Context) {
+	ast.Walk(doc, func(node ast.Node, entering bool) (ast.WalkStatus, error) {
+		h, ok := node.(*ast.Heading)
+		if !ok || !entering || h.Level < 2 || h.Level > 3 {
+			return ast.WalkContinue, nil
+		}
+		id, _ := h.AttributeString("id")
+		b, _ := id.([]byte)
+		*t.headings = append(*t.headings, Heading{Level: h.Level, ID: string(b), Text: string(h.Text(reader.Source()))})
+		return ast.WalkSkipChildren, nil
+	})
+}
+
+// renderDoc renders a docs page. Headings are given ids, and the h2 and h3
+// headings are returned for the table of contents.
+func renderDoc(rc *RenderContext, src []byte) (template.HTML, []Heading, error) {
+	var toc []Heading
+	html, err := renderPage(rc, src,
+		parser.WithAutoHeadingID(),
+		parser.WithASTTransformers(util.Prioritized(headingTOC{headings: &toc}, 100)),
+	)
+	return html, toc, err
+}
+
+// DocVersion is an entry in the version switcher.
+type DocVersion struct {
+	Name    string
+	URL     string
+	Current bool
+}
+
+// DocsPage is the data passed to a docs layout.
+type DocsPage struct {
+	Post
+	// Section is the docs section the page is in.
+	Section  *DocNode
+	Sidebar  []*DocNode
+	TOC      []Heading
+	Prev     *DocNode
+	Next     *DocNode
+	Versions []DocVersion
+}
+
+func DocsHandler(dr DocsReader) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		slug := strings.Trim(r.PathValue("path"), "/")
+		rootSlug, err := dr.root(slug)
+		if err != nil {
+			http.Error(w, "Page not found", http.StatusNotFound)
+			return
+		}
+		root, err := dr.tree(rootSlug)
+		if err != nil {
+			http.Error(w, "Error reading docs", http.StatusInternalServerError)
+			return
+		}
+
+		// Versions are listed by weight, then newest first. The sidebar shows
+		// the version being viewed, or everything else in the section when
+		// the page isn't in a version.
+		var versions, sidebar []*DocNode
+		for _, n := range root.Children {
+			if n.Version != "" {
+				versions = append(versions, n)
+			} else {
+				sidebar = append(sidebar, n)
+			}
+		}
+		sort.SliceStable(versions, func(i, j int) bool {
+			if versions[i].Weight != versions[j].Weight {
+				return versions[i].Weight < versions[j].Weight
+			}
+			return versions[i].Version > versions[j].Version
+		})
+		top := root
+		for _, v := range versions {
+			if slug == v.Slug || strings.HasPrefix(slug, v.Slug+"/") {
+				top, sidebar = v, v.Children
+			}
+		}
+		order := docPages(sidebar)
+		if top.Page {
+			order = append([]*DocNode{top}, order...)
+		}
+
+		// Sections without content of their own go to their first page.
+		if node := root.find(slug); node != nil && !node.Page {
+			var first []*DocNode
+			switch node {
+			case root, top:
+				first = order
+			default:
+				first = docPages(node.Children)
+			}
+			switch {
+			case len(first) > 0:
+				http.Redirect(w, r, first[0].URL(), http.StatusFound)
+			case node == root && len(versions) > 0:
+				http.Redirect(w, r, versions[0].URL(), http.StatusFound)
+			default:
+				http.Error(w, "Page not found", http.StatusNotFound)
+			}
+			return
+		}
+
+		postMarkdown, err := dr.Read(slug)
+		if err != nil {
+			http.Error(w, "Page not found", http.StatusNotFound)
+			return
+		}
+		post, rest, err := parsePost(dr, slug, postMarkdown)
+		if err != nil {
+			http.Error(w, "Error parsing frontmatter", http.StatusInternalServerError)
+			return
+		}
+		if post.Visibility == VisibilityPrivate && !isPreview(r) {
+			http.Error(w, "Page not found", http.StatusNotFound)
+			return
+		}
+		page := DocsPage{Post: post, Section: root, Sidebar: sidebar}
+		rc := &RenderContext{Slug: slug, Style: post.HighlightStyle, Request: r}
+		page.Content, page.TOC, err = renderDoc(rc, rest)
+		if err != nil {
+			http.Error(w, "Error converting markdown", http.StatusInternalServerError)
+			return
+		}
+		root.mark(slug)
+		for i, n := range order {
+			if n.Slug != slug {
+				continue
+			}
+			if i > 0 {
+				page.Prev = order[i-1]
+			}
+			if i < len(order)-1 {
+				page.Next = order[i+1]
+			}
+		}
+		// Switching versions keeps the reader on the same page when the
+		// other version has it.
+		rel := ""
+		if top != root {
+			rel = strings.TrimPrefix(slug, top.Slug)
+		}
+		for _, v := range versions {
+			dv := DocVersion{Name: v.Version, URL: v.URL(), Current: v == top}
+			if n := v.find(v.Slug + rel); rel != "" && n != nil && n.Page {
+				dv.URL = n.URL()
+			}
+			page.Versions = append(page.Versions, dv)
+		}
+
+		tpl, err := parseTemplate(post.layout())
+		if err != nil {
+			http.Error(w, "Error parsing template", http.StatusInternalServerError)
+			return
+		}
+		w.Header().Set("Content-Security-Policy", rc.ContentSecurityPolicy())
+		err = tpl.Execute(w, page)
+	}
+}
@@ -0,0 +1,391 @@
+package main
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"html/template"
+	"io"
+	"io/fs"
+	"log"
+	"math"
+	"net/http"
+	"net/url"
+	"os"
+	"path/filepath"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Third party embeds are rendered as facades: a static placeholder with a
+// locally cached thumbnail and a button. The real iframe is only created once
+// the reader clicks the button, so opening a post never contacts a third
+// party on its own.
+//
+// Thumbnail URLs are signed when a post is rendered, so the cache only ever
+// fetches thumbnails that some post links to.
+func (ec *EmbedCache) register() {
+	shortcodes["youtube"] = ec.facadeShortcode(youTubeFacade)
+	shortcodes["map"] = ec.facadeShortcode(mapFacade)
+	shortcodes["mastodon"] = ec.facadeShortcode(mastodonFacade)
+}
+
+// facadeShortcode returns a shortcode rendering the facade built by fn.
+// Exports link to the embed instead, since the facade needs our script.
+func (ec *EmbedCache) facadeShortcode(fn func(sc Shortcode) (facade, error)) shortcodeDef {
+	return shortcodeDef{
+		render: func(sc Shortcode, rc *RenderContext) (template.HTML, error) {
+			f, err := fn(sc)
+			if err != nil {
+				return "", err
+			}
+			if f.Thumb != "" {
+				f.Thumb = ec.thumbURL(f.Thumb)
+			}
+			return renderFacade(rc, f)
+		},
+		markdown: func(sc Shortcode) (string, error) {
+			f, err := fn(sc)
+			if err != nil {
+				return "", err
+			}
+			return fmt.Sprintf("[%s](%s)", escapeMarkdown(f.Title), f.Link), nil
+		},
+	}
+}
+
+type facade struct {
+	Provider string
+	Title    string
+	// Src is the iframe URL loaded once the reader agrees.
+	Src  string
+	Host string
+	Link string
+	// Thumb is the name of the thumbnail in the EmbedCache, such as
+	// youtube/{id}.jpg, until it is rendered as a signed URL.
+	Thumb string
+	// Attribution is credit the provider requires wherever its content is
+	// shown.
+	Attribution template.HTML
+}
+
+var facadeTpl = template.Must(template.New("facade").Parse(`<div class="embed-facade not-prose relative aspect-video bg-gray-900 rounded overflow-hidden my-6" data-embed-src="{{.Src}}" data-embed-title="{{.Title}}">
+  {{- if .Thumb}}
+  <img src="{{.Thumb}}" alt="" loading="lazy" class="absolute inset-0 w-full h-full object-cover opacity-50">
+  {{- end}}
+  <div class="absolute inset-0 flex flex-col items-center justify-center text-white text-center p-4">
+    <p class="font-semibold text-lg">{{.Title}}</p>
+    <button type="button" class="embed-load mt-3 bg-white text-gray-900 rounded px-4 py-2">Load {{.Provider}}</button>
+    <p class="text-xs mt-3 text-gray-300">Loading this will connect to {{.Host}}. You can also <a href="{{.Link}}" class="underline">open it on {{.Provider}}</a>.</p>
+  </div>
+  {{- with .Attribution}}
+  <p class="absolute bottom-0 right-0 bg-white/75 text-gray-900 text-xs px-1">{{.}}</p>
+  {{- end}}
+</div>`))
+
+func renderFacade(rc *RenderContext, f facade) (template.HTML, error) {
+	u, err := url.Parse(f.Src)
+	if err != nil {
+		return "", err
+	}
+	f.Host = u.Host
+	rc.allowFrame(u.Scheme + "://" + u.Host)
+	var buf bytes.Buffer
+	err = facadeTpl.Execute(&buf, f)
+	if err != nil {
+		return "", err
+	}
+	return template.HTML(buf.String()), nil
+}
+
+var youtubeIDRe = regexp.MustCompile(`^[A-Za-z0-9_-]{11}$`)
+
+// youTubeFacade handles {{< youtube id="..." title="..." >}} using YouTube's
+// privacy enhanced domain.
+func youTubeFacade(sc Shortcode) (facade, error) {
+	id := sc.Arg("id", 0)
+	if !youtubeIDRe.MatchString(id) {
+		return facade{}, fmt.Errorf("invalid video id %q", id)
+	}
+	title := sc.Arg("title", 1)
+	if title == "" {
+		title = "YouTube video"
+	}
+	return facade{
+		Provider: "YouTube",
+		Title:    title,
+		Src:      "https://www.youtube-nocookie.com/embed/" + id + "?autoplay=1",
+		Link:     "https://www.youtube.com/watch?v=" + id,
+		Thumb:    "youtube/" + id + ".jpg",
+	}, nil
+}
+
+// mapFacade handles {{< map lat="..." lon="..." zoom="14" >}} as an
+// OpenStreetMap embed. The thumbnail is the map tile containing the marker.
+func mapFacade(sc Shortcode) (facade, error) {
+	lat, err := strconv.ParseFloat(sc.Arg("lat", 0), 64)
+	if err != nil || lat < -85 || lat > 85 {
+		return facade{}, fmt.Errorf("invalid lat %q", sc.Arg("lat", 0))
+	}
+	lon, err := strconv.ParseFloat(sc.Arg("lon", 1), 64)
+	if err != nil || lon < -180 || lon > 180 {
+		return facade{}, fmt.Errorf("invalid lon %q", sc.Arg("lon", 1))
+	}
+	zoom := 14
+	if z := sc.Arg("zoom", 2); z != "" {
+		zoom, err = strconv.Atoi(z)
+		if err != nil || zoom < 1 || zoom > 18 {
+			return facade{}, fmt.Errorf("invalid zoom %q", z)
+		}
+	}
+	title := sc.Args["title"]
+	if title == "" {
+		title = "Map"
+	}
+	// Roughly the area visible in a 640x360 iframe at this zoom level.
+	dlon := 640.0 / 256 * 360 / math.Exp2(float64(zoom)) / 2
+	dlat := dlon * 360 / 640 * math.Cos(lat*math.Pi/180)
+	bbox := fmt.Sprintf("%f,%f,%f,%f", lon-dlon, lat-dlat, lon+dlon, lat+dlat)
+	x, y := tileXY(lat, lon, zoom)
+	return facade{
+		Provider: "OpenStreetMap",
+		Title:    title,
+		Src: "https://www.openstreetmap.org/export/embed.html?" + url.Values{
+			"bbox":   {bbox},
+			"layer":  {"mapnik"},
+			"marker": {fmt.Sprintf("%f,%f", lat, lon)},
+		}.Encode(),
+		Link:        fmt.Sprintf("https://www.openstreetmap.org/?mlat=%f&mlon=%f#map=%d/%f/%f", lat, lon, zoom, lat, lon),
+		Thumb:       fmt.Sprintf("tiles/%d/%d/%d.png", zoom, x, y),
+		Attribution: `&copy; <a href="https://www.openstreetmap.org/copyright" class="underline">OpenStreetMap</a> contributors`,
+	}, nil
+}
+
+// tileXY returns the slippy map tile containing lat, lon.
+func tileXY(lat, lon float64, zoom int) (int, int) {
+	n := math.Exp2(float64(zoom))
+	latRad := lat * math.Pi / 180
+	x := int((lon + 180) / 360 * n)
+	y := int((1 - math.Log(math.Tan(latRad)+1/math.Cos(latRad))/math.Pi) / 2 * n)
+	return x, y
+}
+
+// mastodonFacade handles {{< mastodon url="https://host/@user/123" >}}.
+func mastodonFacade(sc Shortcode) (facade, error) {
+	u, err := url.Parse(sc.Arg("url", 0))
+	if err != nil || u.Scheme != "https" || u.Host == "" {
+		return facade{}, fmt.Errorf("invalid url %q", sc.Arg("url", 0))
+	}
+	u.RawQuery, u.Fragment = "", ""
+	title := "Post on " + u.Host
+	if user, _, ok := strings.Cut(strings.TrimPrefix(u.Path, "/"), "/"); ok && strings.HasPrefix(user, "@") {
+		title = "Post by " + user + " on " + u.Host
+	}
+	return facade{
+		Provider: "Mastodon",
+		Title:    title,
+		Src:      strings.TrimSuffix(u.String(), "/") + "/embed",
+		Link:     u.String(),
+	}, nil
+}
+
+// EmbedCache fetches embed thumbnails from third parties on our readers'
+// behalf and keeps a copy on disk.
+type EmbedCache struct {
+	Dir       string
+	UserAgent string
+	Client    *http.Client
+	// Secret signs the thumbnail URLs in posts.
+	Secret string
+	// MaxBytes limits the size of the cache. The thumbnails fetched longest
+	// ago are deleted to make room. Zero means defaultEmbedCacheSize.
+	MaxBytes int64
+
+	mu sync.Mutex
+}
+
+func NewEmbedCache(cfg Config) *EmbedCache {
+	return &EmbedCache{
+		Dir:       filepath.Join(cfg.CacheDir, "embeds"),
+		UserAgent: "jonblog (+" + cfg.BaseURL + ")",
+		Secret:    cfg.Secret,
+	}
+}
+
+const (
+	// maxThumbSize limits how much we download for a single thumbnail.
+	maxThumbSize          = 5 << 20
+	defaultEmbedCacheSize = 200 << 20
+)
+
+// thumbURL returns the signed URL of the thumbnail called name.
+func (ec *EmbedCache) thumbURL(name string) string {
+	kind, file, _ := strings.Cut(name, "/")
+	return "/embeds/" + kind + "/" + sign(ec.Secret, "embed:"+name) + "/" + file
+}
+
+// YouTubeThumbHandler serves /embeds/youtube/{sig}/{id}.jpg.
+func (ec *EmbedCache) YouTubeThumbHandler() http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		id, ok := strings.CutSuffix(r.PathValue("file"), ".jpg")
+		name := "youtube/" + id + ".jpg"
+		if !ok || !youtubeIDRe.MatchString(id) || !verify(ec.Secret, "embed:"+name, r.PathValue("sig")) {
+			http.Error(w, "Not found", http.StatusNotFound)
+			return
+		}
+		ec.serve(w, r, filepath.FromSlash(name), "https://i.ytimg.com/vi/"+id+"/hqdefault.jpg")
+	}
+}
+
+// TileHandler serves /embeds/tiles/{sig}/{z}/{x}/{y}.png.
+func (ec *EmbedCache) TileHandler() http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		yStr, ok := strings.CutSuffix(r.PathValue("file"), ".png")
+		z, errZ := strconv.Atoi(r.PathValue("z"))
+		x, errX := strconv.Atoi(r.PathValue("x"))
+		y, errY := strconv.Atoi(yStr)
+		if !ok || errZ != nil || errX != nil || errY != nil || z < 1 || z > 18 ||
+			x < 0 || y < 0 || x >= 1<<z || y >= 1<<z {
+			http.Error(w, "Not found", http.StatusNotFound)
+			return
+		}
+		path := fmt.Sprintf("%d/%d/%d.png", z, x, y)
+		if !verify(ec.Secret, "embed:tiles/"+path, r.PathValue("sig")) {
+			http.Error(w, "Not found", http.StatusNotFound)
+			return
+		}
+		ec.serve(w, r, filepath.Join("tiles", filepath.FromSlash(path)), "https://tile.openstreetmap.org/"+path)
+	}
+}
+
+// FacadeScriptHandler serves the script that loads embeds when asked to.
+func FacadeScriptHandler() http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "text/javascript; charset=utf-8")
+		http.ServeFile(w, r, "facade.js")
+	}
+}
+
+func (ec *EmbedCache) serve(w http.ResponseWriter, r *http.Request, name, src string) {
+	path := filepath.Join(ec.Dir, name)
+	if _, err := os.Stat(path); errors.Is(err, os.ErrNotExist) {
+		err = ec.fetch(path, src)
+		if err != nil {
+			log.Printf("embeds: fetching %s: %v", src, err)
+			http.Error(w, "Thumbnail unavailable", http.StatusBadGateway)
+			return
+		}
+	}
+	w.Header().Set("Cache-Control", "public, max-age=604800")
+	http.ServeFile(w, r, path)
+}
+
+func (ec *EmbedCache) fetch(path, src string) error {
+	client := ec.Client
+	if client == nil {
+		client = &http.Client{Timeout: 10 * time.Second}
+	}
+	req, err := http.NewRequest(http.MethodGet, src, nil)
+	if err != nil {
+		return err
+	}
+	req.Header.Set("User-Agent", ec.UserAgent)
+	resp, err := client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return fmt.Errorf("unexpected status %s", resp.Status)
+	}
+	if !strings.HasPrefix(resp.Header.Get("Content-Type"), "image/") {
+		return fmt.Errorf("unexpected content type %q", resp.Header.Get("Content-Type"))
+	}
+	b, err := io.ReadAll(io.LimitReader(resp.Body, maxThumbSize))
+	if err != nil {
+		return err
+	}
+	err = os.MkdirAll(filepath.Dir(path), 0755)
+	if err != nil {
+		return err
+	}
+	// Readers may fetch the same thumbnail at once, so each fetch writes its
+	// own temporary file.
+	tmp, err := os.CreateTemp(filepath.Dir(path), filepath.Base(path)+".*.tmp")
+	if err != nil {
+		return err
+	}
+	_, err = tmp.Write(b)
+	if cerr := tmp.Close(); err == nil {
+		err = cerr
+	}
+	if err == nil {
+		err = os.Chmod(tmp.Name(), 0644)
+	}
+	if err == nil {
+		err = os.Rename(tmp.Name(), path)
+	}
+	if err != nil {
+		os.Remove(tmp.Name())
+		return err
+	}
+	return ec.trim(path)
+}
+
+// trim deletes the oldest thumbnails, other than keep, until the cache fits
+// in MaxBytes.
+func (ec *EmbedCache) trim(keep string) error {
+	ec.mu.Lock()
+	defer ec.mu.Unlock()
+	limit := ec.MaxBytes
+	if limit == 0 {
+		limit = defaultEmbedCacheSize
+	}
+	type cached struct {
+		path    string
+		size    int64
+		modTime time.Time
+	}
+	var files []cached
+	var total int64
+	err := filepath.WalkDir(ec.Dir, func(path string, d fs.DirEntry, err error) error {
+		if err != nil || d.IsDir() {
+			return err
+		}
+		if strings.HasSuffix(d.Name(), ".tmp") {
+			// Being written by another fetch.
+			return nil
+		}
+		info, err := d.Info()
+		if err != nil {
+			return err
+		}
+		files = append(files, cached{path, info.Size(), info.ModTime()})
+		total += info.Size()
+		return nil
+	})
+	if err != nil || total <= limit {
+		return err
+	}
+	sort.Slice(files, func(i, j int) bool {
+		return files[i].modTime.Before(files[j].modTime)
+	})
+	for _, f := range files {
+		if total <= limit {
+			break
+		}
+		if f.path == keep {
+			continue
+		}
+		err = os.Remove(f.path)
+		if err != nil && !errors.Is(err, fs.ErrNotExist) {
+			return err
+		}
+		total -= f.size
+	}
+	return nil
+}
@@ -0,0 +1,62 @@
+package main
+
+import (
+	"bytes"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"sync"
+	"testing"
+)
+
+func TestEmbedCacheConcurrentFetch(t *testing.T) {
+	thumb := bytes.Repeat([]byte("jpeg"), 64<<10)
+	var start sync.WaitGroup
+	start.Add(1)
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		// Hold every response until all the fetches are in flight.
+		start.Wait()
+		w.Header().Set("Content-Type", "image/jpeg")
+		w.Write(thumb)
+	}))
+	t.Cleanup(srv.Close)
+	ec := &EmbedCache{Dir: t.TempDir(), Client: srv.Client()}
+	path := filepath.Join(ec.Dir, "youtube", "abc.jpg")
+
+	const fetches = 8
+	errs := make([]error, fetches)
+	var wg sync.WaitGroup
+	for i := range errs {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			errs[i] = ec.fetch(path, srv.URL)
+		}()
+	}
+	start.Done()
+	wg.Wait()
+	for i, err := range errs {
+		if err != nil {
+			t.Errorf("fetch %d: %v", i, err)
+		}
+	}
+	got, err := os.ReadFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(got, thumb) {
+		t.Errorf("thumbnail has %d bytes, want %d", len(got), len(thumb))
+	}
+	entries, err := os.ReadDir(filepath.Dir(path))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(entries) != 1 {
+		var names []string
+		for _, e := range entries {
+			names = append(names, e.Name())
+		}
+		t.Errorf("cache has %q, want only the thumbnail", names)
+	}
+}
@@ -0,0 +1,281 @@
+package main
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"io"
+	"os"
+	"strings"
+	"time"
+)
+
+// EXIF holds the handful of EXIF fields we show on photo pages.
+type EXIF struct {
+	Taken       time.Time
+	Make        string
+	Model       string
+	Lens        string
+	Orientation int
+	HasGPS      bool
+	Lat, Lon    float64
+}
+
+// Camera returns the make and model, without repeating the make when the
+// model already includes it (as in "Canon" "Canon EOS R5").
+func (e EXIF) Camera() string {
+	if e.Make == "" || strings.HasPrefix(strings.ToLower(e.Model), strings.ToLower(e.Make)) {
+		return e.Model
+	}
+	return strings.TrimSpace(e.Make + " " + e.Model)
+}
+
+const (
+	tagMake             = 0x010F
+	tagModel            = 0x0110
+	tagOrientation      = 0x0112
+	tagDateTime         = 0x0132
+	tagExifIFD          = 0x8769
+	tagGPSIFD           = 0x8825
+	tagDateTimeOriginal = 0x9003
+	tagLensModel        = 0xA434
+	tagGPSLatRef        = 0x0001
+	tagGPSLat           = 0x0002
+	tagGPSLonRef        = 0x0003
+	tagGPSLon           = 0x0004
+)
+
+// jpegSegments calls fn for every marker segment before the image data of a
+// JPEG. start and end are the offsets of the whole segment, including its
+// marker.
+func jpegSegments(b []byte, fn func(marker byte, payload []byte, start, end int)) error {
+	if len(b) < 2 || b[0] != 0xFF || b[1] != 0xD8 {
+		return errors.New("not a jpeg")
+	}
+	for i := 2; i+4 <= len(b); {
+		if b[i] != 0xFF {
+			return errors.New("invalid jpeg marker")
+		}
+		marker := b[i+1]
+		if marker == 0xDA || marker == 0xD9 {
+			// Start of scan or end of image: no more metadata.
+			return nil
+		}
+		n := int(binary.BigEndian.Uint16(b[i+2:]))
+		if n < 2 || i+2+n > len(b) {
+			return errors.New("truncated jpeg segment")
+		}
+		fn(marker, b[i+4:i+2+n], i, i+2+n)
+		i += 2 + n
+	}
+	return nil
+}
+
+var exifHeader = []byte("Exif\x00\x00")
+
+// readEXIF extracts EXIF data from a JPEG. Files without EXIF data return the
+// zero value and no error.
+func readEXIF(b []byte) (EXIF, error) {
+	var tiff []byte
+	err := jpegSegments(b, func(marker byte, payload []byte, start, end int) {
+		if marker == 0xE1 && tiff == nil && bytes.HasPrefix(payload, exifHeader) {
+			tiff = payload[len(exifHeader):]
+		}
+	})
+	if err != nil || tiff == nil {
+		return EXIF{}, err
+	}
+	return parseEXIF(tiff)
+}
+
+// readEXIFFile is readEXIF for the JPEG at path. It only reads the segment
+// headers and the EXIF segment, which is at most 64KB, so the size of the
+// image doesn't matter.
+func readEXIFFile(path string) (EXIF, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return EXIF{}, err
+	}
+	defer f.Close()
+	var hdr [4]byte
+	_, err = io.ReadFull(f, hdr[:2])
+	if err != nil || hdr[0] != 0xFF || hdr[1] != 0xD8 {
+		return EXIF{}, errors.New("not a jpeg")
+	}
+	for {
+		_, err = io.ReadFull(f, hdr[:])
+		if errors.Is(err, io.EOF) || errors.Is(err, io.ErrUnexpectedEOF) {
+			return EXIF{}, nil
+		}
+		if err != nil {
+			return EXIF{}, err
+		}
+		if hdr[0] != 0xFF {
+			return EXIF{}, errors.New("invalid jpeg marker")
+		}
+		if hdr[1] == 0xDA || hdr[1] == 0xD9 {
+			return EXIF{}, nil
+		}
+		n := int(binary.BigEndian.Uint16(hdr[2:])) - 2
+		if n < 0 {
+			return EXIF{}, errors.New("truncated jpeg segment")
+		}
+		if hdr[1] != 0xE1 {
+			_, err = f.Seek(int64(n), io.SeekCurrent)
+			if err != nil {
+				return EXIF{}, err
+			}
+			continue
+		}
+		payload := make([]byte, n)
+		_, err = io.ReadFull(f, payload)
+		if err != nil {
+			return EXIF{}, errors.New("truncated jpeg segment")
+		}
+		if tiff, ok := bytes.CutPrefix(payload, exifHeader); ok {
+			return parseEXIF(tiff)
+		}
+	}
+}
+
+// parseEXIF reads the TIFF structure inside an EXIF segment.
+func parseEXIF(tiff []byte) (EXIF, error) {
+	var e EXIF
+	if len(tiff) < 8 {
+		return e, errors.New("truncated exif")
+	}
+	var order binary.ByteOrder
+	switch string(tiff[:2]) {
+	case "II":
+		order = binary.LittleEndian
+	case "MM":
+		order = binary.BigEndian
+	default:
+		return e, errors.New("invalid exif byte order")
+	}
+
+	ifd0, err := readIFD(tiff, order, order.Uint32(tiff[4:]))
+	if err != nil {
+		return e, err
+	}
+	e.Make = ifd0.str(tagMake)
+	e.Model = ifd0.str(tagModel)
+	e.Orientation = int(ifd0.uint(tagOrientation))
+	taken := ifd0.str(tagDateTime)
+	if off := ifd0.uint(tagExifIFD); off != 0 {
+		exifIFD, err := readIFD(tiff, order, off)
+		if err == nil {
+			if s := exifIFD.str(tagDateTimeOriginal); s != "" {
+				taken = s
+			}
+			e.Lens = exifIFD.str(tagLensModel)
+		}
+	}
+	if t, err := time.Parse("2006:01:02 15:04:05", taken); err == nil {
+		e.Taken = t
+	}
+	if off := ifd0.uint(tagGPSIFD); off != 0 {
+		gps, err := readIFD(tiff, order, off)
+		if err == nil {
+			lat, okLat := gps.degrees(tagGPSLat)
+			lon, okLon := gps.degrees(tagGPSLon)
+			if okLat && okLon {
+				if gps.str(tagGPSLatRef) == "S" {
+					lat = -lat
+				}
+				if gps.str(tagGPSLonRef) == "W" {
+					lon = -lon
+				}
+				e.HasGPS, e.Lat, e.Lon = true, lat, lon
+			}
+		}
+	}
+	return e, nil
+}
+
+type ifdEntry struct {
+	typ   uint16
+	count uint32
+	data  []byte
+}
+
+type ifd struct {
+	order   binary.ByteOrder
+	entries map[uint16]ifdEntry
+}
+
+var exifTypeSizes = map[uint16]uint32{1: 1, 2: 1, 3: 2, 4: 4, 5: 8, 7: 1, 9: 4, 10: 8}
+
+func readIFD(tiff []byte, order binary.ByteOrder, offset uint32) (ifd, error) {
+	d := ifd{order: order, entries: make(map[uint16]ifdEntry)}
+	if uint64(offset)+2 > uint64(len(tiff)) {
+		return d, errors.New("ifd out of range")
+	}
+	n := int(order.Uint16(tiff[offset:]))
+	pos := int(offset) + 2
+	for i := 0; i < n && pos+12 <= len(tiff); i, pos = i+1, pos+12 {
+		tag := order.Uint16(tiff[pos:])
+		typ := order.Uint16(tiff[pos+2:])
+		count := order.Uint32(tiff[pos+4:])
+		// Entries hold at least one value, so readers never have to check
+		// the length of data.
+		size, ok := exifTypeSizes[typ]
+		if !ok || count == 0 || count > 1<<20 {
+			continue
+		}
+		total := size * count
+		var data []byte
+		if total <= 4 {
+			data = tiff[pos+8 : pos+8+int(total)]
+		} else {
+			off := order.Uint32(tiff[pos+8:])
+			if uint64(off)+uint64(total) > uint64(len(tiff)) {
+				continue
+			}
+			data = tiff[off : off+total]
+		}
+		d.entries[tag] = ifdEntry{typ: typ, count: count, data: data}
+	}
+	return d, nil
+}
+
+func (d ifd) str(tag uint16) string {
+	e, ok := d.entries[tag]
+	if !ok || e.typ != 2 {
+		return ""
+	}
+	return strings.TrimSpace(strings.TrimRight(string(e.data), "\x00"))
+}
+
+func (d ifd) uint(tag uint16) uint32 {
+	e, ok := d.entries[tag]
+	if !ok {
+		return 0
+	}
+	switch e.typ {
+	case 3:
+		return uint32(d.order.Uint16(e.data))
+	case 4:
+		return d.order.Uint32(e.data)
+	}
+	return 0
+}
+
+// degrees reads a GPS coordinate stored as three rationals: degrees, minutes
+// and seconds.
+func (d ifd) degrees(tag uint16) (float64, bool) {
+	e, ok := d.entries[tag]
+	if !ok || e.typ != 5 || e.count != 3 {
+		return 0, false
+	}
+	var parts [3]float64
+	for i := range parts {
+		num := d.order.Uint32(e.data[i*8:])
+		den := d.order.Uint32(e.data[i*8+4:])
+		if den == 0 {
+			return 0, false
+		}
+		parts[i] = float64(num) / float64(den)
+	}
+	return parts[0] + parts[1]/60 + parts[2]/3600, true
+}
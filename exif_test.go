@@ -0,0 +1,253 @@
+package main
+
+import (
+	"bytes"
+	"encoding/binary"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+// tiffEntry is an IFD entry for buildTIFF. Values of up to four bytes are
+// stored in the entry, larger ones after the IFD.
+type tiffEntry struct {
+	tag   uint16
+	typ   uint16
+	count uint32
+	data  []byte
+	// ifd, when set, makes the entry point at ifds[ifd] instead of holding
+	// data.
+	ifd int
+}
+
+// buildTIFF lays out ifds one after the other, each followed by its data.
+func buildTIFF(order binary.ByteOrder, ifds ...[]tiffEntry) []byte {
+	size := func(ifd []tiffEntry) int {
+		n := 2 + 12*len(ifd) + 4
+		for _, e := range ifd {
+			if len(e.data) > 4 {
+				n += len(e.data)
+			}
+		}
+		return n
+	}
+	offsets := make([]int, len(ifds))
+	end := 8
+	for i, ifd := range ifds {
+		offsets[i] = end
+		end += size(ifd)
+	}
+	b := make([]byte, end)
+	copy(b, "II")
+	if order == binary.BigEndian {
+		copy(b, "MM")
+	}
+	order.PutUint16(b[2:], 42)
+	order.PutUint32(b[4:], uint32(offsets[0]))
+	for i, ifd := range ifds {
+		pos := offsets[i]
+		order.PutUint16(b[pos:], uint16(len(ifd)))
+		extra := pos + 2 + 12*len(ifd) + 4
+		for j, e := range ifd {
+			p := pos + 2 + 12*j
+			order.PutUint16(b[p:], e.tag)
+			order.PutUint16(b[p+2:], e.typ)
+			order.PutUint32(b[p+4:], e.count)
+			switch {
+			case e.ifd != 0:
+				order.PutUint32(b[p+8:], uint32(offsets[e.ifd]))
+			case len(e.data) <= 4:
+				copy(b[p+8:], e.data)
+			default:
+				order.PutUint32(b[p+8:], uint32(extra))
+				copy(b[extra:], e.data)
+				extra += len(e.data)
+			}
+		}
+	}
+	return b
+}
+
+func asciiEntry(tag uint16, s string) tiffEntry {
+	return tiffEntry{tag: tag, typ: 2, count: uint32(len(s) + 1), data: append([]byte(s), 0)}
+}
+
+func shortEntry(order binary.ByteOrder, tag, v uint16) tiffEntry {
+	data := make([]byte, 2)
+	order.PutUint16(data, v)
+	return tiffEntry{tag: tag, typ: 3, count: 1, data: data}
+}
+
+// degreesEntry stores a GPS coordinate as degrees, minutes and hundredths of
+// a second.
+func degreesEntry(order binary.ByteOrder, tag uint16, deg, min, sec100 uint32) tiffEntry {
+	data := make([]byte, 24)
+	for i, v := range [][2]uint32{{deg, 1}, {min, 1}, {sec100, 100}} {
+		order.PutUint32(data[i*8:], v[0])
+		order.PutUint32(data[i*8+4:], v[1])
+	}
+	return tiffEntry{tag: tag, typ: 5, count: 3, data: data}
+}
+
+// jpegWithEXIF returns the start of a JPEG with tiff in its APP1 segment,
+// after an APP0 segment, followed by a start of scan. A nil tiff leaves out
+// the APP1 segment.
+func jpegWithEXIF(tiff []byte) []byte {
+	var b bytes.Buffer
+	segment := func(marker byte, payload []byte) {
+		b.Write([]byte{0xFF, marker})
+		binary.Write(&b, binary.BigEndian, uint16(len(payload)+2))
+		b.Write(payload)
+	}
+	b.Write([]byte{0xFF, 0xD8})
+	segment(0xE0, []byte("JFIF\x00\x01\x02\x00\x00\x01\x00\x01\x00\x00"))
+	if tiff != nil {
+		segment(0xE1, append([]byte("Exif\x00\x00"), tiff...))
+	}
+	segment(0xDA, []byte{0x01, 0x01, 0x00, 0x00, 0x3F, 0x00})
+	b.Write([]byte{0x12, 0x34, 0xFF, 0xD9})
+	return b.Bytes()
+}
+
+func TestReadEXIF(t *testing.T) {
+	le, be := binary.LittleEndian, binary.BigEndian
+	full := func(order binary.ByteOrder) []byte {
+		return buildTIFF(order,
+			[]tiffEntry{
+				asciiEntry(tagMake, "Canon"),
+				asciiEntry(tagModel, "Canon EOS R5"),
+				shortEntry(order, tagOrientation, 6),
+				asciiEntry(tagDateTime, "2024:01:01 00:00:00"),
+				{tag: tagExifIFD, typ: 4, count: 1, ifd: 1},
+				{tag: tagGPSIFD, typ: 4, count: 1, ifd: 2},
+			},
+			[]tiffEntry{
+				asciiEntry(tagDateTimeOriginal, "2024:06:01 12:30:45"),
+				asciiEntry(tagLensModel, "RF24-105mm"),
+			},
+			[]tiffEntry{
+				asciiEntry(tagGPSLatRef, "N"),
+				degreesEntry(order, tagGPSLat, 64, 8, 0),
+				asciiEntry(tagGPSLonRef, "W"),
+				degreesEntry(order, tagGPSLon, 21, 54, 3600),
+			},
+		)
+	}
+	want := EXIF{
+		Taken:       time.Date(2024, 6, 1, 12, 30, 45, 0, time.UTC),
+		Make:        "Canon",
+		Model:       "Canon EOS R5",
+		Lens:        "RF24-105mm",
+		Orientation: 6,
+		HasGPS:      true,
+		Lat:         64 + 8.0/60,
+		Lon:         -(21 + 54.0/60 + 36.0/3600),
+	}
+	tests := []struct {
+		name    string
+		jpeg    []byte
+		want    EXIF
+		wantErr bool
+	}{
+		{name: "little endian", jpeg: jpegWithEXIF(full(le)), want: want},
+		{name: "big endian", jpeg: jpegWithEXIF(full(be)), want: want},
+		{name: "no exif", jpeg: jpegWithEXIF(nil)},
+		{
+			name: "short with no values",
+			jpeg: jpegWithEXIF(buildTIFF(le, []tiffEntry{
+				asciiEntry(tagMake, "Canon"),
+				{tag: tagOrientation, typ: 3, count: 0},
+			})),
+			want: EXIF{Make: "Canon"},
+		},
+		{
+			name: "long with no values",
+			jpeg: jpegWithEXIF(buildTIFF(le, []tiffEntry{
+				{tag: tagExifIFD, typ: 4, count: 0},
+				{tag: tagGPSIFD, typ: 4, count: 0},
+			})),
+		},
+		{
+			name: "data out of range",
+			jpeg: jpegWithEXIF(func() []byte {
+				b := buildTIFF(le, []tiffEntry{asciiEntry(tagModel, "A long model name")})
+				// Point the model past the end of the data.
+				le.PutUint32(b[8+2+8:], 1000)
+				return b
+			}()),
+		},
+		{
+			name: "ifd out of range",
+			jpeg: jpegWithEXIF(func() []byte {
+				b := buildTIFF(le, []tiffEntry{asciiEntry(tagMake, "Canon")})
+				le.PutUint32(b[4:], 1000)
+				return b
+			}()),
+			wantErr: true,
+		},
+		{name: "truncated exif", jpeg: jpegWithEXIF([]byte("II*\x00")), wantErr: true},
+		{name: "bad byte order", jpeg: jpegWithEXIF([]byte("XX*\x00\x08\x00\x00\x00")), wantErr: true},
+		{name: "not a jpeg", jpeg: []byte("\x89PNG\r\n\x1a\n"), wantErr: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := readEXIF(tt.jpeg)
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("readEXIF() error = %v, want error %t", err, tt.wantErr)
+			}
+			if got != tt.want {
+				t.Errorf("readEXIF() = %+v, want %+v", got, tt.want)
+			}
+
+			path := filepath.Join(t.TempDir(), "photo.jpg")
+			err = os.WriteFile(path, tt.jpeg, 0644)
+			if err != nil {
+				t.Fatal(err)
+			}
+			got, err = readEXIFFile(path)
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("readEXIFFile() error = %v, want error %t", err, tt.wantErr)
+			}
+			if got != tt.want {
+				t.Errorf("readEXIFFile() = %+v, want %+v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestIFDUint(t *testing.T) {
+	le := binary.LittleEndian
+	tiff := buildTIFF(le, []tiffEntry{
+		shortEntry(le, 1, 7),
+		{tag: 2, typ: 4, count: 1, data: []byte{0x01, 0x02, 0x03, 0x04}},
+		asciiEntry(3, "text"),
+		{tag: 4, typ: 3, count: 0},
+		{tag: 5, typ: 4, count: 0},
+		{tag: 6, typ: 99, count: 1, data: []byte{1}},
+	})
+	d, err := readIFD(tiff, le, 8)
+	if err != nil {
+		t.Fatal(err)
+	}
+	tests := []struct {
+		name string
+		tag  uint16
+		want uint32
+	}{
+		{"short", 1, 7},
+		{"long", 2, 0x04030201},
+		{"ascii", 3, 0},
+		{"short with no values", 4, 0},
+		{"long with no values", 5, 0},
+		{"unknown type", 6, 0},
+		{"missing", 7, 0},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := d.uint(tt.tag); got != tt.want {
+				t.Errorf("uint(%d) = %#x, want %#x", tt.tag, got, tt.want)
+			}
+		})
+	}
+}
@@ -0,0 +1,220 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"io"
+	"net/url"
+	"path/filepath"
+	"regexp"
+	"strings"
+	"time"
+)
+
+// runExport implements `jonblog export [-o dir] [slug...]`. Each post is
+// written to dir as plain CommonMark that any other platform can read:
+//
+//   - shortcodes are replaced by markdown, or by their HTML when there is no
+//     markdown equivalent, and private blocks are dropped
+//   - pre_markdown plugins are applied
+//   - links and images relative to the site are made absolute
+//   - frontmatter is YAML with only the fields other tools understand
+//
+// Only blog posts are exported, including those in sections, which get their
+// section's defaults. Docs pages and the text of section index files are
+// left out, so their links from posts point at the live site. Post markdown
+// has no include or wiki link syntax, so nothing else needs resolving.
+// Without slugs, every published post is exported.
+func runExport(w io.Writer, fsr FileReader, baseURL string, args []string) error {
+	flags := flag.NewFlagSet("export", flag.ExitOnError)
+	dir := flags.String("o", "export", "directory to write the posts to")
+	flags.Parse(args)
+
+	slugs := flags.Args()
+	if len(slugs) == 0 {
+		posts, err := listPosts(fsr)
+		if err != nil {
+			return err
+		}
+		for _, post := range posts {
+			slugs = append(slugs, post.Slug)
+		}
+	}
+	for _, slug := range slugs {
+		b, err := exportPost(fsr, baseURL, slug)
+		if err != nil {
+			return fmt.Errorf("%s: %w", slug, err)
+		}
+		path := filepath.Join(*dir, filepath.FromSlash(slug)+".md")
+		err = writeFile(path, bytes.NewReader(b))
+		if err != nil {
+			return err
+		}
+		fmt.Fprintln(w, path)
+	}
+	return nil
+}
+
+// exportPost returns the portable markdown of the post at slug.
+func exportPost(fsr FileReader, baseURL, slug string) ([]byte, error) {
+	postMarkdown, err := fsr.Read(slug)
+	if err != nil {
+		return nil, err
+	}
+	post, rest, err := parsePost(fsr, slug, postMarkdown)
+	if err != nil {
+		return nil, err
+	}
+	rest, err = runPlugins(hookPreMarkdown, rest)
+	if err != nil {
+		return nil, err
+	}
+	// Without a request, private blocks render as nothing.
+	body, err := resolveShortcodes(&RenderContext{Slug: slug, Style: post.HighlightStyle}, rest)
+	if err != nil {
+		return nil, err
+	}
+	postURL, err := url.Parse(strings.TrimSuffix(baseURL, "/") + "/posts/" + slug)
+	if err != nil {
+		return nil, err
+	}
+	body = absoluteLinks(body, postURL)
+
+	var buf bytes.Buffer
+	buf.WriteString("---\n")
+	writeYAML(&buf, "title", post.Title)
+	writeYAML(&buf, "description", post.Description)
+	if !post.Date.IsZero() {
+		writeYAML(&buf, "date", post.Date.Format(time.RFC3339))
+	}
+	writeYAML(&buf, "author", post.Author.Name)
+	if len(post.Tags) > 0 {
+		writeYAML(&buf, "tags", post.Tags)
+	}
+	writeYAML(&buf, "canonical_url", postURL.String())
+	buf.WriteString("---\n\n")
+	buf.Write(bytes.TrimLeft(body, "\n"))
+	return buf.Bytes(), nil
+}
+
+// writeYAML writes a YAML key with a JSON encoded value, which YAML parsers
+// read as flow scalars and sequences. Empty strings are skipped.
+func writeYAML(buf *bytes.Buffer, key string, v any) {
+	if s, ok := v.(string); ok && s == "" {
+		return
+	}
+	b, _ := json.Marshal(v)
+	fmt.Fprintf(buf, "%s: %s\n", key, b)
+}
+
+// resolveShortcodes replaces each shortcode in src with its markdown, or its
+// HTML set off by blank lines so it is read as an HTML block.
+func resolveShortcodes(rc *RenderContext, src []byte) ([]byte, error) {
+	lines := strings.Split(string(src), "\n")
+	var out []string
+	last := 0
+	for _, span := range findShortcodes(lines) {
+		def := shortcodes[span.sc.Name]
+		var s string
+		if def.markdown != nil {
+			md, err := def.markdown(span.sc)
+			if err != nil {
+				return nil, fmt.Errorf("shortcode %s: %w", span.sc.Name, err)
+			}
+			s = md
+		} else {
+			html, err := def.render(span.sc, rc)
+			if err != nil {
+				return nil, fmt.Errorf("shortcode %s: %w", span.sc.Name, err)
+			}
+			s = htmlBlock(string(html))
+		}
+		out = append(out, lines[last:span.start]...)
+		last = span.end + 1
+		if s == "" {
+			continue
+		}
+		if len(out) > 0 && strings.TrimSpace(out[len(out)-1]) != "" {
+			out = append(out, "")
+		}
+		out = append(out, s)
+		if last < len(lines) && strings.TrimSpace(lines[last]) != "" {
+			out = append(out, "")
+		}
+	}
+	out = append(out, lines[last:]...)
+	return []byte(strings.Join(out, "\n")), nil
+}
+
+// htmlBlock removes the blank lines from html, since a blank line would end
+// the HTML block. Inside <pre>, where they are part of the content, the
+// newline of each blank line is written as &#10; instead.
+func htmlBlock(html string) string {
+	html = strings.TrimSpace(html)
+	var b strings.Builder
+	last := 0
+	for _, loc := range preRe.FindAllStringIndex(html, -1) {
+		b.WriteString(blankLineRe.ReplaceAllString(html[last:loc[0]], "\n"))
+		b.WriteString(preBlankLineRe.ReplaceAllString(html[loc[0]:loc[1]], "\n$1&#10;"))
+		last = loc[1]
+	}
+	b.WriteString(blankLineRe.ReplaceAllString(html[last:], "\n"))
+	return b.String()
+}
+
+var (
+	blankLineRe    = regexp.MustCompile(`\n\s*\n`)
+	preRe          = regexp.MustCompile(`(?is)<pre\b.*?</pre>`)
+	preBlankLineRe = regexp.MustCompile(`\n([ \t]*)\n`)
+	// mdLinkRe matches the destination of inline links and images, and of
+	// link reference definitions.
+	mdLinkRe   = regexp.MustCompile(`(\]\(\s*<?)([^\s)>]+)|(^\s{0,3}\[[^\]]+\]:\s*<?)([^\s>]+)`)
+	htmlLinkRe = regexp.MustCompile(`(\b(?:href|src)=")([^"]*)`)
+)
+
+// absoluteLinks resolves the links and images in src against base. Code
+// blocks are left alone.
+func absoluteLinks(src []byte, base *url.URL) []byte {
+	resolve := func(re *regexp.Regexp, line string) string {
+		return re.ReplaceAllStringFunc(line, func(m string) string {
+			sm := re.FindStringSubmatch(m)
+			prefix, dest := sm[1], sm[2]
+			if prefix == "" && len(sm) > 3 {
+				prefix, dest = sm[3], sm[4]
+			}
+			if strings.HasPrefix(dest, "#") {
+				return m
+			}
+			u, err := url.Parse(dest)
+			if err != nil || u.Scheme != "" {
+				return m
+			}
+			return prefix + base.ResolveReference(u).String()
+		})
+	}
+	lines := strings.Split(string(src), "\n")
+	fence := ""
+	for i, line := range lines {
+		trimmed := strings.TrimSpace(line)
+		if fence != "" {
+			if strings.HasPrefix(trimmed, fence) && strings.Trim(trimmed, fence[:1]) == "" {
+				fence = ""
+			}
+			continue
+		}
+		if strings.HasPrefix(trimmed, "```") || strings.HasPrefix(trimmed, "~~~") {
+			fence = trimmed[:3]
+			continue
+		}
+		lines[i] = resolve(htmlLinkRe, resolve(mdLinkRe, line))
+	}
+	return []byte(strings.Join(lines, "\n"))
+}
+
+// escapeMarkdown escapes the characters that would end or change the text of
+// a link.
+func escapeMarkdown(s string) string {
+	return strings.NewReplacer(`\`, `\\`, `[`, `\[`, `]`, `\]`, `*`, `\*`, `_`, `\_`, "`", "\\`").Replace(s)
+}
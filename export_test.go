@@ -0,0 +1,203 @@
+package main
+
+import (
+	"net/url"
+	"os"
+	"path/filepath"
+	"slices"
+	"strings"
+	"testing"
+
+	"golang.org/x/net/html"
+	"golang.org/x/net/html/atom"
+)
+
+// preTexts returns the text of every <pre> element in s, as a browser would
+// show it.
+func preTexts(t *testing.T, s string) []string {
+	t.Helper()
+	doc, err := html.Parse(strings.NewReader(s))
+	if err != nil {
+		t.Fatal(err)
+	}
+	var texts []string
+	var walk func(n *html.Node)
+	walk = func(n *html.Node) {
+		if n.DataAtom == atom.Pre {
+			texts = append(texts, nodeText(n))
+			return
+		}
+		for c := n.FirstChild; c != nil; c = c.NextSibling {
+			walk(c)
+		}
+	}
+	walk(doc)
+	return texts
+}
+
+func TestHTMLBlock(t *testing.T) {
+	tests := []struct {
+		name string
+		html string
+		want string
+	}{
+		{
+			name: "no blank lines",
+			html: "<div>\n  <p>Hi</p>\n</div>\n",
+			want: "<div>\n  <p>Hi</p>\n</div>",
+		},
+		{
+			name: "blank lines",
+			html: "<div>\n\n  <p>Hi</p>\n  \t\n</div>",
+			want: "<div>\n  <p>Hi</p>\n</div>",
+		},
+		{
+			name: "blank line in pre",
+			html: "<div>\n\n<pre><code>a := 1\n\nb := 2\n</code></pre>\n\n</div>",
+			want: "<div>\n<pre><code>a := 1\n&#10;b := 2\n</code></pre>\n</div>",
+		},
+		{
+			name: "blank lines in pre",
+			html: "<pre>\n\na\n\n\n  \nb</pre>",
+			want: "<pre>\n&#10;a\n&#10;\n  &#10;b</pre>",
+		},
+		{
+			name: "several pres",
+			html: "<PRE>a\n\nb</PRE>\n\n<p>x</p>\n\n<pre class=\"chroma\">c\n\nd</pre>",
+			want: "<PRE>a\n&#10;b</PRE>\n<p>x</p>\n<pre class=\"chroma\">c\n&#10;d</pre>",
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got := htmlBlock(tt.html)
+			if got != tt.want {
+				t.Errorf("htmlBlock() = %q, want %q", got, tt.want)
+			}
+			for _, line := range strings.Split(got, "\n") {
+				if strings.TrimSpace(line) == "" {
+					t.Errorf("htmlBlock() = %q, which has a blank line", got)
+					break
+				}
+			}
+			wantPre, gotPre := preTexts(t, tt.html), preTexts(t, got)
+			if strings.Join(gotPre, "|") != strings.Join(wantPre, "|") {
+				t.Errorf("pre text = %q, want %q", gotPre, wantPre)
+			}
+		})
+	}
+}
+
+func TestMDLinkRe(t *testing.T) {
+	tests := []struct {
+		line string
+		want []string
+	}{
+		{"[text](/posts/a)", []string{"/posts/a"}},
+		{"![alt](img.png)", []string{"img.png"}},
+		{"[a](/a) and [b](/b \"title\")", []string{"/a", "/b"}},
+		{"[text](<spaced.md>)", []string{"spaced.md"}},
+		{"[text]( /padded )", []string{"/padded"}},
+		{"[ref]: /posts/ref", []string{"/posts/ref"}},
+		{"   [ref]: <angled> \"title\"", []string{"angled"}},
+		{"    [ref]: /indented-code", nil},
+		{"[not a link] (/space)", nil},
+		{"plain text", nil},
+	}
+	for _, tt := range tests {
+		t.Run(tt.line, func(t *testing.T) {
+			var got []string
+			for _, sm := range mdLinkRe.FindAllStringSubmatch(tt.line, -1) {
+				if sm[2] != "" {
+					got = append(got, sm[2])
+				} else {
+					got = append(got, sm[4])
+				}
+			}
+			if strings.Join(got, "|") != strings.Join(tt.want, "|") {
+				t.Errorf("destinations = %q, want %q", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestAbsoluteLinks(t *testing.T) {
+	base, err := url.Parse("https://example.com/posts/go")
+	if err != nil {
+		t.Fatal(err)
+	}
+	tests := []struct {
+		name string
+		src  string
+		want string
+	}{
+		{"root relative", "[a](/posts/b)", "[a](https://example.com/posts/b)"},
+		{"relative", "![img](diagram.png)", "![img](https://example.com/posts/diagram.png)"},
+		{"parent", "[up](../about)", "[up](https://example.com/about)"},
+		{"absolute", "[x](https://other.example/a)", "[x](https://other.example/a)"},
+		{"mailto", "[mail](mailto:jon@example.com)", "[mail](mailto:jon@example.com)"},
+		{"fragment", "[jump](#setup)", "[jump](#setup)"},
+		{"query", "[q](/search?q=go)", "[q](https://example.com/search?q=go)"},
+		{"title kept", `[a](/b "The title")`, `[a](https://example.com/b "The title")`},
+		{"angle brackets", "[a](</b>)", "[a](<https://example.com/b>)"},
+		{"reference", "[ref]: /posts/ref", "[ref]: https://example.com/posts/ref"},
+		{"html", `<a href="/a"><img src="img.png"></a>`, `<a href="https://example.com/a"><img src="https://example.com/posts/img.png"></a>`},
+		{"html absolute", `<img src="https://cdn.example/x.png">`, `<img src="https://cdn.example/x.png">`},
+		{
+			name: "fenced code",
+			src:  "[a](/a)\n```md\n[b](/b)\n```\n[c](/c)",
+			want: "[a](https://example.com/a)\n```md\n[b](/b)\n```\n[c](https://example.com/c)",
+		},
+		{
+			name: "tilde fence with a longer close",
+			src:  "~~~\n<a href=\"/x\">\n~~~~\n<a href=\"/y\">",
+			want: "~~~\n<a href=\"/x\">\n~~~~\n<a href=\"https://example.com/y\">",
+		},
+		{
+			name: "unclosed fence",
+			src:  "```\n[a](/a)",
+			want: "```\n[a](/a)",
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got := string(absoluteLinks([]byte(tt.src), base))
+			if got != tt.want {
+				t.Errorf("absoluteLinks() = %q, want %q", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestRunExportSections(t *testing.T) {
+	dir := t.TempDir()
+	writeFiles(t, dir, map[string]string{
+		"top.md":             "+++\ntitle = \"Top\"\n+++\nTop.\n",
+		"guides/_index.toml": "[author]\nname = \"Section Author\"\n",
+		"guides/setup.md":    "+++\ntitle = \"Setup\"\n+++\nSetup.\n",
+		"widget/_index.toml": "type = \"docs\"\ntitle = \"Widget\"\n",
+		"widget/install.md":  "+++\ntitle = \"Install\"\n+++\nInstall.\n",
+	})
+	out := t.TempDir()
+	var w strings.Builder
+	err := runExport(&w, FileReader{Dir: dir}, "https://example.com", []string{"-o", out})
+	if err != nil {
+		t.Fatalf("runExport() error = %v", err)
+	}
+	got, err := filepath.Glob(filepath.Join(out, "*"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	for i := range got {
+		got[i] = filepath.Base(got[i])
+	}
+	if want := []string{"setup.md", "top.md"}; !slices.Equal(got, want) {
+		t.Errorf("exported %q, want %q", got, want)
+	}
+	setup, err := os.ReadFile(filepath.Join(out, "setup.md"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !strings.Contains(string(setup), `author: "Section Author"`) {
+		t.Errorf("setup.md = %q, want the section's author", setup)
+	}
+}
@@ -0,0 +1,13 @@
+// Embeds are only loaded from third parties once the reader asks for them.
+document.addEventListener("click", (e) => {
+  const button = e.target.closest(".embed-load");
+  if (!button) return;
+  const facade = button.closest("[data-embed-src]");
+  const iframe = document.createElement("iframe");
+  iframe.src = facade.dataset.embedSrc;
+  iframe.title = facade.dataset.embedTitle;
+  iframe.allow = "autoplay; encrypted-media; picture-in-picture; fullscreen";
+  iframe.referrerPolicy = "strict-origin-when-cross-origin";
+  iframe.className = "absolute inset-0 w-full h-full";
+  facade.replaceChildren(iframe);
+});
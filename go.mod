@@ -3,11 +3,17 @@ module github.com/joncalhoun/jonblog
 go 1.22.1
 
 require (
-	github.com/BurntSushi/toml v0.3.1 // indirect
-	github.com/adrg/frontmatter v0.2.0 // indirect
-	github.com/alecthomas/chroma/v2 v2.2.0 // indirect
+	github.com/BurntSushi/toml v0.3.1
+	github.com/adrg/frontmatter v0.2.0
+	github.com/alecthomas/chroma/v2 v2.2.0
+	github.com/tetratelabs/wazero v1.7.3
+	github.com/yuin/goldmark v1.7.0
+	github.com/yuin/goldmark-highlighting/v2 v2.0.0-20230729083705-37449abec8cc
+	golang.org/x/image v0.18.0
+	golang.org/x/net v0.25.0
+)
+
+require (
 	github.com/dlclark/regexp2 v1.7.0 // indirect
-	github.com/yuin/goldmark v1.7.0 // indirect
-	github.com/yuin/goldmark-highlighting/v2 v2.0.0-20230729083705-37449abec8cc // indirect
 	gopkg.in/yaml.v2 v2.3.0 // indirect
 )
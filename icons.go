@@ -0,0 +1,232 @@
+package main
+
+import (
+	"bytes"
+	"encoding/binary"
+	"encoding/json"
+	"fmt"
+	"image"
+	"image/color"
+	"image/png"
+	"net/http"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"golang.org/x/image/draw"
+)
+
+// icon is one file generated from the source image. Opaque icons are drawn
+// on the background color, since Apple fills transparency with black.
+// Maskable icons keep the image within the middle 80%, which is the area
+// platforms promise not to crop.
+type icon struct {
+	name     string
+	size     int
+	opaque   bool
+	maskable bool
+}
+
+var iconFiles = []icon{
+	{name: "favicon-16x16.png", size: 16},
+	{name: "favicon-32x32.png", size: 32},
+	{name: "apple-touch-icon.png", size: 180, opaque: true},
+	{name: "icon-192.png", size: 192},
+	{name: "icon-512.png", size: 512},
+	{name: "icon-maskable-192.png", size: 192, opaque: true, maskable: true},
+	{name: "icon-maskable-512.png", size: 512, opaque: true, maskable: true},
+}
+
+// favicon.ico holds these sizes, which covers browser tabs and Windows
+// shortcuts.
+var icoSizes = []int{16, 32, 48}
+
+// IconSet is every favicon and app icon, generated in memory from a single
+// source image when the server starts.
+type IconSet struct {
+	files   map[string][]byte
+	modTime time.Time
+}
+
+// NewIconSet generates the icons from cfg.Source, which should be square and
+// at least 512 pixels wide.
+func NewIconSet(cfg IconConfig) (*IconSet, error) {
+	b, err := os.ReadFile(cfg.Source)
+	if err != nil {
+		return nil, err
+	}
+	info, err := os.Stat(cfg.Source)
+	if err != nil {
+		return nil, err
+	}
+	src, _, err := image.Decode(bytes.NewReader(b))
+	if err != nil {
+		return nil, fmt.Errorf("icons: decoding %s: %w", cfg.Source, err)
+	}
+	if e, err := readEXIF(b); err == nil {
+		src = orient(src, e.Orientation)
+	}
+	bg, err := parseHexColor(cfg.Background)
+	if err != nil {
+		return nil, fmt.Errorf("icons: background: %w", err)
+	}
+
+	is := &IconSet{files: make(map[string][]byte), modTime: info.ModTime()}
+	for _, ic := range iconFiles {
+		var fill color.Color = color.Transparent
+		if ic.opaque {
+			fill = bg
+		}
+		pad := 0
+		if ic.maskable {
+			pad = ic.size / 10
+		}
+		is.files[ic.name], err = encodePNG(squareIcon(src, ic.size, pad, fill))
+		if err != nil {
+			return nil, err
+		}
+	}
+	is.files["favicon.ico"], err = encodeICO(src, icoSizes)
+	if err != nil {
+		return nil, err
+	}
+	is.files["site.webmanifest"], err = webManifest(cfg.Background)
+	if err != nil {
+		return nil, err
+	}
+	return is, nil
+}
+
+// squareIcon scales img to fit within a size x size square, less pad on each
+// side, and centers it on fill.
+func squareIcon(img image.Image, size, pad int, fill color.Color) *image.NRGBA {
+	dst := image.NewNRGBA(image.Rect(0, 0, size, size))
+	draw.Draw(dst, dst.Bounds(), image.NewUniform(fill), image.Point{}, draw.Src)
+	b := img.Bounds()
+	inner := size - 2*pad
+	scale := min(float64(inner)/float64(b.Dx()), float64(inner)/float64(b.Dy()))
+	w := max(1, int(float64(b.Dx())*scale+0.5))
+	h := max(1, int(float64(b.Dy())*scale+0.5))
+	x, y := (size-w)/2, (size-h)/2
+	draw.CatmullRom.Scale(dst, image.Rect(x, y, x+w, y+h), img, b, draw.Over, nil)
+	return dst
+}
+
+func encodePNG(img image.Image) ([]byte, error) {
+	var buf bytes.Buffer
+	err := png.Encode(&buf, img)
+	return buf.Bytes(), err
+}
+
+// encodeICO writes an ICO file with a PNG image for each size, which every
+// browser still in use understands.
+func encodeICO(img image.Image, sizes []int) ([]byte, error) {
+	var images [][]byte
+	for _, size := range sizes {
+		b, err := encodePNG(squareIcon(img, size, 0, color.Transparent))
+		if err != nil {
+			return nil, err
+		}
+		images = append(images, b)
+	}
+	var buf bytes.Buffer
+	binary.Write(&buf, binary.LittleEndian, [3]uint16{0, 1, uint16(len(sizes))})
+	offset := 6 + 16*len(sizes)
+	for i, size := range sizes {
+		dim := uint8(size)
+		if size >= 256 {
+			dim = 0
+		}
+		binary.Write(&buf, binary.LittleEndian, struct {
+			Width, Height, Colors, Reserved uint8
+			Planes, BitCount                uint16
+			Size, Offset                    uint32
+		}{dim, dim, 0, 0, 1, 32, uint32(len(images[i])), uint32(offset)})
+		offset += len(images[i])
+	}
+	for _, b := range images {
+		buf.Write(b)
+	}
+	return buf.Bytes(), nil
+}
+
+func webManifest(background string) ([]byte, error) {
+	type manifestIcon struct {
+		Src     string `json:"src"`
+		Sizes   string `json:"sizes"`
+		Type    string `json:"type"`
+		Purpose string `json:"purpose,omitempty"`
+	}
+	var icons []manifestIcon
+	for _, ic := range iconFiles {
+		if !strings.HasPrefix(ic.name, "icon-") {
+			continue
+		}
+		mi := manifestIcon{Src: "/" + ic.name, Sizes: fmt.Sprintf("%dx%d", ic.size, ic.size), Type: "image/png"}
+		if ic.maskable {
+			mi.Purpose = "maskable"
+		}
+		icons = append(icons, mi)
+	}
+	return json.MarshalIndent(struct {
+		Name            string         `json:"name"`
+		ShortName       string         `json:"short_name"`
+		Icons           []manifestIcon `json:"icons"`
+		ThemeColor      string         `json:"theme_color"`
+		BackgroundColor string         `json:"background_color"`
+		Display         string         `json:"display"`
+	}{"Jon's Blog", "Jon's Blog", icons, background, background, "browser"}, "", "  ")
+}
+
+// parseHexColor parses a color in the #rrggbb form.
+func parseHexColor(s string) (color.Color, error) {
+	if len(s) != 7 || s[0] != '#' {
+		return nil, fmt.Errorf("invalid color %q", s)
+	}
+	v, err := strconv.ParseUint(s[1:], 16, 32)
+	if err != nil {
+		return nil, fmt.Errorf("invalid color %q", s)
+	}
+	return color.NRGBA{R: uint8(v >> 16), G: uint8(v >> 8), B: uint8(v), A: 0xff}, nil
+}
+
+// iconLinks is what {{template "icons"}} renders in the head of every page.
+// It is set when the server or a build starts with icons set up, and is empty
+// otherwise so pages don't link to icons that don't exist.
+var iconLinks string
+
+const iconLinksHTML = `<link rel="icon" href="/favicon.ico" sizes="any">
+  <link rel="icon" type="image/png" sizes="32x32" href="/favicon-32x32.png">
+  <link rel="icon" type="image/png" sizes="16x16" href="/favicon-16x16.png">
+  <link rel="apple-touch-icon" href="/apple-touch-icon.png">
+  <link rel="manifest" href="/site.webmanifest">`
+
+// Names returns the name of every file in the set, each of which is served
+// from the root of the site.
+func (is *IconSet) Names() []string {
+	var names []string
+	for name := range is.files {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
+
+// Handler serves the icon named by the request path.
+func (is *IconSet) Handler() http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		name := strings.TrimPrefix(r.URL.Path, "/")
+		b, ok := is.files[name]
+		if !ok {
+			http.NotFound(w, r)
+			return
+		}
+		if name == "site.webmanifest" {
+			w.Header().Set("Content-Type", "application/manifest+json")
+		}
+		w.Header().Set("Cache-Control", "public, max-age=86400")
+		http.ServeContent(w, r, name, is.modTime, bytes.NewReader(b))
+	}
+}
@@ -0,0 +1,183 @@
+package main
+
+import (
+	"bytes"
+	"encoding/binary"
+	"encoding/json"
+	"image"
+	"image/color"
+	"image/png"
+	"os"
+	"path/filepath"
+	"slices"
+	"sort"
+	"strings"
+	"testing"
+
+	"golang.org/x/image/draw"
+)
+
+func TestIconLinks(t *testing.T) {
+	ar := AlbumReader{Dir: t.TempDir()}
+	t.Cleanup(func() { iconLinks = "" })
+	tests := []struct {
+		name  string
+		links string
+		want  bool
+	}{
+		{"icons off", "", false},
+		{"icons on", iconLinksHTML, true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			iconLinks = tt.links
+			page := serve(t, "GET /albums", "/albums", AlbumsHandler(ar))
+			for _, name := range []string{"/favicon.ico", "/site.webmanifest", "/apple-touch-icon.png"} {
+				if got := strings.Contains(page, `href="`+name+`"`); got != tt.want {
+					t.Errorf("page links to %s: %t, want %t", name, got, tt.want)
+				}
+			}
+		})
+	}
+}
+
+func TestNewIconSet(t *testing.T) {
+	src := image.NewNRGBA(image.Rect(0, 0, 600, 400))
+	draw.Draw(src, src.Bounds(), image.NewUniform(color.NRGBA{R: 0xff, A: 0xff}), image.Point{}, draw.Src)
+	b, err := encodePNG(src)
+	if err != nil {
+		t.Fatal(err)
+	}
+	path := filepath.Join(t.TempDir(), "icon.png")
+	err = os.WriteFile(path, b, 0644)
+	if err != nil {
+		t.Fatal(err)
+	}
+	is, err := NewIconSet(IconConfig{Source: path, Background: "#112233"})
+	if err != nil {
+		t.Fatalf("NewIconSet() error = %v", err)
+	}
+
+	wantNames := []string{"favicon.ico", "site.webmanifest"}
+	for _, ic := range iconFiles {
+		wantNames = append(wantNames, ic.name)
+	}
+	sort.Strings(wantNames)
+	if got := is.Names(); !slices.Equal(got, wantNames) {
+		t.Errorf("Names() = %q, want %q", got, wantNames)
+	}
+
+	t.Run("png", func(t *testing.T) {
+		for _, ic := range iconFiles {
+			img, err := png.Decode(bytes.NewReader(is.files[ic.name]))
+			if err != nil {
+				t.Fatalf("%s: %v", ic.name, err)
+			}
+			if got := img.Bounds().Size(); got != image.Pt(ic.size, ic.size) {
+				t.Errorf("%s is %v, want %dx%d", ic.name, got, ic.size, ic.size)
+			}
+			// The source is wider than it is tall, so the corners are padding.
+			_, _, _, a := img.At(0, 0).RGBA()
+			if opaque := a == 0xffff; opaque != ic.opaque {
+				t.Errorf("%s corner opaque = %t, want %t", ic.name, opaque, ic.opaque)
+			}
+		}
+	})
+
+	t.Run("ico", func(t *testing.T) {
+		ico := is.files["favicon.ico"]
+		var header [3]uint16
+		err := binary.Read(bytes.NewReader(ico), binary.LittleEndian, &header)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if want := [3]uint16{0, 1, uint16(len(icoSizes))}; header != want {
+			t.Fatalf("ICO header = %v, want %v", header, want)
+		}
+		for i, size := range icoSizes {
+			entry := ico[6+16*i : 6+16*(i+1)]
+			if int(entry[0]) != size || int(entry[1]) != size {
+				t.Errorf("entry %d is %dx%d, want %dx%d", i, entry[0], entry[1], size, size)
+			}
+			n, offset := binary.LittleEndian.Uint32(entry[8:]), binary.LittleEndian.Uint32(entry[12:])
+			if int(offset)+int(n) > len(ico) {
+				t.Fatalf("entry %d runs past the end of the file", i)
+			}
+			img, err := png.Decode(bytes.NewReader(ico[offset : offset+n]))
+			if err != nil {
+				t.Fatalf("entry %d: %v", i, err)
+			}
+			if got := img.Bounds().Size(); got != image.Pt(size, size) {
+				t.Errorf("entry %d image is %v, want %dx%d", i, got, size, size)
+			}
+		}
+	})
+
+	t.Run("manifest", func(t *testing.T) {
+		var got struct {
+			Icons []struct {
+				Src, Sizes, Type, Purpose string
+			} `json:"icons"`
+			ThemeColor      string `json:"theme_color"`
+			BackgroundColor string `json:"background_color"`
+		}
+		err := json.Unmarshal(is.files["site.webmanifest"], &got)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if got.ThemeColor != "#112233" || got.BackgroundColor != "#112233" {
+			t.Errorf("manifest colors = %q, %q, want #112233", got.ThemeColor, got.BackgroundColor)
+		}
+		var icons []string
+		for _, ic := range got.Icons {
+			icons = append(icons, strings.TrimSpace(ic.Src+" "+ic.Sizes+" "+ic.Type+" "+ic.Purpose))
+		}
+		want := []string{
+			"/icon-192.png 192x192 image/png",
+			"/icon-512.png 512x512 image/png",
+			"/icon-maskable-192.png 192x192 image/png maskable",
+			"/icon-maskable-512.png 512x512 image/png maskable",
+		}
+		if !slices.Equal(icons, want) {
+			t.Errorf("manifest icons = %q, want %q", icons, want)
+		}
+	})
+
+	t.Run("bad background", func(t *testing.T) {
+		_, err := NewIconSet(IconConfig{Source: path, Background: "red"})
+		if err == nil {
+			t.Errorf("NewIconSet() with a bad background succeeded")
+		}
+	})
+}
+
+func TestParseHexColor(t *testing.T) {
+	tests := []struct {
+		s       string
+		want    color.Color
+		wantErr bool
+	}{
+		{"#112233", color.NRGBA{R: 0x11, G: 0x22, B: 0x33, A: 0xff}, false},
+		{"#FFffFF", color.NRGBA{R: 0xff, G: 0xff, B: 0xff, A: 0xff}, false},
+		{"", nil, true},
+		{"112233", nil, true},
+		{"#123", nil, true},
+		{"#1122334", nil, true},
+		{"#11223g", nil, true},
+		{"#+12345", nil, true},
+		{"#-12345", nil, true},
+		{"#_12345", nil, true},
+		{"red", nil, true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.s, func(t *testing.T) {
+			got, err := parseHexColor(tt.s)
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("parseHexColor(%q) error = %v, want error %t", tt.s, err, tt.wantErr)
+			}
+			if got != tt.want {
+				t.Errorf("parseHexColor(%q) = %v, want %v", tt.s, got, tt.want)
+			}
+		})
+	}
+}
@@ -0,0 +1,112 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"image"
+	"image/color"
+	"image/jpeg"
+	_ "image/png"
+	"os"
+	"path/filepath"
+
+	"golang.org/x/image/draw"
+)
+
+// resizeToFit scales img down so that it fits within w x h, keeping its aspect
+// ratio. Images that already fit are returned as is.
+func resizeToFit(img image.Image, w, h int) image.Image {
+	b := img.Bounds()
+	if b.Dx() <= w && b.Dy() <= h {
+		return img
+	}
+	scale := min(float64(w)/float64(b.Dx()), float64(h)/float64(b.Dy()))
+	dw := max(1, int(float64(b.Dx())*scale+0.5))
+	dh := max(1, int(float64(b.Dy())*scale+0.5))
+	dst := image.NewRGBA(image.Rect(0, 0, dw, dh))
+	draw.CatmullRom.Scale(dst, dst.Bounds(), img, b, draw.Over, nil)
+	return dst
+}
+
+// orient rotates img so it displays upright, given its EXIF orientation.
+func orient(img image.Image, orientation int) image.Image {
+	b := img.Bounds()
+	var dst *image.RGBA
+	var at func(x, y int) (int, int)
+	switch orientation {
+	case 3:
+		dst = image.NewRGBA(image.Rect(0, 0, b.Dx(), b.Dy()))
+		at = func(x, y int) (int, int) { return b.Dx() - 1 - x, b.Dy() - 1 - y }
+	case 6:
+		dst = image.NewRGBA(image.Rect(0, 0, b.Dy(), b.Dx()))
+		at = func(x, y int) (int, int) { return b.Dy() - 1 - y, x }
+	case 8:
+		dst = image.NewRGBA(image.Rect(0, 0, b.Dy(), b.Dx()))
+		at = func(x, y int) (int, int) { return y, b.Dx() - 1 - x }
+	default:
+		return img
+	}
+	for y := 0; y < b.Dy(); y++ {
+		for x := 0; x < b.Dx(); x++ {
+			dx, dy := at(x, y)
+			dst.Set(dx, dy, img.At(b.Min.X+x, b.Min.Y+y))
+		}
+	}
+	return dst
+}
+
+// ImageCache stores resized copies of images. Entries are regenerated
+// whenever the source image is newer than the cached copy.
+type ImageCache struct {
+	Dir string
+}
+
+// Resized returns the path of a JPEG copy of src that fits within w x h. key
+// is a relative, slash separated name for the copy within the cache. The copy
+// has no metadata, since it is re-encoded.
+func (ic ImageCache) Resized(src, key string, w, h int) (string, error) {
+	dst := filepath.Join(ic.Dir, fmt.Sprintf("%dx%d", w, h), filepath.FromSlash(key)+".jpg")
+	srcInfo, err := os.Stat(src)
+	if err != nil {
+		return "", err
+	}
+	if dstInfo, err := os.Stat(dst); err == nil && !dstInfo.ModTime().Before(srcInfo.ModTime()) {
+		return dst, nil
+	}
+
+	b, err := os.ReadFile(src)
+	if err != nil {
+		return "", err
+	}
+	img, _, err := image.Decode(bytes.NewReader(b))
+	if err != nil {
+		return "", fmt.Errorf("decoding %s: %w", src, err)
+	}
+	if e, err := readEXIF(b); err == nil {
+		img = orient(img, e.Orientation)
+	}
+	img = resizeToFit(img, w, h)
+	// JPEG has no transparency, so flatten onto white.
+	flat := image.NewRGBA(img.Bounds())
+	draw.Draw(flat, flat.Bounds(), image.NewUniform(color.White), image.Point{}, draw.Src)
+	draw.Draw(flat, flat.Bounds(), img, img.Bounds().Min, draw.Over)
+
+	err = os.MkdirAll(filepath.Dir(dst), 0755)
+	if err != nil {
+		return "", err
+	}
+	tmp := dst + ".tmp"
+	f, err := os.Create(tmp)
+	if err != nil {
+		return "", err
+	}
+	err = jpeg.Encode(f, flat, &jpeg.Options{Quality: 82})
+	if cerr := f.Close(); err == nil {
+		err = cerr
+	}
+	if err != nil {
+		os.Remove(tmp)
+		return "", err
+	}
+	return dst, os.Rename(tmp, dst)
+}
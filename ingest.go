@@ -0,0 +1,491 @@
+package main
+
+import (
+	"bytes"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"mime"
+	"mime/multipart"
+	"mime/quotedprintable"
+	"net/mail"
+	"net/smtp"
+	"net/url"
+	"os"
+	"path"
+	"path/filepath"
+	"regexp"
+	"strings"
+	"time"
+
+	"golang.org/x/net/html"
+)
+
+// DraftIngester turns email messages into markdown drafts.
+type DraftIngester struct {
+	Config Config
+}
+
+var (
+	subjectSecretRe = regexp.MustCompile(`\s*\[([^\]]+)\]\s*`)
+	blankLinesRe    = regexp.MustCompile(`\n{3,}`)
+)
+
+// Deliver creates a draft from the message read from r. The sender and
+// secret are checked from the headers alone, so the body of a message that
+// would be rejected is never read.
+func (di DraftIngester) Deliver(envFrom string, to []string, r io.Reader) error {
+	msg, err := mail.ReadMessage(r)
+	if err != nil {
+		return err
+	}
+	dec := new(mime.WordDecoder)
+	subject, err := dec.DecodeHeader(msg.Header.Get("Subject"))
+	if err != nil {
+		subject = msg.Header.Get("Subject")
+	}
+	author, err := mail.ParseAddress(msg.Header.Get("From"))
+	if err != nil {
+		return fmt.Errorf("parsing From header: %w", err)
+	}
+	if !di.allowed(envFrom) || !di.allowed(author.Address) {
+		return fmt.Errorf("sender %s is not allowed", author.Address)
+	}
+	subject, ok := di.checkSecret(subject, to)
+	if !ok {
+		return errors.New("missing or invalid secret")
+	}
+
+	var parts mailParts
+	err = parts.collect(msg.Header, msg.Body)
+	if err != nil {
+		return err
+	}
+
+	title := strings.TrimSpace(subject)
+	if title == "" {
+		title = "Untitled"
+	}
+	slug, err := di.newSlug(title)
+	if err != nil {
+		return err
+	}
+
+	// Attachments are stored first so that inline images referenced by
+	// cid: in an HTML body can be rewritten to their new location.
+	cids := make(map[string]string)
+	var links []string
+	for _, a := range parts.attachments {
+		urlPath, err := di.storeMedia(slug, a)
+		if err != nil {
+			return err
+		}
+		if a.contentID != "" {
+			cids[a.contentID] = urlPath
+			continue
+		}
+		if strings.HasPrefix(a.contentType, "image/") {
+			links = append(links, fmt.Sprintf("![%s](%s)", a.filename, urlPath))
+		} else {
+			links = append(links, fmt.Sprintf("[%s](%s)", a.filename, urlPath))
+		}
+	}
+
+	var body string
+	switch {
+	case parts.text != "":
+		body = strings.ReplaceAll(parts.text, "\r\n", "\n")
+	case parts.html != "":
+		body, err = htmlToMarkdown(parts.html, cids)
+		if err != nil {
+			return err
+		}
+	}
+	body = strings.TrimSpace(body)
+	if len(links) > 0 {
+		body += "\n\n" + strings.Join(links, "\n\n")
+	}
+
+	var buf bytes.Buffer
+	fmt.Fprintln(&buf, "+++")
+	fmt.Fprintf(&buf, "title = %s\n", tomlString(title))
+	fmt.Fprintln(&buf, `description = ""`)
+	fmt.Fprintf(&buf, "date = %s\n", time.Now().Format("2006-01-02"))
+	fmt.Fprintln(&buf, "draft = true")
+	fmt.Fprintln(&buf)
+	fmt.Fprintln(&buf, "[author]")
+	fmt.Fprintf(&buf, "name = %s\n", tomlString(author.Name))
+	fmt.Fprintf(&buf, "email = %s\n", tomlString(author.Address))
+	fmt.Fprintln(&buf, "+++")
+	fmt.Fprintln(&buf)
+	fmt.Fprintln(&buf, body)
+
+	err = os.MkdirAll(di.Config.DraftsDir, 0755)
+	if err != nil {
+		return err
+	}
+	err = os.WriteFile(filepath.Join(di.Config.DraftsDir, slug+".md"), buf.Bytes(), 0644)
+	if err != nil {
+		return err
+	}
+	log.Printf("smtp: created draft %q from %s", slug, author.Address)
+	return di.notify(author, title, slug)
+}
+
+func (di DraftIngester) allowed(addr string) bool {
+	for _, a := range di.Config.SMTP.Allowed {
+		if strings.EqualFold(a, addr) {
+			return true
+		}
+	}
+	return false
+}
+
+// checkSecret looks for the shared secret in the recipient +tag or in the
+// subject. The subject is returned with the secret removed.
+func (di DraftIngester) checkSecret(subject string, to []string) (string, bool) {
+	secret := di.Config.SMTP.Secret
+	if secret == "" {
+		return subject, false
+	}
+	for _, rcpt := range to {
+		local, _, _ := strings.Cut(rcpt, "@")
+		_, tag, ok := strings.Cut(local, "+")
+		if ok && strings.EqualFold(tag, secret) {
+			return subject, true
+		}
+	}
+	found := false
+	subject = subjectSecretRe.ReplaceAllStringFunc(subject, func(m string) string {
+		if strings.TrimSpace(m) == "["+secret+"]" {
+			found = true
+			return " "
+		}
+		return m
+	})
+	return strings.TrimSpace(subject), found
+}
+
+func (di DraftIngester) newSlug(title string) (string, error) {
+	base := slugify(title)
+	if base == "" {
+		base = "draft"
+	}
+	slug := base
+	for i := 2; ; i++ {
+		_, err := os.Stat(filepath.Join(di.Config.DraftsDir, slug+".md"))
+		if errors.Is(err, os.ErrNotExist) {
+			return slug, nil
+		}
+		if err != nil {
+			return "", err
+		}
+		slug = fmt.Sprintf("%s-%d", base, i)
+	}
+}
+
+// storeMedia saves an attachment in the draft's media directory. Attachments
+// never replace an existing file; a name that is taken gets a numbered suffix,
+// as in photo-2.jpg.
+func (di DraftIngester) storeMedia(slug string, a attachment) (string, error) {
+	dir := filepath.Join(di.Config.MediaDir, slug)
+	err := os.MkdirAll(dir, 0755)
+	if err != nil {
+		return "", err
+	}
+	ext := filepath.Ext(a.filename)
+	base := strings.TrimSuffix(a.filename, ext)
+	name := a.filename
+	for i := 2; ; i++ {
+		f, err := os.OpenFile(filepath.Join(dir, name), os.O_WRONLY|os.O_CREATE|os.O_EXCL, 0644)
+		if errors.Is(err, os.ErrExist) {
+			name = fmt.Sprintf("%s-%d%s", base, i, ext)
+			continue
+		}
+		if err != nil {
+			return "", err
+		}
+		_, err = f.Write(a.data)
+		if cerr := f.Close(); err == nil {
+			err = cerr
+		}
+		if err != nil {
+			return "", err
+		}
+		return path.Join("/media", slug, url.PathEscape(name)), nil
+	}
+}
+
+func (di DraftIngester) notify(author *mail.Address, title, slug string) error {
+	link := previewURL(di.Config, slug)
+	mc := di.Config.Mail
+	if mc.Addr == "" {
+		log.Printf("smtp: preview for %s: %s", author.Address, link)
+		return nil
+	}
+	var msg bytes.Buffer
+	fmt.Fprintf(&msg, "From: %s\r\n", mc.From)
+	fmt.Fprintf(&msg, "To: %s\r\n", author.String())
+	fmt.Fprintf(&msg, "Subject: %s\r\n", mime.QEncoding.Encode("utf-8", "Draft created: "+title))
+	fmt.Fprintf(&msg, "Content-Type: text/plain; charset=utf-8\r\n\r\n")
+	fmt.Fprintf(&msg, "Your draft %q is ready.\r\n\r\nPreview it at %s\r\n", title, link)
+	return sendMail(mc, []string{author.Address}, msg.Bytes())
+}
+
+func sendMail(mc MailConfig, to []string, msg []byte) error {
+	var auth smtp.Auth
+	if mc.Username != "" {
+		host, _, _ := strings.Cut(mc.Addr, ":")
+		auth = smtp.PlainAuth("", mc.Username, mc.Password, host)
+	}
+	return smtp.SendMail(mc.Addr, auth, mc.From, to, msg)
+}
+
+// previewURL returns a signed link to a draft.
+func previewURL(cfg Config, slug string) string {
+	return fmt.Sprintf("%s/drafts/%s?sig=%s", strings.TrimSuffix(cfg.BaseURL, "/"), slug, sign(cfg.Secret, "draft:"+slug))
+}
+
+type attachment struct {
+	filename    string
+	contentType string
+	contentID   string
+	data        []byte
+}
+
+type mailParts struct {
+	text        string
+	html        string
+	attachments []attachment
+}
+
+// collect walks a (possibly multipart) message body, keeping the first text
+// and HTML bodies and every attachment.
+func (mp *mailParts) collect(h mail.Header, r io.Reader) error {
+	mediaType, params, err := mime.ParseMediaType(h.Get("Content-Type"))
+	if err != nil {
+		mediaType = "text/plain"
+	}
+	if strings.HasPrefix(mediaType, "multipart/") {
+		mr := multipart.NewReader(r, params["boundary"])
+		for {
+			p, err := mr.NextRawPart()
+			if err == io.EOF {
+				return nil
+			}
+			if err != nil {
+				return err
+			}
+			err = mp.collect(mail.Header(p.Header), p)
+			if err != nil {
+				return err
+			}
+		}
+	}
+
+	data, err := io.ReadAll(decodeTransfer(h.Get("Content-Transfer-Encoding"), r))
+	if err != nil {
+		return err
+	}
+	disposition, dparams, _ := mime.ParseMediaType(h.Get("Content-Disposition"))
+	filename := dparams["filename"]
+	if filename == "" {
+		filename = params["name"]
+	}
+	switch {
+	case disposition != "attachment" && filename == "" && mediaType == "text/plain" && mp.text == "":
+		mp.text = string(data)
+	case disposition != "attachment" && filename == "" && mediaType == "text/html" && mp.html == "":
+		mp.html = string(data)
+	default:
+		if filename == "" {
+			exts, _ := mime.ExtensionsByType(mediaType)
+			filename = "attachment"
+			if len(exts) > 0 {
+				filename += exts[0]
+			}
+		}
+		mp.attachments = append(mp.attachments, attachment{
+			filename:    filepath.Base(filepath.Clean("/" + filename)),
+			contentType: mediaType,
+			contentID:   strings.Trim(h.Get("Content-ID"), "<>"),
+			data:        data,
+		})
+	}
+	return nil
+}
+
+func decodeTransfer(encoding string, r io.Reader) io.Reader {
+	switch strings.ToLower(encoding) {
+	case "base64":
+		return base64.NewDecoder(base64.StdEncoding, &newlineStripper{r})
+	case "quoted-printable":
+		return quotedprintable.NewReader(r)
+	}
+	return r
+}
+
+// newlineStripper drops CR and LF bytes, which the base64 decoder rejects.
+type newlineStripper struct{ r io.Reader }
+
+func (ns *newlineStripper) Read(p []byte) (int, error) {
+	n, err := ns.r.Read(p)
+	j := 0
+	for _, b := range p[:n] {
+		if b != '\r' && b != '\n' {
+			p[j] = b
+			j++
+		}
+	}
+	return j, err
+}
+
+// htmlToMarkdown converts the subset of HTML mail clients typically produce
+// into markdown. Anything it doesn't understand is reduced to its text.
+func htmlToMarkdown(src string, cids map[string]string) (string, error) {
+	doc, err := html.Parse(strings.NewReader(src))
+	if err != nil {
+		return "", err
+	}
+	var walk func(buf *strings.Builder, n *html.Node, listPrefix string)
+	children := func(buf *strings.Builder, n *html.Node, listPrefix string) {
+		for c := n.FirstChild; c != nil; c = c.NextSibling {
+			walk(buf, c, listPrefix)
+		}
+	}
+	walk = func(buf *strings.Builder, n *html.Node, listPrefix string) {
+		switch n.Type {
+		case html.TextNode:
+			text := strings.Join(strings.Fields(n.Data), " ")
+			if text == "" {
+				if n.Data != "" {
+					buf.WriteString(" ")
+				}
+				return
+			}
+			if strings.TrimLeft(n.Data, " \t\r\n") != n.Data {
+				text = " " + text
+			}
+			if strings.TrimRight(n.Data, " \t\r\n") != n.Data {
+				text += " "
+			}
+			buf.WriteString(text)
+			return
+		case html.ElementNode:
+		default:
+			children(buf, n, listPrefix)
+			return
+		}
+		switch n.Data {
+		case "head", "style", "script", "title":
+		case "br":
+			buf.WriteString("  \n")
+		case "p", "div":
+			children(buf, n, listPrefix)
+			buf.WriteString("\n\n")
+		case "h1", "h2", "h3", "h4", "h5", "h6":
+			buf.WriteString("\n" + strings.Repeat("#", int(n.Data[1]-'0')) + " ")
+			children(buf, n, listPrefix)
+			buf.WriteString("\n\n")
+		case "strong", "b":
+			buf.WriteString("**")
+			children(buf, n, listPrefix)
+			buf.WriteString("**")
+		case "em", "i":
+			buf.WriteString("_")
+			children(buf, n, listPrefix)
+			buf.WriteString("_")
+		case "code":
+			buf.WriteString("`")
+			children(buf, n, listPrefix)
+			buf.WriteString("`")
+		case "pre":
+			buf.WriteString("\n```\n" + strings.TrimSpace(nodeText(n)) + "\n```\n\n")
+		case "blockquote":
+			var inner strings.Builder
+			children(&inner, n, listPrefix)
+			for _, line := range strings.Split(strings.TrimSpace(inner.String()), "\n") {
+				buf.WriteString(strings.TrimSpace("> "+line) + "\n")
+			}
+			buf.WriteString("\n")
+		case "ul", "ol":
+			for i, c := 1, n.FirstChild; c != nil; c = c.NextSibling {
+				if c.Type != html.ElementNode || c.Data != "li" {
+					continue
+				}
+				marker := "- "
+				if n.Data == "ol" {
+					marker = fmt.Sprintf("%d. ", i)
+				}
+				buf.WriteString(listPrefix + marker)
+				children(buf, c, listPrefix+"  ")
+				buf.WriteString("\n")
+				i++
+			}
+			buf.WriteString("\n")
+		case "a":
+			buf.WriteString("[")
+			children(buf, n, listPrefix)
+			buf.WriteString("](" + attr(n, "href") + ")")
+		case "img":
+			src := attr(n, "src")
+			if cid, ok := strings.CutPrefix(src, "cid:"); ok {
+				src = cids[cid]
+			}
+			buf.WriteString("![" + attr(n, "alt") + "](" + src + ")")
+		default:
+			children(buf, n, listPrefix)
+		}
+	}
+	var buf strings.Builder
+	walk(&buf, doc, "")
+	out := blankLinesRe.ReplaceAllString(buf.String(), "\n\n")
+	return strings.TrimSpace(out), nil
+}
+
+func attr(n *html.Node, key string) string {
+	for _, a := range n.Attr {
+		if a.Key == key {
+			return a.Val
+		}
+	}
+	return ""
+}
+
+func nodeText(n *html.Node) string {
+	if n.Type == html.TextNode {
+		return n.Data
+	}
+	var sb strings.Builder
+	for c := n.FirstChild; c != nil; c = c.NextSibling {
+		sb.WriteString(nodeText(c))
+	}
+	return sb.String()
+}
+
+var nonSlugRe = regexp.MustCompile(`[^a-z0-9]+`)
+
+func slugify(s string) string {
+	return strings.Trim(nonSlugRe.ReplaceAllString(strings.ToLower(s), "-"), "-")
+}
+
+// tomlString quotes s as a TOML basic string.
+func tomlString(s string) string {
+	var sb strings.Builder
+	sb.WriteByte('"')
+	for _, r := range s {
+		switch {
+		case r == '"' || r == '\\':
+			sb.WriteByte('\\')
+			sb.WriteRune(r)
+		case r < 0x20 || r == 0x7f:
+			fmt.Fprintf(&sb, "\\u%04X", r)
+		default:
+			sb.WriteRune(r)
+		}
+	}
+	sb.WriteByte('"')
+	return sb.String()
+}
@@ -1,13 +1,19 @@
 package main
 
 import (
-	"bytes"
+	"context"
+	"flag"
+	"fmt"
 	"html/template"
 	"io"
 	"log"
 	"net/http"
 	"os"
+	"path/filepath"
+	"slices"
+	"sort"
 	"strings"
+	"time"
 
 	"github.com/adrg/frontmatter"
 	"github.com/yuin/goldmark"
@@ -15,11 +21,208 @@ import (
 )
 
 func main() {
+	configPath := flag.String("config", "jonblog.toml", "path to the config file")
+	flag.Usage = func() {
+		fmt.Fprintln(flag.CommandLine.Output(), "Usage: jonblog [flags] [check [slug...] | export [-o dir] [slug...] | build [-o dir] | rollback [-o dir] [release] | invalidate]")
+		flag.PrintDefaults()
+	}
+	flag.Parse()
+
+	switch flag.Arg(0) {
+	case "", "export", "build", "rollback", "invalidate":
+	case "check":
+		if runCheck(os.Stdout, FileReader{}, flag.Args()[1:]) > 0 {
+			os.Exit(1)
+		}
+		return
+	default:
+		flag.Usage()
+		os.Exit(2)
+	}
+
+	cfg, err := LoadConfig(*configPath)
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	if flag.Arg(0) == "rollback" {
+		err = runRollback(os.Stdout, cfg.Static, flag.Args()[1:])
+		if err != nil {
+			log.Fatal(err)
+		}
+		return
+	}
+
+	// Built in shortcodes are registered before plugins, which may not
+	// replace them.
+	polls, err := NewPollStore(filepath.Join(cfg.DataDir, "polls.json"), cfg.Secret)
+	if err != nil {
+		log.Fatal(err)
+	}
+	shortcodes[pollShortcode] = polls.shortcode()
+	embeds := NewEmbedCache(cfg)
+	embeds.register()
+
+	err = LoadPlugins(cfg.Plugins)
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	if flag.Arg(0) == "export" {
+		err = runExport(os.Stdout, FileReader{}, cfg.BaseURL, flag.Args()[1:])
+		if err != nil {
+			log.Fatal(err)
+		}
+		return
+	}
+	if flag.Arg(0) == "build" {
+		err = runBuild(os.Stdout, cfg, flag.Args()[1:])
+		if err != nil {
+			log.Fatal(err)
+		}
+		return
+	}
+
+	// Replicas sign the versions they send each other, which only works if
+	// they share a secret.
+	if cfg.randomSecret && len(cfg.Replicas.Peers) > 0 {
+		log.Fatal("replicas: peers need a secret set in the config, the same on every replica")
+	}
+
+	coord, err := NewCoordinator(cfg.Replicas, cfg.Secret)
+	if err != nil {
+		log.Fatal(err)
+	}
+	// Run after deploying content so every replica drops what it rendered
+	// from the old content.
+	if flag.Arg(0) == "invalidate" {
+		if _, ok := coord.(localCoordinator); ok {
+			log.Fatal("replicas: set dir or peers in the config to invalidate")
+		}
+		err = coord.Publish(newVersion())
+		if err != nil {
+			log.Fatal(err)
+		}
+		return
+	}
+
+	reactions, err := NewReactionStore(filepath.Join(cfg.DataDir, "reactions.json"), cfg.Reactions, cfg.Secret)
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	corrections, err := NewCorrectionStore(filepath.Join(cfg.DataDir, "corrections.json"))
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	accounts, err := NewAccountStore(filepath.Join(cfg.DataDir, "accounts.json"), cfg)
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	bots, err := NewBotFilter(cfg.Bots)
+	if err != nil {
+		log.Fatal(err)
+	}
+	trustedProxies, err = parsePrefixes(cfg.TrustedProxies)
+	if err != nil {
+		log.Fatalf("trusted_proxies: %v", err)
+	}
+
+	replica := NewReplica(coord)
+
 	mux := http.NewServeMux()
 
-	mux.HandleFunc("GET /posts/{slug}", PostHandler(FileReader{}))
+	mux.HandleFunc("GET /readyz", replica.ReadyHandler())
+	if pc, ok := coord.(*peerCoordinator); ok {
+		mux.HandleFunc("POST /replicas/version", pc.Handler())
+	}
+
+	mux.Handle("GET /posts/{slug}", accounts.TrackReading(PostHandler(FileReader{}, cfg.BaseURL, reactions, replica)))
+	mux.HandleFunc("POST /posts/{slug}/reactions", ReactHandler(FileReader{}, reactions))
+	mux.HandleFunc("GET /posts/{slug}/paragraphs/{n}", ParagraphHandler(FileReader{}))
+	mux.HandleFunc("POST /posts/{slug}/corrections", CorrectionHandler(FileReader{}, corrections))
+	mux.HandleFunc("POST /posts/{slug}/polls/{poll}", VoteHandler(FileReader{}, polls))
+	mux.HandleFunc("GET /posts/{slug}/slides", SlidesHandler(FileReader{}, "slides.gohtml"))
+	mux.HandleFunc("GET /posts/{slug}/handout", SlidesHandler(FileReader{}, "handout.gohtml"))
+	mux.HandleFunc("GET /posts/{slug}/code/{name...}", CodeHandler(FileReader{}))
+	mux.HandleFunc("GET /posts/{slug}/examples.zip", ExamplesHandler(FileReader{}))
+	mux.HandleFunc("GET /posts/{slug}/card", CardHandler(FileReader{}, cfg.MediaDir))
+	mux.HandleFunc("GET /posts/{slug}/mf2.json", PostMF2Handler(FileReader{}, cfg.BaseURL))
+	mux.HandleFunc("GET /oembed", OEmbedHandler(FileReader{}, cfg.MediaDir, cfg.BaseURL))
+	mux.Handle("GET /drafts/{slug}", RequireSignature(cfg.Secret, "draft:", PostHandler(FileReader{Dir: cfg.DraftsDir}, cfg.BaseURL, nil, nil)))
+	mux.HandleFunc("GET /docs/{path...}", DocsHandler(DocsReader{}))
+	mux.HandleFunc("GET /account", AccountHandler(FileReader{}, accounts))
+	mux.HandleFunc("POST /account/login", LoginHandler(accounts))
+	mux.HandleFunc("GET /account/verify", VerifyHandler(accounts))
+	mux.HandleFunc("POST /account/logout", LogoutHandler(accounts))
+	mux.HandleFunc("POST /account/bookmarks", BookmarkHandler(FileReader{}, accounts))
+	mux.HandleFunc("POST /account/tags", FollowTagHandler(accounts))
+	mux.HandleFunc("GET /account/export", ExportHandler(accounts))
+	mux.HandleFunc("POST /account/delete", DeleteAccountHandler(accounts))
+	mux.HandleFunc("GET /embeds/facade.js", FacadeScriptHandler())
+	mux.HandleFunc("GET /embeds/youtube/{sig}/{file}", embeds.YouTubeThumbHandler())
+	mux.HandleFunc("GET /embeds/tiles/{sig}/{z}/{x}/{file}", embeds.TileHandler())
+	albums := AlbumReader{Dir: cfg.AlbumsDir}
+	images := ImageCache{Dir: filepath.Join(cfg.CacheDir, "images")}
+	mux.HandleFunc("GET /albums", AlbumsHandler(albums))
+	mux.HandleFunc("GET /albums/feed.xml", AlbumsFeedHandler(albums, cfg.BaseURL))
+	mux.HandleFunc("GET /albums/mf2.json", AlbumsMF2Handler(albums, cfg.BaseURL))
+	mux.HandleFunc("GET /albums/{album}", AlbumHandler(albums))
+	mux.HandleFunc("GET /albums/{album}/mf2.json", AlbumMF2Handler(albums, cfg.BaseURL))
+	mux.HandleFunc("GET /albums/{album}/photos/{photo}", PhotoHandler(albums))
+	mux.HandleFunc("GET /albums/{album}/images/{photo}", PhotoImageHandler(albums, images, photoSize))
+	mux.HandleFunc("GET /albums/{album}/thumbs/{photo}", PhotoImageHandler(albums, images, thumbSize))
+	mux.Handle("GET /media/", http.StripPrefix("/media/", http.FileServer(http.Dir(cfg.MediaDir))))
+
+	var icons *IconSet
+	if cfg.Icons.Source != "" {
+		icons, err = NewIconSet(cfg.Icons)
+		if err != nil {
+			log.Fatal(err)
+		}
+		for _, name := range icons.Names() {
+			mux.Handle("GET /"+name, icons.Handler())
+		}
+		iconLinks = iconLinksHTML
+	}
+
+	if cfg.Admin.Password != "" {
+		admin := func(h http.HandlerFunc) http.Handler {
+			return RequireAdmin(cfg.Admin, h)
+		}
+		mux.Handle("GET /admin/corrections", admin(AdminCorrectionsHandler(corrections)))
+		mux.Handle("POST /admin/corrections/{id}/apply", admin(replica.Invalidates(AdminResolveCorrectionHandler(FileReader{}, corrections, CorrectionApplied))))
+		mux.Handle("POST /admin/corrections/{id}/reject", admin(AdminResolveCorrectionHandler(FileReader{}, corrections, CorrectionRejected)))
+		mux.Handle("GET /admin/metrics", admin(bots.MetricsHandler()))
+		mux.Handle("GET /admin/polls.csv", admin(AdminPollsCSVHandler(polls)))
+		if cfg.Previews.Repo != "" {
+			previews, err := NewPreviewManager(cfg)
+			if err != nil {
+				log.Fatal(err)
+			}
+			previews.Icons = icons
+			mux.Handle("GET /preview/{ref}/{rest...}", admin(previews.Handler()))
+		}
+	}
+
+	if cfg.SMTP.Addr != "" {
+		smtpServer := SMTPServer{
+			Addr:    cfg.SMTP.Addr,
+			Deliver: DraftIngester{Config: cfg}.Deliver,
+		}
+		go func() {
+			log.Fatal(smtpServer.ListenAndServe())
+		}()
+	}
 
-	err := http.ListenAndServe(":3030", mux)
+	var handler http.Handler = bots.Middleware(mux)
+	if cfg.Dev {
+		log.Printf("config: dev mode, private blocks are shown")
+		handler = DevMode(handler)
+	}
+	err = http.ListenAndServe(cfg.Addr, handler)
 	if err != nil {
 		log.Fatal(err)
 	}
@@ -29,10 +232,18 @@ type SlugReader interface {
 	Read(slug string) (string, error)
 }
 
-type FileReader struct{}
+type FileReader struct {
+	// Dir is the directory posts are read from. The zero value reads from the
+	// current directory.
+	Dir string
+}
 
 func (fsr FileReader) Read(slug string) (string, error) {
-	f, err := os.Open(slug + ".md")
+	path, err := fsr.path(slug)
+	if err != nil {
+		return "", err
+	}
+	f, err := os.Open(path)
 	if err != nil {
 		return "", err
 	}
@@ -44,50 +255,227 @@ func (fsr FileReader) Read(slug string) (string, error) {
 	return string(b), nil
 }
 
-func PostHandler(sl SlugReader) http.HandlerFunc {
+// List returns the slug of every post in Dir and its sections.
+func (fsr FileReader) List() ([]string, error) {
+	files, err := fsr.files()
+	if err != nil {
+		return nil, err
+	}
+	slugs := make([]string, 0, len(files))
+	for slug := range files {
+		slugs = append(slugs, slug)
+	}
+	sort.Strings(slugs)
+	return slugs, nil
+}
+
+// Write replaces the markdown of an existing post.
+func (fsr FileReader) Write(slug, postMarkdown string) error {
+	path, err := fsr.path(slug)
+	if err != nil {
+		return err
+	}
+	tmp := path + ".tmp"
+	err = os.WriteFile(tmp, []byte(postMarkdown), 0644)
+	if err != nil {
+		return err
+	}
+	return os.Rename(tmp, path)
+}
+
+// PostHandler renders a post. reactions may be nil, in which case reactions
+// are not shown, and replica may be nil, in which case renders are not
+// cached.
+func PostHandler(sl SlugReader, baseURL string, reactions *ReactionStore, replica *Replica) http.HandlerFunc {
 	return func(w http.ResponseWriter, r *http.Request) {
-		var post Post
-		post.Slug = r.PathValue("slug")
-		postMarkdown, err := sl.Read(post.Slug)
+		slug := r.PathValue("slug")
+		postMarkdown, err := sl.Read(slug)
 		if err != nil {
 			// TODO: Handle different errors in the future
 			http.Error(w, "Post not found", http.StatusNotFound)
 			return
 		}
-		rest, err := frontmatter.Parse(strings.NewReader(postMarkdown), &post)
+		post, rest, err := parsePost(sl, slug, postMarkdown)
 		if err != nil {
 			http.Error(w, "Error parsing frontmatter", http.StatusInternalServerError)
 			return
 		}
-		mdRenderer := goldmark.New(
-			goldmark.WithExtensions(
-				highlighting.NewHighlighting(
-					highlighting.WithStyle("dracula"),
-				),
-			),
-		)
-		var buf bytes.Buffer
-		err = mdRenderer.Convert(rest, &buf)
+		if post.Visibility == VisibilityPrivate && !isPreview(r) {
+			http.Error(w, "Post not found", http.StatusNotFound)
+			return
+		}
+		rc := &RenderContext{Slug: slug, Style: post.HighlightStyle, Request: r}
+		post.Content, err = replica.renderMarkdown(rc, rest)
 		if err != nil {
 			http.Error(w, "Error converting markdown", http.StatusInternalServerError)
 			return
 		}
 		// TODO: Parse the template once, not every page load.
-		tpl, err := template.ParseFiles("post.gohtml")
+		tpl, err := parseTemplate(post.layout())
 		if err != nil {
 			http.Error(w, "Error parsing template", http.StatusInternalServerError)
 			return
 		}
-		post.Content = template.HTML(buf.String())
+		for _, block := range codeBlocks(rest) {
+			name := cleanFilename(block.Filename)
+			if name != "" && !slices.Contains(post.Files, name) {
+				post.Files = append(post.Files, name)
+			}
+		}
+		if reactions != nil {
+			post.Reactions = reactions.Counts(slug)
+		}
+		post.Paragraphs = paragraphs(postMarkdown, rest)
+		// Previews aren't public, so they don't advertise a URL to embed.
+		if !isPreview(r) {
+			post.URL = strings.TrimSuffix(baseURL, "/") + "/posts/" + slug
+		}
+		w.Header().Set("Content-Security-Policy", rc.ContentSecurityPolicy())
 		err = tpl.Execute(w, post)
 	}
 }
 
+// listPosts returns every published post, newest first. Content is not
+// rendered.
+func listPosts(fsr FileReader) ([]Post, error) {
+	slugs, err := fsr.List()
+	if err != nil {
+		return nil, err
+	}
+	var posts []Post
+	for _, slug := range slugs {
+		postMarkdown, err := fsr.Read(slug)
+		if err != nil {
+			return nil, err
+		}
+		post, _, err := parsePost(fsr, slug, postMarkdown)
+		if err != nil {
+			return nil, fmt.Errorf("%s: %w", slug, err)
+		}
+		if post.Draft || (post.Visibility != "" && post.Visibility != VisibilityPublic) {
+			continue
+		}
+		posts = append(posts, post)
+	}
+	sort.SliceStable(posts, func(i, j int) bool {
+		return posts[i].Date.After(posts[j].Date)
+	})
+	return posts, nil
+}
+
+// parsePost parses the frontmatter of a post, returning the post along with
+// the remaining markdown. Section defaults are applied first when sl supports
+// them, so the post's own frontmatter takes precedence.
+func parsePost(sl SlugReader, slug, postMarkdown string) (Post, []byte, error) {
+	var post Post
+	if sr, ok := sl.(SectionReader); ok {
+		defaults, err := sr.Defaults(slug)
+		if err != nil {
+			return post, nil, err
+		}
+		for _, d := range defaults {
+			_, err = frontmatter.Parse(strings.NewReader(d.Frontmatter), &post)
+			if err != nil {
+				return post, nil, fmt.Errorf("%s: %w", d.Path, err)
+			}
+		}
+	}
+	post.Slug = slug
+	rest, err := frontmatter.Parse(strings.NewReader(postMarkdown), &post)
+	if err != nil {
+		return post, nil, err
+	}
+	return post, rest, nil
+}
+
+// newMarkdown returns the markdown renderer used for everything we render, so
+// that code highlighting looks the same everywhere. An empty style uses the
+// default.
+func newMarkdown(style string) goldmark.Markdown {
+	if style == "" {
+		style = defaultHighlightStyle
+	}
+	return goldmark.New(
+		goldmark.WithExtensions(
+			highlighting.NewHighlighting(
+				highlighting.WithStyle(style),
+			),
+		),
+	)
+}
+
+// RequireSignature only lets requests through when the sig query parameter is
+// a valid signature of prefix + the slug path value.
+func RequireSignature(secret, prefix string, next http.Handler) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if !verify(secret, prefix+r.PathValue("slug"), r.URL.Query().Get("sig")) {
+			http.Error(w, "Post not found", http.StatusNotFound)
+			return
+		}
+		next.ServeHTTP(w, r.WithContext(context.WithValue(r.Context(), previewKey{}, true)))
+	}
+}
+
 type Post struct {
-	Title   string `toml:"title"`
-	Slug    string `toml:"slug"`
-	Content template.HTML
-	Author  Author `toml:"author"`
+	Title       string    `toml:"title"`
+	Slug        string    `toml:"slug"`
+	Description string    `toml:"description"`
+	Date        time.Time `toml:"date"`
+	Tags        []string  `toml:"tags"`
+	Content     template.HTML
+	Author      Author `toml:"author"`
+	Draft       bool   `toml:"draft"`
+	Slides      bool   `toml:"slides"`
+	// Layout is the template used to render the post.
+	Layout         string `toml:"layout"`
+	Series         string `toml:"series"`
+	HighlightStyle string `toml:"highlight_style"`
+	// Visibility is "public", "unlisted" (not listed anywhere, but reachable
+	// by URL) or "private" (only viewable via a signed preview link).
+	Visibility string `toml:"visibility"`
+	// Type is "docs" for pages in a docs section. It is usually set by the
+	// section's index file.
+	Type string `toml:"type"`
+	// Weight orders docs pages in the sidebar, lightest first.
+	Weight int `toml:"weight"`
+	// Files lists the filenames of code blocks that can be downloaded.
+	Files      []string        `toml:"-"`
+	Reactions  []ReactionCount `toml:"-"`
+	Paragraphs []Paragraph     `toml:"-"`
+	// URL is the post's public address, used for oEmbed discovery.
+	URL string `toml:"-"`
+}
+
+const (
+	VisibilityPublic   = "public"
+	VisibilityUnlisted = "unlisted"
+	VisibilityPrivate  = "private"
+)
+
+const (
+	defaultLayout         = "post.gohtml"
+	docsLayout            = "docs.gohtml"
+	defaultHighlightStyle = "dracula"
+)
+
+// layout returns the template file for the post. Only plain .gohtml file
+// names in the current directory are allowed.
+func (p Post) layout() string {
+	if p.Layout == "" && p.Type == docsType {
+		return docsLayout
+	}
+	if p.Layout == "" || !validSlug(p.Layout) || filepath.Ext(p.Layout) != ".gohtml" {
+		return defaultLayout
+	}
+	return p.Layout
+}
+
+type previewKey struct{}
+
+// isPreview reports whether the request came through a signed preview link.
+func isPreview(r *http.Request) bool {
+	preview, _ := r.Context().Value(previewKey{}).(bool)
+	return preview
 }
 
 type Author struct {
@@ -0,0 +1,175 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"strings"
+	"time"
+
+	"golang.org/x/net/html"
+)
+
+// Pages are marked up with microformats2 (https://microformats.org/wiki/mf2)
+// so IndieWeb readers can follow and quote them. The same data is available
+// as mf2 JSON, in the form an mf2 parser would produce from the page.
+type mf2Item struct {
+	Type       []string         `json:"type"`
+	Properties map[string][]any `json:"properties"`
+	Children   []mf2Item        `json:"children,omitempty"`
+	// Value is the plain text of an item that is itself a property, such as
+	// the author of an entry.
+	Value string `json:"value,omitempty"`
+}
+
+type mf2Content struct {
+	HTML  string `json:"html"`
+	Value string `json:"value"`
+}
+
+type mf2Doc struct {
+	Items   []mf2Item           `json:"items"`
+	Rels    map[string][]string `json:"rels"`
+	RelURLs map[string]any      `json:"rel-urls"`
+}
+
+func newMF2(typ string) mf2Item {
+	return mf2Item{Type: []string{typ}, Properties: make(map[string][]any)}
+}
+
+// set adds a property, skipping empty values so the JSON matches what a
+// parser finds in the page.
+func (item mf2Item) set(name string, values ...any) {
+	for _, v := range values {
+		switch v := v.(type) {
+		case string:
+			if v == "" {
+				continue
+			}
+		case time.Time:
+			if v.IsZero() {
+				continue
+			}
+			item.Properties[name] = append(item.Properties[name], v.Format(time.RFC3339))
+			continue
+		}
+		item.Properties[name] = append(item.Properties[name], v)
+	}
+}
+
+func writeMF2(w http.ResponseWriter, items ...mf2Item) {
+	w.Header().Set("Content-Type", "application/mf2+json")
+	enc := json.NewEncoder(w)
+	enc.SetIndent("", "  ")
+	enc.Encode(mf2Doc{Items: items, Rels: map[string][]string{}, RelURLs: map[string]any{}})
+}
+
+func htmlText(s string) string {
+	doc, err := html.Parse(strings.NewReader(s))
+	if err != nil {
+		return ""
+	}
+	return strings.TrimSpace(nodeText(doc))
+}
+
+// PostMF2Handler serves /posts/{slug}/mf2.json.
+func PostMF2Handler(fsr FileReader, baseURL string) http.HandlerFunc {
+	base := strings.TrimSuffix(baseURL, "/")
+	return func(w http.ResponseWriter, r *http.Request) {
+		slug := r.PathValue("slug")
+		postMarkdown, err := fsr.Read(slug)
+		if err != nil {
+			http.Error(w, "Post not found", http.StatusNotFound)
+			return
+		}
+		post, rest, err := parsePost(fsr, slug, postMarkdown)
+		if err != nil {
+			http.Error(w, "Error parsing frontmatter", http.StatusInternalServerError)
+			return
+		}
+		if post.Visibility == VisibilityPrivate {
+			http.Error(w, "Post not found", http.StatusNotFound)
+			return
+		}
+		content, err := renderMarkdown(&RenderContext{Slug: slug, Style: post.HighlightStyle, Request: r}, rest)
+		if err != nil {
+			http.Error(w, "Error converting markdown", http.StatusInternalServerError)
+			return
+		}
+
+		entry := newMF2("h-entry")
+		entry.set("name", post.Title)
+		entry.set("published", post.Date)
+		entry.set("url", base+"/posts/"+slug)
+		for _, tag := range post.Tags {
+			entry.set("category", tag)
+		}
+		if post.Author.Name != "" {
+			author := newMF2("h-card")
+			author.Value = post.Author.Name
+			author.set("name", post.Author.Name)
+			if post.Author.Email != "" {
+				author.set("email", "mailto:"+post.Author.Email)
+			}
+			entry.set("author", author)
+		}
+		entry.set("content", mf2Content{HTML: strings.TrimSpace(string(content)), Value: htmlText(string(content))})
+		writeMF2(w, entry)
+	}
+}
+
+func albumEntry(a Album, base string) mf2Item {
+	entry := newMF2("h-entry")
+	entry.set("name", a.Title)
+	entry.set("published", a.Date)
+	entry.set("url", base+"/albums/"+a.Name)
+	if cover := a.Cover(); cover != nil {
+		entry.set("photo", base+cover.ThumbURL())
+	}
+	return entry
+}
+
+// AlbumsMF2Handler serves /albums/mf2.json, an h-feed of every album.
+func AlbumsMF2Handler(ar AlbumReader, baseURL string) http.HandlerFunc {
+	base := strings.TrimSuffix(baseURL, "/")
+	return func(w http.ResponseWriter, r *http.Request) {
+		albums, err := ar.List()
+		if err != nil {
+			http.Error(w, "Error reading albums", http.StatusInternalServerError)
+			return
+		}
+		feed := newMF2("h-feed")
+		feed.set("name", "Albums")
+		for _, a := range albums {
+			feed.Children = append(feed.Children, albumEntry(a, base))
+		}
+		writeMF2(w, feed)
+	}
+}
+
+// AlbumMF2Handler serves /albums/{album}/mf2.json, an h-feed of the photos in
+// an album.
+func AlbumMF2Handler(ar AlbumReader, baseURL string) http.HandlerFunc {
+	base := strings.TrimSuffix(baseURL, "/")
+	return func(w http.ResponseWriter, r *http.Request) {
+		album, err := ar.Read(r.PathValue("album"))
+		if err != nil {
+			http.Error(w, "Album not found", http.StatusNotFound)
+			return
+		}
+		feed := newMF2("h-feed")
+		feed.set("name", album.Title)
+		feed.set("summary", album.Description)
+		for _, p := range album.Photos {
+			entry := newMF2("h-entry")
+			entry.set("name", p.Caption)
+			if !p.EXIF.Taken.IsZero() {
+				// EXIF times have no zone.
+				entry.set("published", p.EXIF.Taken.Format("2006-01-02T15:04:05"))
+			}
+			entry.set("url", base+p.URL())
+			entry.set("photo", base+p.ImageURL())
+			feed.Children = append(feed.Children, entry)
+		}
+		writeMF2(w, feed)
+	}
+}
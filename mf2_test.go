@@ -0,0 +1,305 @@
+package main
+
+import (
+	"encoding/binary"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"reflect"
+	"slices"
+	"strings"
+	"testing"
+
+	"golang.org/x/net/html"
+)
+
+// serve returns the body of a GET for target, registered on a mux as
+// pattern.
+func serve(t *testing.T, pattern, target string, h http.Handler) string {
+	t.Helper()
+	mux := http.NewServeMux()
+	mux.Handle(pattern, h)
+	rec := httptest.NewRecorder()
+	mux.ServeHTTP(rec, httptest.NewRequest(http.MethodGet, target, nil))
+	if rec.Code != http.StatusOK {
+		t.Fatalf("GET %s: status %d: %s", target, rec.Code, rec.Body)
+	}
+	return rec.Body.String()
+}
+
+func writeFiles(t *testing.T, dir string, files map[string]string) {
+	t.Helper()
+	for name, data := range files {
+		path := filepath.Join(dir, name)
+		err := os.MkdirAll(filepath.Dir(path), 0755)
+		if err != nil {
+			t.Fatal(err)
+		}
+		err = os.WriteFile(path, []byte(data), 0644)
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+}
+
+// mf2Want is what a page should have for some microformats classes.
+type mf2Want struct {
+	// classes are the classes an element must have, separated by spaces.
+	classes string
+	// attr is the attribute holding the value, "" for the element's text or
+	// "*" for its tag, which is enough for items.
+	attr string
+	// values are those of every element with the classes, in page order.
+	values []string
+}
+
+// assertMF2 checks the elements of page with the classes of each of wants.
+func assertMF2(t *testing.T, page string, wants []mf2Want) {
+	t.Helper()
+	doc, err := html.Parse(strings.NewReader(page))
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, want := range wants {
+		var values []string
+		var walk func(n *html.Node)
+		walk = func(n *html.Node) {
+			if n.Type == html.ElementNode && hasClasses(n, want.classes) {
+				switch want.attr {
+				case "":
+					values = append(values, strings.Join(strings.Fields(nodeText(n)), " "))
+				case "*":
+					values = append(values, n.Data)
+				default:
+					values = append(values, attr(n, want.attr))
+				}
+			}
+			for c := n.FirstChild; c != nil; c = c.NextSibling {
+				walk(c)
+			}
+		}
+		walk(doc)
+		if !slices.Equal(values, want.values) {
+			t.Errorf("class %q %s = %q, want %q", want.classes, orText(want.attr), values, want.values)
+		}
+	}
+}
+
+func hasClasses(n *html.Node, classes string) bool {
+	have := strings.Fields(attr(n, "class"))
+	for _, c := range strings.Fields(classes) {
+		if !slices.Contains(have, c) {
+			return false
+		}
+	}
+	return true
+}
+
+func orText(attr string) string {
+	switch attr {
+	case "":
+		return "text"
+	case "*":
+		return "tag"
+	}
+	return attr
+}
+
+func TestPostMF2(t *testing.T) {
+	dir := t.TempDir()
+	writeFiles(t, dir, map[string]string{
+		"dated.md": `+++
+title = "A dated post"
+date = 2024-03-01T10:00:00Z
+tags = ["go", "web"]
+[author]
+name = "Jon Calhoun"
+email = "jon@example.com"
++++
+Some *markdown* with [a link](/posts/undated).
+
+And a second paragraph.
+`,
+		"undated.md": `+++
+title = "An undated post"
+[author]
+name = "Jon Calhoun"
++++
+Just text.
+`,
+		"anonymous.md": `+++
+title = "Nobody wrote this"
+date = 2024-03-02T10:00:00+02:00
++++
+Text.
+`,
+	})
+	fsr := FileReader{Dir: dir}
+	tests := []struct {
+		slug  string
+		wants []mf2Want
+	}{
+		{
+			slug: "dated",
+			wants: []mf2Want{
+				{"h-entry", "*", []string{"div"}},
+				{"p-name", "", []string{"A dated post", "Jon Calhoun"}},
+				{"u-url", "href", []string{"/posts/dated"}},
+				{"dt-published", "datetime", []string{"2024-03-01T10:00:00Z"}},
+				{"p-category", "", []string{"go", "web"}},
+				{"p-author h-card", "", []string{"Jon Calhoun"}},
+				{"u-email", "href", []string{"mailto:jon@example.com"}},
+				{"e-content", "", []string{"Some markdown with a link. And a second paragraph."}},
+			},
+		},
+		{
+			slug: "undated",
+			wants: []mf2Want{
+				{"h-entry", "*", []string{"div"}},
+				{"p-name", "", []string{"An undated post", "Jon Calhoun"}},
+				{"u-url", "value", []string{"/posts/undated"}},
+				{"dt-published", "datetime", nil},
+				{"p-author h-card", "", []string{"Jon Calhoun"}},
+				{"u-email", "href", nil},
+				{"e-content", "", []string{"Just text."}},
+			},
+		},
+		{
+			slug: "anonymous",
+			wants: []mf2Want{
+				{"h-entry", "*", []string{"div"}},
+				{"p-name", "", []string{"Nobody wrote this"}},
+				{"u-url", "href", []string{"/posts/anonymous"}},
+				{"dt-published", "datetime", []string{"2024-03-02T10:00:00+02:00"}},
+				{"p-author", "", nil},
+				{"h-card", "*", nil},
+			},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.slug, func(t *testing.T) {
+			page := serve(t, "GET /posts/{slug}", "/posts/"+tt.slug, PostHandler(fsr, "https://example.com", nil, nil))
+			assertMF2(t, page, tt.wants)
+		})
+	}
+}
+
+func TestPostMF2JSON(t *testing.T) {
+	dir := t.TempDir()
+	writeFiles(t, dir, map[string]string{"dated.md": `+++
+title = "A dated post"
+date = 2024-03-01T10:00:00Z
+tags = ["go", "web"]
+[author]
+name = "Jon Calhoun"
+email = "jon@example.com"
++++
+Some *markdown*.
+`})
+	doc := serve(t, "GET /posts/{slug}/mf2.json", "/posts/dated/mf2.json", PostMF2Handler(FileReader{Dir: dir}, "https://example.com/"))
+	var got mf2Doc
+	err := json.Unmarshal([]byte(doc), &got)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(got.Items) != 1 {
+		t.Fatalf("mf2 JSON has %d items, want 1", len(got.Items))
+	}
+	entry := got.Items[0]
+	want := map[string][]any{
+		"name":      {"A dated post"},
+		"published": {"2024-03-01T10:00:00Z"},
+		"url":       {"https://example.com/posts/dated"},
+		"category":  {"go", "web"},
+		"author": {map[string]any{
+			"type":       []any{"h-card"},
+			"properties": map[string]any{"name": []any{"Jon Calhoun"}, "email": []any{"mailto:jon@example.com"}},
+			"value":      "Jon Calhoun",
+		}},
+		"content": {map[string]any{"html": "<p id=\"p-1\">Some <em>markdown</em>.</p>", "value": "Some markdown."}},
+	}
+	if !slices.Equal(entry.Type, []string{"h-entry"}) || !reflect.DeepEqual(entry.Properties, want) {
+		t.Errorf("mf2 JSON item = %+v, want h-entry with %+v", entry, want)
+	}
+}
+
+func TestAlbumMF2(t *testing.T) {
+	dir := t.TempDir()
+	le := binary.LittleEndian
+	taken := func(s string) string {
+		return string(jpegWithEXIF(buildTIFF(le,
+			[]tiffEntry{{tag: tagExifIFD, typ: 4, count: 1, ifd: 1}},
+			[]tiffEntry{asciiEntry(tagDateTimeOriginal, s)},
+		)))
+	}
+	writeFiles(t, dir, map[string]string{
+		"iceland/captions.toml": `title = "Iceland"
+description = "A week on the ring road."
+date = 2024-06-10T00:00:00Z
+[captions]
+"a.jpg" = "Skógafoss in the rain"
+`,
+		"iceland/a.jpg":  taken("2024:06:01 12:30:45"),
+		"iceland/b.jpg":  taken("2024:06:02 08:00:00"),
+		"iceland/c.jpg":  string(jpegWithEXIF(nil)),
+		"empty/notes.md": "Nothing here yet.",
+	})
+	ar := AlbumReader{Dir: dir}
+	tests := []struct {
+		name    string
+		pattern string
+		h       http.Handler
+		wants   []mf2Want
+	}{
+		{
+			name:    "albums",
+			pattern: "GET /albums",
+			h:       AlbumsHandler(ar),
+			wants: []mf2Want{
+				{"h-feed", "*", []string{"div"}},
+				{"h-entry", "href", []string{"/albums/iceland", "/albums/empty"}},
+				{"p-name", "", []string{"Albums", "Iceland", "empty"}},
+				{"u-url", "value", []string{"/albums/iceland", "/albums/empty"}},
+				{"u-photo", "value", []string{"/albums/iceland/thumbs/a.jpg"}},
+				{"dt-published", "datetime", []string{"2024-06-10T00:00:00Z"}},
+			},
+		},
+		{
+			name:    "iceland",
+			pattern: "GET /albums/{album}",
+			h:       AlbumHandler(ar),
+			wants: []mf2Want{
+				{"h-feed", "*", []string{"div"}},
+				{"h-entry", "href", []string{"/albums/iceland/photos/a.jpg", "/albums/iceland/photos/b.jpg", "/albums/iceland/photos/c.jpg"}},
+				{"p-name", "", []string{"Iceland", "Skógafoss in the rain"}},
+				{"p-summary", "", []string{"A week on the ring road."}},
+				{"dt-published", "datetime", []string{"2024-06-01T12:30:45", "2024-06-02T08:00:00"}},
+				{"u-photo", "value", []string{"/albums/iceland/images/a.jpg", "/albums/iceland/images/b.jpg", "/albums/iceland/images/c.jpg"}},
+				{"u-url", "value", []string{"/albums/iceland/photos/a.jpg", "/albums/iceland/photos/b.jpg", "/albums/iceland/photos/c.jpg"}},
+			},
+		},
+		{
+			name:    "empty",
+			pattern: "GET /albums/{album}",
+			h:       AlbumHandler(ar),
+			wants: []mf2Want{
+				{"h-feed", "*", []string{"div"}},
+				{"p-name", "", []string{"empty"}},
+				{"p-summary", "", nil},
+				{"h-entry", "*", nil},
+			},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			target := "/albums"
+			if tt.name != "albums" {
+				target += "/" + tt.name
+			}
+			page := serve(t, tt.pattern, target, tt.h)
+			assertMF2(t, page, tt.wants)
+		})
+	}
+}
@@ -0,0 +1,217 @@
+package main
+
+import (
+	"encoding/json"
+	"encoding/xml"
+	"fmt"
+	"html/template"
+	"image"
+	"net/http"
+	"net/url"
+	"os"
+	"path/filepath"
+	"regexp"
+	"strconv"
+	"strings"
+	"unicode/utf8"
+
+	"golang.org/x/net/html"
+)
+
+// Posts can be embedded by other sites and chat tools using oEmbed
+// (https://oembed.com). The embed is an iframe of the post's card, a small
+// page with the title, author, excerpt and thumbnail.
+const (
+	cardWidth     = 600
+	cardHeight    = 240
+	minCardWidth  = 280
+	minCardHeight = 120
+)
+
+// Card is the data passed to the card template.
+type Card struct {
+	Post
+	Excerpt string
+	// Thumbnail is the first image in the post, if it is in the media
+	// directory. Its size is needed for oEmbed responses.
+	Thumbnail       string
+	ThumbnailWidth  int
+	ThumbnailHeight int
+}
+
+var mediaImageRe = regexp.MustCompile(`!\[[^\]]*\]\((/media/[^)\s]+)`)
+
+// readCard reads the post at slug for use in a card. Private posts are not
+// found.
+func readCard(fsr FileReader, mediaDir, slug string) (Card, error) {
+	postMarkdown, err := fsr.Read(slug)
+	if err != nil {
+		return Card{}, err
+	}
+	post, rest, err := parsePost(fsr, slug, postMarkdown)
+	if err != nil {
+		return Card{}, err
+	}
+	if post.Visibility == VisibilityPrivate {
+		return Card{}, os.ErrNotExist
+	}
+	card := Card{Post: post, Excerpt: post.Description}
+	if card.Excerpt == "" {
+		if ps := paragraphs(postMarkdown, rest); len(ps) > 0 {
+			card.Excerpt = excerpt(ps[0].Source, 200)
+		}
+	}
+	if m := mediaImageRe.FindSubmatch(blankPrivate(rest)); m != nil {
+		name := filepath.FromSlash(strings.TrimPrefix(string(m[1]), "/media/"))
+		if filepath.IsLocal(name) {
+			cfg, err := imageConfig(filepath.Join(mediaDir, name))
+			if err == nil {
+				card.Thumbnail = string(m[1])
+				card.ThumbnailWidth, card.ThumbnailHeight = cfg.Width, cfg.Height
+			}
+		}
+	}
+	return card, nil
+}
+
+func imageConfig(path string) (image.Config, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return image.Config{}, err
+	}
+	defer f.Close()
+	cfg, _, err := image.DecodeConfig(f)
+	return cfg, err
+}
+
+// excerpt returns the plain text of a markdown paragraph, cut to at most n
+// characters.
+func excerpt(src string, n int) string {
+	rendered, err := renderFragment(&RenderContext{}, []byte(src))
+	if err != nil {
+		return ""
+	}
+	doc, err := html.Parse(strings.NewReader(string(rendered)))
+	if err != nil {
+		return ""
+	}
+	s := strings.Join(strings.Fields(nodeText(doc)), " ")
+	if utf8.RuneCountInString(s) <= n {
+		return s
+	}
+	r := []rune(s)[:n]
+	if i := strings.LastIndexByte(string(r), ' '); i > 0 {
+		return string(r)[:i] + "…"
+	}
+	return string(r) + "…"
+}
+
+// CardHandler serves /posts/{slug}/card, which is meant to be shown in an
+// iframe.
+func CardHandler(fsr FileReader, mediaDir string) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		card, err := readCard(fsr, mediaDir, r.PathValue("slug"))
+		if err != nil {
+			http.Error(w, "Post not found", http.StatusNotFound)
+			return
+		}
+		tpl, err := template.ParseFiles("card.gohtml")
+		if err != nil {
+			http.Error(w, "Error parsing template", http.StatusInternalServerError)
+			return
+		}
+		err = tpl.Execute(w, card)
+	}
+}
+
+type oEmbed struct {
+	XMLName         xml.Name `json:"-" xml:"oembed"`
+	Type            string   `json:"type" xml:"type"`
+	Version         string   `json:"version" xml:"version"`
+	Title           string   `json:"title" xml:"title"`
+	AuthorName      string   `json:"author_name,omitempty" xml:"author_name,omitempty"`
+	ProviderName    string   `json:"provider_name" xml:"provider_name"`
+	ProviderURL     string   `json:"provider_url" xml:"provider_url"`
+	CacheAge        int      `json:"cache_age" xml:"cache_age"`
+	ThumbnailURL    string   `json:"thumbnail_url,omitempty" xml:"thumbnail_url,omitempty"`
+	ThumbnailWidth  int      `json:"thumbnail_width,omitempty" xml:"thumbnail_width,omitempty"`
+	ThumbnailHeight int      `json:"thumbnail_height,omitempty" xml:"thumbnail_height,omitempty"`
+	HTML            string   `json:"html" xml:"html"`
+	Width           int      `json:"width" xml:"width"`
+	Height          int      `json:"height" xml:"height"`
+}
+
+// OEmbedHandler serves /oembed?url=...&format=json|xml. maxwidth and
+// maxheight are honoured down to the smallest card we can render. Only URLs
+// of posts under baseURL, which may include a path, are embedded.
+func OEmbedHandler(fsr FileReader, mediaDir, baseURL string) http.HandlerFunc {
+	base := strings.TrimSuffix(baseURL, "/")
+	baseU, err := url.Parse(base)
+	if err != nil {
+		baseU = &url.URL{}
+	}
+	return func(w http.ResponseWriter, r *http.Request) {
+		q := r.URL.Query()
+		format := q.Get("format")
+		if format == "" {
+			format = "json"
+		}
+		if format != "json" && format != "xml" {
+			http.Error(w, "Unsupported format", http.StatusNotImplemented)
+			return
+		}
+		u, err := url.Parse(q.Get("url"))
+		if err != nil || baseU.Host == "" || !strings.EqualFold(u.Scheme, baseU.Scheme) || !strings.EqualFold(u.Host, baseU.Host) {
+			http.Error(w, "Not found", http.StatusNotFound)
+			return
+		}
+		slug, ok := strings.CutPrefix(strings.TrimSuffix(u.Path, "/"), baseU.Path+"/posts/")
+		if !ok {
+			http.Error(w, "Not found", http.StatusNotFound)
+			return
+		}
+		width, height := cardWidth, cardHeight
+		if v, err := strconv.Atoi(q.Get("maxwidth")); err == nil {
+			width = min(width, v)
+		}
+		if v, err := strconv.Atoi(q.Get("maxheight")); err == nil {
+			height = min(height, v)
+		}
+		if width < minCardWidth || height < minCardHeight {
+			http.Error(w, "Not found", http.StatusNotFound)
+			return
+		}
+		card, err := readCard(fsr, mediaDir, slug)
+		if err != nil {
+			http.Error(w, "Not found", http.StatusNotFound)
+			return
+		}
+
+		src := base + "/posts/" + url.PathEscape(slug) + "/card"
+		resp := oEmbed{
+			Type:         "rich",
+			Version:      "1.0",
+			Title:        card.Title,
+			AuthorName:   card.Author.Name,
+			ProviderName: "Jon's Blog",
+			ProviderURL:  base + "/",
+			CacheAge:     86400,
+			HTML: fmt.Sprintf(`<iframe src="%s" width="%d" height="%d" title="%s" style="border:0;max-width:100%%" loading="lazy"></iframe>`,
+				template.HTMLEscapeString(src), width, height, template.HTMLEscapeString(card.Title)),
+			Width:  width,
+			Height: height,
+		}
+		if card.Thumbnail != "" {
+			resp.ThumbnailURL = base + card.Thumbnail
+			resp.ThumbnailWidth, resp.ThumbnailHeight = card.ThumbnailWidth, card.ThumbnailHeight
+		}
+		if format == "xml" {
+			w.Header().Set("Content-Type", "text/xml; charset=utf-8")
+			w.Write([]byte(xml.Header))
+			xml.NewEncoder(w).Encode(resp)
+			return
+		}
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(resp)
+	}
+}
@@ -0,0 +1,85 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"testing"
+)
+
+func TestOEmbedHandler(t *testing.T) {
+	dir := t.TempDir()
+	writeFiles(t, dir, map[string]string{
+		"hello.md": "+++\ntitle = \"Hello\"\ndate = 2024-03-01T10:00:00Z\n+++\nHi.\n",
+	})
+	fsr := FileReader{Dir: dir}
+	tests := []struct {
+		baseURL string
+		url     string
+		wantSrc string
+	}{
+		{"https://example.com", "https://example.com/posts/hello", "https://example.com/posts/hello/card"},
+		{"https://example.com/", "https://EXAMPLE.com/posts/hello/", "https://example.com/posts/hello/card"},
+		{"https://example.com/blog", "https://example.com/blog/posts/hello", "https://example.com/blog/posts/hello/card"},
+		{"https://example.com/blog/", "https://example.com/blog/posts/hello", "https://example.com/blog/posts/hello/card"},
+		{"https://example.com/blog", "https://example.com/posts/hello", ""},
+		{"https://example.com/blog", "https://example.com/blogposts/hello", ""},
+		{"https://example.com", "http://example.com/posts/hello", ""},
+		{"https://example.com", "https://example.org/posts/hello", ""},
+		{"https://example.com", "https://example.com/posts/missing", ""},
+	}
+	for _, tt := range tests {
+		t.Run(tt.baseURL+" "+tt.url, func(t *testing.T) {
+			rec := httptest.NewRecorder()
+			target := "/oembed?url=" + url.QueryEscape(tt.url)
+			OEmbedHandler(fsr, "", tt.baseURL).ServeHTTP(rec, httptest.NewRequest(http.MethodGet, target, nil))
+			if tt.wantSrc == "" {
+				if rec.Code != http.StatusNotFound {
+					t.Errorf("status = %d, want %d", rec.Code, http.StatusNotFound)
+				}
+				return
+			}
+			if rec.Code != http.StatusOK {
+				t.Fatalf("status = %d: %s", rec.Code, rec.Body)
+			}
+			var got oEmbed
+			err := json.Unmarshal(rec.Body.Bytes(), &got)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if !strings.Contains(got.HTML, `src="`+tt.wantSrc+`"`) {
+				t.Errorf("html = %s, want an iframe of %s", got.HTML, tt.wantSrc)
+			}
+		})
+	}
+}
+
+func TestCardHandlerDate(t *testing.T) {
+	dir := t.TempDir()
+	writeFiles(t, dir, map[string]string{
+		"dated.md":   "+++\ntitle = \"Dated\"\ndate = 2024-03-01T10:00:00Z\n[author]\nname = \"Jon\"\n+++\nHi.\n",
+		"undated.md": "+++\ntitle = \"Undated\"\n[author]\nname = \"Jon\"\n+++\nHi.\n",
+	})
+	fsr := FileReader{Dir: dir}
+	tests := []struct {
+		slug    string
+		want    string
+		notWant string
+	}{
+		{"dated", "Jon &middot; March 1, 2024", ""},
+		{"undated", "Jon", "0001"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.slug, func(t *testing.T) {
+			page := serve(t, "GET /posts/{slug}/card", "/posts/"+tt.slug+"/card", CardHandler(fsr, ""))
+			if !strings.Contains(page, tt.want) {
+				t.Errorf("card is missing %q", tt.want)
+			}
+			if tt.notWant != "" && (strings.Contains(page, tt.notWant) || strings.Contains(page, "&middot;")) {
+				t.Errorf("card shows a date for an undated post")
+			}
+		})
+	}
+}
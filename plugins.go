@@ -0,0 +1,285 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"html/template"
+	"io/fs"
+	"log"
+	"os"
+	"path/filepath"
+	"regexp"
+	"strings"
+	"time"
+
+	"github.com/tetratelabs/wazero"
+	"github.com/tetratelabs/wazero/api"
+	"github.com/tetratelabs/wazero/imports/wasi_snapshot_preview1"
+)
+
+// Plugins are WebAssembly modules in the plugins directory that add render
+// steps without changing the server. Each call gets a fresh instance of the
+// module, with no filesystem or network access, a memory limit and a time
+// limit.
+//
+// A plugin must export its memory and
+//
+//	alloc(size i32) -> i32
+//
+// which returns a buffer of size bytes for the host to write input to. It
+// may then export any of the hooks below. Each takes a pointer and length of
+// its input, and returns the pointer and length of its output packed into an
+// i64 as ptr<<32 | len.
+//
+//	pre_markdown  markdown of a page -> markdown
+//	post_html     HTML of a page -> HTML
+//	shortcode     JSON {"name", "args", "pos", "inner", "slug"} -> HTML
+//
+// A plugin providing shortcodes also exports shortcodes() -> i64, returning a
+// JSON list such as [{"name": "chart", "paired": true}]. Pre-processors should
+// keep lines where they are, since paragraphs are mapped back to the source
+// for corrections.
+//
+// The host provides two functions in the "jonblog" module, both taking a
+// pointer and length of a string: log(ptr, len) writes to the server log, and
+// fail(ptr, len) ends the current call with a message. WASI is available so
+// that modules built for it load, but without any files or environment.
+const (
+	hookPreMarkdown = "pre_markdown"
+	hookPostHTML    = "post_html"
+	hookShortcode   = "shortcode"
+)
+
+const (
+	defaultPluginMemoryMB  = 32
+	defaultPluginTimeoutMS = 500
+)
+
+// Plugin is a loaded WebAssembly module.
+type Plugin struct {
+	Name     string
+	runtime  wazero.Runtime
+	compiled wazero.CompiledModule
+	timeout  time.Duration
+}
+
+// plugins is every loaded plugin, in the order their hooks run.
+var plugins []*Plugin
+
+// pluginCall records a failure reported by the plugin through fail.
+type pluginCall struct {
+	err error
+}
+
+type pluginCallKey struct{}
+
+// LoadPlugins loads every .wasm file in cfg.Dir, in name order. Shortcodes
+// they provide are added to the registry.
+func LoadPlugins(cfg PluginConfig) error {
+	entries, err := os.ReadDir(cfg.Dir)
+	if errors.Is(err, fs.ErrNotExist) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	for _, entry := range entries {
+		if entry.IsDir() || filepath.Ext(entry.Name()) != ".wasm" {
+			continue
+		}
+		p, err := loadPlugin(filepath.Join(cfg.Dir, entry.Name()), cfg)
+		if err != nil {
+			return err
+		}
+		err = p.registerShortcodes()
+		if err != nil {
+			return fmt.Errorf("plugin %s: %w", p.Name, err)
+		}
+		plugins = append(plugins, p)
+		log.Printf("plugins: loaded %s", p.Name)
+	}
+	return nil
+}
+
+func loadPlugin(path string, cfg PluginConfig) (*Plugin, error) {
+	ctx := context.Background()
+	wasm, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	if cfg.MemoryMB <= 0 {
+		cfg.MemoryMB = defaultPluginMemoryMB
+	}
+	if cfg.TimeoutMS <= 0 {
+		cfg.TimeoutMS = defaultPluginTimeoutMS
+	}
+	p := &Plugin{
+		Name:    strings.TrimSuffix(filepath.Base(path), ".wasm"),
+		timeout: time.Duration(cfg.TimeoutMS) * time.Millisecond,
+	}
+	p.runtime = wazero.NewRuntimeWithConfig(ctx, wazero.NewRuntimeConfig().
+		WithMemoryLimitPages(uint32(cfg.MemoryMB)*16). // 64KiB pages
+		WithCloseOnContextDone(true))
+	wasi_snapshot_preview1.MustInstantiate(ctx, p.runtime)
+	host := p.runtime.NewHostModuleBuilder("jonblog")
+	host.NewFunctionBuilder().WithFunc(p.hostLog).Export("log")
+	host.NewFunctionBuilder().WithFunc(hostFail).Export("fail")
+	_, err = host.Instantiate(ctx)
+	if err != nil {
+		p.runtime.Close(ctx)
+		return nil, err
+	}
+	p.compiled, err = p.runtime.CompileModule(ctx, wasm)
+	if err != nil {
+		p.runtime.Close(ctx)
+		return nil, fmt.Errorf("plugin %s: %w", p.Name, err)
+	}
+	if _, ok := p.compiled.ExportedMemories()["memory"]; !ok {
+		p.runtime.Close(ctx)
+		return nil, fmt.Errorf("plugin %s: memory is not exported", p.Name)
+	}
+	if !p.exports("alloc") {
+		p.runtime.Close(ctx)
+		return nil, fmt.Errorf("plugin %s: alloc is not exported", p.Name)
+	}
+	return p, nil
+}
+
+func (p *Plugin) hostLog(ctx context.Context, m api.Module, ptr, n uint32) {
+	if b, ok := m.Memory().Read(ptr, n); ok {
+		log.Printf("plugin %s: %s", p.Name, b)
+	}
+}
+
+// hostFail records the failure and ends the call by panicking, which wazero
+// turns into an error from the guest function.
+func hostFail(ctx context.Context, m api.Module, ptr, n uint32) {
+	msg, _ := m.Memory().Read(ptr, n)
+	err := errors.New(string(msg))
+	if pc, _ := ctx.Value(pluginCallKey{}).(*pluginCall); pc != nil {
+		pc.err = err
+	}
+	panic(err)
+}
+
+func (p *Plugin) exports(fn string) bool {
+	_, ok := p.compiled.ExportedFunctions()[fn]
+	return ok
+}
+
+// call runs fn in a new instance of the plugin. If input is nil, fn is
+// called without arguments. Failures are logged, since they usually only
+// show up to readers as a 500.
+func (p *Plugin) call(fn string, input []byte) (out []byte, err error) {
+	defer func() {
+		if err != nil {
+			log.Print(err)
+		}
+	}()
+	ctx, cancel := context.WithTimeout(context.Background(), p.timeout)
+	defer cancel()
+	pc := &pluginCall{}
+	ctx = context.WithValue(ctx, pluginCallKey{}, pc)
+	// Reactor modules, such as those built by Go and TinyGo, set themselves
+	// up in _initialize.
+	mod, err := p.runtime.InstantiateModule(ctx, p.compiled, wazero.NewModuleConfig().
+		WithName("").
+		WithStartFunctions("_initialize"))
+	if err != nil {
+		return nil, fmt.Errorf("plugin %s: %w", p.Name, err)
+	}
+	defer mod.Close(context.Background())
+
+	var args []uint64
+	if input != nil {
+		res, err := mod.ExportedFunction("alloc").Call(ctx, uint64(len(input)))
+		if err != nil {
+			return nil, fmt.Errorf("plugin %s: alloc: %w", p.Name, err)
+		}
+		if !mod.Memory().Write(uint32(res[0]), input) {
+			return nil, fmt.Errorf("plugin %s: alloc returned an invalid buffer", p.Name)
+		}
+		args = []uint64{res[0], uint64(len(input))}
+	}
+	res, err := mod.ExportedFunction(fn).Call(ctx, args...)
+	if pc.err != nil {
+		return nil, fmt.Errorf("plugin %s: %s: %w", p.Name, fn, pc.err)
+	}
+	if err != nil {
+		return nil, fmt.Errorf("plugin %s: %s: %w", p.Name, fn, err)
+	}
+	if len(res) != 1 {
+		return nil, fmt.Errorf("plugin %s: %s has the wrong signature", p.Name, fn)
+	}
+	out, ok := mod.Memory().Read(uint32(res[0]>>32), uint32(res[0]))
+	if !ok {
+		return nil, fmt.Errorf("plugin %s: %s returned an invalid buffer", p.Name, fn)
+	}
+	return bytes.Clone(out), nil
+}
+
+var shortcodeNameRe = regexp.MustCompile(`^[A-Za-z0-9_-]+$`)
+
+func (p *Plugin) registerShortcodes() error {
+	if !p.exports("shortcodes") {
+		return nil
+	}
+	if !p.exports(hookShortcode) {
+		return errors.New("shortcodes is exported without shortcode")
+	}
+	out, err := p.call("shortcodes", nil)
+	if err != nil {
+		return err
+	}
+	var defs []struct {
+		Name   string `json:"name"`
+		Paired bool   `json:"paired"`
+	}
+	err = json.Unmarshal(out, &defs)
+	if err != nil {
+		return fmt.Errorf("shortcodes: %w", err)
+	}
+	for _, def := range defs {
+		if _, ok := shortcodes[def.Name]; ok || !shortcodeNameRe.MatchString(def.Name) {
+			return fmt.Errorf("shortcode %q is invalid or already registered", def.Name)
+		}
+		shortcodes[def.Name] = shortcodeDef{paired: def.Paired, render: p.renderShortcode}
+	}
+	return nil
+}
+
+func (p *Plugin) renderShortcode(sc Shortcode, rc *RenderContext) (template.HTML, error) {
+	in, err := json.Marshal(struct {
+		Name  string            `json:"name"`
+		Args  map[string]string `json:"args"`
+		Pos   []string          `json:"pos"`
+		Inner string            `json:"inner"`
+		Slug  string            `json:"slug"`
+	}{sc.Name, sc.Args, sc.Pos, sc.Inner, rc.Slug})
+	if err != nil {
+		return "", err
+	}
+	out, err := p.call(hookShortcode, in)
+	if err != nil {
+		return "", err
+	}
+	return template.HTML(out), nil
+}
+
+// runPlugins passes src through hook of every plugin that exports it.
+func runPlugins(hook string, src []byte) ([]byte, error) {
+	for _, p := range plugins {
+		if !p.exports(hook) {
+			continue
+		}
+		var err error
+		src, err = p.call(hook, src)
+		if err != nil {
+			return nil, err
+		}
+	}
+	return src, nil
+}
@@ -0,0 +1,250 @@
+package main
+
+import (
+	"context"
+	"encoding/binary"
+	"encoding/json"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+// testPluginShortcodes is the shortcodes() result of testPluginWASM.
+const testPluginShortcodes = `[{"name":"zz-echo","paired":true}]`
+
+// testPluginWASM returns a plugin written directly in WebAssembly. It echoes
+// the input of shortcode and pre_markdown, except that pre_markdown
+//
+//   - calls fail("boom") and then fail("continued") when its input starts
+//     with "!", and
+//   - loops forever when its input starts with "#".
+//
+// alloc always returns offset 1024, growing the memory to fit, and traps if
+// it can't.
+func testPluginWASM() []byte {
+	uleb := func(n int) []byte { return binary.AppendUvarint(nil, uint64(n)) }
+	sleb := func(n int64) []byte {
+		var b []byte
+		for {
+			c := byte(n & 0x7f)
+			n >>= 7
+			if (n == 0 && c&0x40 == 0) || (n == -1 && c&0x40 != 0) {
+				return append(b, c)
+			}
+			b = append(b, c|0x80)
+		}
+	}
+	cat := func(parts ...[]byte) []byte {
+		var b []byte
+		for _, p := range parts {
+			b = append(b, p...)
+		}
+		return b
+	}
+	vec := func(items ...[]byte) []byte { return cat(append([][]byte{uleb(len(items))}, items...)...) }
+	str := func(s string) []byte { return cat(uleb(len(s)), []byte(s)) }
+	section := func(id byte, content []byte) []byte { return cat([]byte{id}, uleb(len(content)), content) }
+	i32Const := func(n int64) []byte { return cat([]byte{0x41}, sleb(n)) }
+	body := func(locals []byte, code ...[]byte) []byte {
+		b := cat(locals, cat(code...), []byte{0x0b})
+		return cat(uleb(len(b)), b)
+	}
+	const (
+		i32, i64    = 0x7f, 0x7e
+		failMsg     = 64
+		continueMsg = 80
+		heap        = 1024
+	)
+	// pack returns ptr<<32 | len from the first two locals.
+	pack := []byte{0x20, 0, 0xad, 0x42, 32, 0x86, 0x20, 1, 0xad, 0x84}
+	firstByteIs := func(c byte) []byte {
+		return cat([]byte{0x20, 0, 0x2d, 0, 0}, i32Const(int64(c)), []byte{0x46})
+	}
+	// needed is the pages alloc must grow the memory by.
+	needed := cat([]byte{0x20, 0}, i32Const(heap+65535), []byte{0x6a}, i32Const(16), []byte{0x76, 0x3f, 0, 0x6b})
+
+	types := vec(
+		[]byte{0x60, 2, i32, i32, 0},      // (i32, i32)
+		[]byte{0x60, 1, i32, 1, i32},      // (i32) -> i32
+		[]byte{0x60, 0, 1, i64},           // () -> i64
+		[]byte{0x60, 2, i32, i32, 1, i64}, // (i32, i32) -> i64
+	)
+	imports := vec(
+		cat(str("jonblog"), str("fail"), []byte{0, 0}),
+		cat(str("jonblog"), str("log"), []byte{0, 0}),
+	)
+	funcs := vec([]byte{1}, []byte{2}, []byte{3}, []byte{3})
+	memory := vec([]byte{0, 1})
+	exports := vec(
+		cat(str("memory"), []byte{2, 0}),
+		cat(str("alloc"), []byte{0, 2}),
+		cat(str("shortcodes"), []byte{0, 3}),
+		cat(str("shortcode"), []byte{0, 4}),
+		cat(str("pre_markdown"), []byte{0, 5}),
+	)
+	code := vec(
+		// alloc
+		body([]byte{1, 1, i32},
+			needed, []byte{0x22, 1}, i32Const(0), []byte{0x4a, 0x04, 0x40}, // if needed > 0
+			[]byte{0x20, 1, 0x40, 0}, i32Const(-1), []byte{0x46, 0x04, 0x40, 0x00, 0x0b}, // trap if memory.grow fails
+			[]byte{0x0b},
+			i32Const(heap),
+		),
+		// shortcodes
+		body([]byte{0}, []byte{0x42}, sleb(int64(len(testPluginShortcodes)))),
+		// shortcode
+		body([]byte{0}, pack),
+		// pre_markdown
+		body([]byte{0},
+			firstByteIs('!'), []byte{0x04, 0x40},
+			i32Const(failMsg), i32Const(4), []byte{0x10, 0},
+			i32Const(continueMsg), i32Const(9), []byte{0x10, 0},
+			[]byte{0x42, 0, 0x0f, 0x0b},
+			firstByteIs('#'), []byte{0x04, 0x40, 0x03, 0x40, 0x0c, 0, 0x0b, 0x0b},
+			pack,
+		),
+	)
+	segment := func(offset int64, s string) []byte {
+		return cat([]byte{0}, i32Const(offset), []byte{0x0b}, str(s))
+	}
+	data := vec(segment(0, testPluginShortcodes), segment(failMsg, "boom"), segment(continueMsg, "continued"))
+	return cat(
+		[]byte("\x00asm\x01\x00\x00\x00"),
+		section(1, types),
+		section(2, imports),
+		section(3, funcs),
+		section(5, memory),
+		section(7, exports),
+		section(10, code),
+		section(11, data),
+	)
+}
+
+// testPlugin loads testPluginWASM with cfg, leaving the registry alone.
+func testPlugin(t *testing.T, cfg PluginConfig) *Plugin {
+	t.Helper()
+	path := filepath.Join(t.TempDir(), "test.wasm")
+	err := os.WriteFile(path, testPluginWASM(), 0644)
+	if err != nil {
+		t.Fatal(err)
+	}
+	p, err := loadPlugin(path, cfg)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { p.runtime.Close(context.Background()) })
+	return p
+}
+
+func TestLoadPlugins(t *testing.T) {
+	dir := t.TempDir()
+	err := os.WriteFile(filepath.Join(dir, "test.wasm"), testPluginWASM(), 0644)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() {
+		for _, p := range plugins {
+			p.runtime.Close(context.Background())
+		}
+		plugins = nil
+		delete(shortcodes, "zz-echo")
+	})
+	err = LoadPlugins(PluginConfig{Dir: dir})
+	if err != nil {
+		t.Fatalf("LoadPlugins() error = %v", err)
+	}
+	if !shortcodes["zz-echo"].paired {
+		t.Fatalf("zz-echo was not registered as a paired shortcode")
+	}
+
+	// The shortcode echoes the JSON it is given, which shows in the page.
+	src := "Before.\n\n{{< zz-echo size=\"big\" first >}}\nInner text\n{{< /zz-echo >}}\n\nAfter.\n"
+	html, err := renderMarkdown(&RenderContext{Slug: "a"}, []byte(src))
+	if err != nil {
+		t.Fatalf("renderMarkdown() error = %v", err)
+	}
+	start, end := strings.Index(string(html), "{"), strings.LastIndex(string(html), "}")
+	if start < 0 || end < start {
+		t.Fatalf("renderMarkdown() = %q, want the shortcode's input in it", html)
+	}
+	var got map[string]any
+	err = json.Unmarshal([]byte(html[start:end+1]), &got)
+	if err != nil {
+		t.Fatalf("shortcode input %q: %v", html[start:end+1], err)
+	}
+	want := map[string]any{
+		"name":  "zz-echo",
+		"args":  map[string]any{"size": "big"},
+		"pos":   []any{"first"},
+		"inner": "Inner text",
+		"slug":  "a",
+	}
+	if gotJSON, wantJSON := mustJSON(t, got), mustJSON(t, want); gotJSON != wantJSON {
+		t.Errorf("shortcode input = %s, want %s", gotJSON, wantJSON)
+	}
+	for _, text := range []string{"Before.", "After."} {
+		if !strings.Contains(string(html), text) {
+			t.Errorf("renderMarkdown() = %q, which is missing %q", html, text)
+		}
+	}
+}
+
+func mustJSON(t *testing.T, v any) string {
+	t.Helper()
+	b, err := json.Marshal(v)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return string(b)
+}
+
+func TestPluginCall(t *testing.T) {
+	tests := []struct {
+		name    string
+		cfg     PluginConfig
+		input   []byte
+		want    string
+		wantErr string
+	}{
+		{"echo", PluginConfig{MemoryMB: 1, TimeoutMS: 1000}, []byte("hello"), "hello", ""},
+		{"zero limits use the defaults", PluginConfig{}, []byte("hello"), "hello", ""},
+		{"within the memory limit", PluginConfig{MemoryMB: 1, TimeoutMS: 1000}, make([]byte, 512<<10), strings.Repeat("\x00", 512<<10), ""},
+		{"over the memory limit", PluginConfig{MemoryMB: 1, TimeoutMS: 1000}, make([]byte, 2<<20), "", "alloc"},
+		{"fail ends the call", PluginConfig{TimeoutMS: 1000}, []byte("!"), "", "pre_markdown: boom"},
+		{"timeout", PluginConfig{TimeoutMS: 50}, []byte("#"), "", "pre_markdown"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			p := testPlugin(t, tt.cfg)
+			start := time.Now()
+			got, err := p.call(hookPreMarkdown, tt.input)
+			if elapsed := time.Since(start); elapsed > 2*time.Second {
+				t.Errorf("call() took %v", elapsed)
+			}
+			if tt.wantErr != "" {
+				if err == nil || !strings.Contains(err.Error(), tt.wantErr) {
+					t.Fatalf("call() error = %v, want %q", err, tt.wantErr)
+				}
+				if strings.Contains(err.Error(), "continued") {
+					t.Errorf("call() error = %v, so the plugin kept running after fail", err)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("call() error = %v", err)
+			}
+			if string(got) != tt.want {
+				t.Errorf("call() = %.40q, want %.40q", got, tt.want)
+			}
+		})
+	}
+
+	t.Run("defaults", func(t *testing.T) {
+		p := testPlugin(t, PluginConfig{})
+		if want := defaultPluginTimeoutMS * time.Millisecond; p.timeout != want {
+			t.Errorf("timeout = %v, want %v", p.timeout, want)
+		}
+	})
+}
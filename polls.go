@@ -0,0 +1,364 @@
+package main
+
+import (
+	"encoding/csv"
+	"errors"
+	"fmt"
+	"html/template"
+	"net/http"
+	"regexp"
+	"slices"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Polls ask readers a question from within a post. Each line of the poll is
+// an option:
+//
+//	{{< poll id="editor" question="Which editor do you use?" closes="2025-12-31" >}}
+//	VS Code
+//	Vim
+//	Emacs
+//	{{< /poll >}}
+//
+// Voting is open until the end of the closes date, in UTC, or forever when it
+// is left out. Readers see the results once they have voted or the poll has
+// closed. Polls only take votes on posts, not docs pages.
+const pollShortcode = "poll"
+
+var pollIDRe = regexp.MustCompile(`^[A-Za-z0-9_-]+$`)
+
+var errPollClosed = errors.New("poll closed")
+
+// Poll is a poll as declared in a post.
+type Poll struct {
+	ID       string
+	Question string
+	Options  []string
+	// Closes is the last day of voting.
+	Closes time.Time
+}
+
+func parsePoll(sc Shortcode) (Poll, error) {
+	p := Poll{ID: sc.Arg("id", 0), Question: sc.Arg("question", 1)}
+	if !pollIDRe.MatchString(p.ID) {
+		return Poll{}, fmt.Errorf("invalid id %q", p.ID)
+	}
+	if p.Question == "" {
+		return Poll{}, errors.New("missing question")
+	}
+	for _, line := range strings.Split(sc.Inner, "\n") {
+		option := strings.TrimSpace(strings.TrimPrefix(strings.TrimSpace(line), "- "))
+		if option != "" && !slices.Contains(p.Options, option) {
+			p.Options = append(p.Options, option)
+		}
+	}
+	if len(p.Options) < 2 {
+		return Poll{}, errors.New("a poll needs at least two options")
+	}
+	if closes := sc.Args["closes"]; closes != "" {
+		t, err := time.Parse("2006-01-02", closes)
+		if err != nil {
+			return Poll{}, fmt.Errorf("invalid closes %q", closes)
+		}
+		p.Closes = t
+	}
+	return p, nil
+}
+
+// Closed reports whether voting has ended.
+func (p Poll) Closed() bool {
+	return p.closedAt(time.Now())
+}
+
+func (p Poll) closedAt(now time.Time) bool {
+	return !p.Closes.IsZero() && !now.Before(p.Closes.AddDate(0, 0, 1))
+}
+
+// findPoll returns the poll with the given id in a post's markdown.
+func findPoll(src []byte, id string) (Poll, bool) {
+	for _, span := range findShortcodes(strings.Split(string(src), "\n")) {
+		if span.sc.Name != pollShortcode {
+			continue
+		}
+		p, err := parsePoll(span.sc)
+		if err == nil && p.ID == id {
+			return p, true
+		}
+	}
+	return Poll{}, false
+}
+
+type pollData struct {
+	// Votes maps slug to poll to option to count.
+	Votes map[string]map[string]map[string]int `json:"votes"`
+	// Seen records which visitors and hashed IP windows have already voted,
+	// keyed by slug, poll and identity, along with when they did so. See
+	// prunePollSeen for how long they are kept.
+	Seen map[string]time.Time `json:"seen"`
+	// Closes records the close date of each poll voted in, keyed by slug and
+	// poll, so voters can be forgotten once it has passed.
+	Closes map[string]time.Time `json:"closes,omitempty"`
+}
+
+// prunePollSeen forgets hashed IP windows after ipWindow, and visitors once
+// their poll has closed. Until then a visitor is remembered however long ago
+// they voted, so they can only ever vote once. Polls without a close date
+// remember their voters for good.
+func prunePollSeen(data *pollData, now time.Time) {
+	for k, t := range data.Seen {
+		if strings.HasPrefix(k, "ip|") {
+			if now.Sub(t) > ipWindow {
+				delete(data.Seen, k)
+			}
+			continue
+		}
+		// Visitor keys are v|slug|id|visitor.
+		poll := strings.TrimPrefix(k, "v|")
+		poll = poll[:max(strings.LastIndex(poll, "|"), 0)]
+		if (Poll{Closes: data.Closes[poll]}).closedAt(now) {
+			delete(data.Seen, k)
+		}
+	}
+	for poll, closes := range data.Closes {
+		if (Poll{Closes: closes}).closedAt(now) {
+			delete(data.Closes, poll)
+		}
+	}
+}
+
+// PollStore counts votes in polls. Only totals are stored, not who voted for
+// what.
+type PollStore struct {
+	Secret string
+
+	file    *JSONFile[pollData]
+	limiter *RateLimiter
+}
+
+func NewPollStore(path, secret string) (*PollStore, error) {
+	file, err := OpenJSONFile[pollData](path)
+	if err != nil {
+		return nil, err
+	}
+	return &PollStore{
+		Secret:  secret,
+		file:    file,
+		limiter: &RateLimiter{Limit: 20, Window: time.Minute},
+	}, nil
+}
+
+// Vote records a vote unless the visitor or their hashed IP has already voted
+// in the poll.
+func (ps *PollStore) Vote(slug string, p Poll, option, visitor, ipKey string) error {
+	if p.Closed() {
+		return errPollClosed
+	}
+	return ps.file.Update(func(data *pollData) error {
+		if data.Votes == nil {
+			data.Votes = make(map[string]map[string]map[string]int)
+			data.Seen = make(map[string]time.Time)
+		}
+		if data.Closes == nil {
+			data.Closes = make(map[string]time.Time)
+		}
+		now := time.Now()
+		prunePollSeen(data, now)
+		visitorKey := "v|" + slug + "|" + p.ID + "|" + visitor
+		ipSeenKey := "ip|" + slug + "|" + p.ID + "|" + ipKey
+		if _, ok := data.Seen[visitorKey]; ok {
+			return errAlreadyCounted
+		}
+		if _, ok := data.Seen[ipSeenKey]; ok {
+			return errAlreadyCounted
+		}
+		data.Seen[visitorKey] = now
+		data.Seen[ipSeenKey] = now
+		data.Closes[slug+"|"+p.ID] = p.Closes
+		if data.Votes[slug] == nil {
+			data.Votes[slug] = make(map[string]map[string]int)
+		}
+		if data.Votes[slug][p.ID] == nil {
+			data.Votes[slug][p.ID] = make(map[string]int)
+		}
+		data.Votes[slug][p.ID][option]++
+		return nil
+	})
+}
+
+// voted reports whether the visitor or their hashed IP has voted in the poll.
+func (ps *PollStore) voted(slug, id, visitor, ipKey string) bool {
+	var ok bool
+	ps.file.View(func(data *pollData) {
+		if visitor != "" {
+			_, ok = data.Seen["v|"+slug+"|"+id+"|"+visitor]
+		}
+		if !ok {
+			_, ok = data.Seen["ip|"+slug+"|"+id+"|"+ipKey]
+		}
+	})
+	return ok
+}
+
+// PollResult is the share of the votes an option received.
+type PollResult struct {
+	Option  string
+	Votes   int
+	Percent int
+}
+
+// Results returns the votes for each option of the poll, in order.
+func (ps *PollStore) Results(slug string, p Poll) ([]PollResult, int) {
+	results := make([]PollResult, 0, len(p.Options))
+	total := 0
+	ps.file.View(func(data *pollData) {
+		for _, option := range p.Options {
+			n := data.Votes[slug][p.ID][option]
+			results = append(results, PollResult{Option: option, Votes: n})
+			total += n
+		}
+	})
+	if total > 0 {
+		for i := range results {
+			results[i].Percent = results[i].Votes * 100 / total
+		}
+	}
+	return results, total
+}
+
+var pollTpl = template.Must(template.New("poll").Parse(`<div id="poll-{{.ID}}" class="not-prose border rounded p-4 my-6">
+  <p class="font-semibold">{{.Question}}</p>
+  {{- if .ShowResults}}
+  {{- range .Results}}
+  <div class="mt-2">
+    <div class="flex justify-between text-sm"><span>{{.Option}}</span><span class="text-gray-500">{{.Percent}}% ({{.Votes}})</span></div>
+    <div class="bg-gray-200 rounded h-2"><div class="bg-blue-600 rounded h-2" style="width: {{.Percent}}%"></div></div>
+  </div>
+  {{- end}}
+  <p class="text-xs text-gray-500 mt-3">{{.Total}} vote{{if ne .Total 1}}s{{end}}{{if .Closed}} &middot; Closed{{end}}</p>
+  {{- else}}
+  <form method="post" action="/posts/{{.Slug}}/polls/{{.ID}}">
+    {{- range .Options}}
+    <label class="block mt-2"><input type="radio" name="option" value="{{.}}" required> {{.}}</label>
+    {{- end}}
+    <button class="mt-3 bg-gray-800 text-white rounded px-4 py-2">Vote</button>
+    {{- if not .Closes.IsZero}}
+    <p class="text-xs text-gray-500 mt-3">Voting closes at the end of {{.Closes.Format "January 2, 2006"}} (UTC)</p>
+    {{- end}}
+  </form>
+  {{- end}}
+</div>`))
+
+// shortcode returns the poll shortcode, which shows the votes in this store.
+func (ps *PollStore) shortcode() shortcodeDef {
+	return shortcodeDef{paired: true, render: ps.render, markdown: pollMarkdown}
+}
+
+func (ps *PollStore) render(sc Shortcode, rc *RenderContext) (template.HTML, error) {
+	p, err := parsePoll(sc)
+	if err != nil {
+		return "", err
+	}
+	data := struct {
+		Poll
+		Slug        string
+		ShowResults bool
+		Results     []PollResult
+		Total       int
+	}{Poll: p, Slug: rc.Slug}
+	rc.noCache = true
+	data.ShowResults = p.Closed()
+	if rc.Request != nil && !data.ShowResults {
+		data.ShowResults = ps.voted(rc.Slug, p.ID, cookieVisitorID(rc.Request, ps.Secret), ipWindowKey(rc.Request, ps.Secret, ipWindow))
+	}
+	data.Results, data.Total = ps.Results(rc.Slug, p)
+	var b strings.Builder
+	err = pollTpl.Execute(&b, data)
+	if err != nil {
+		return "", err
+	}
+	return template.HTML(b.String()), nil
+}
+
+// pollMarkdown exports a poll as its question and a list of options.
+func pollMarkdown(sc Shortcode) (string, error) {
+	p, err := parsePoll(sc)
+	if err != nil {
+		return "", err
+	}
+	var b strings.Builder
+	fmt.Fprintf(&b, "**%s**\n", escapeMarkdown(p.Question))
+	for _, option := range p.Options {
+		fmt.Fprintf(&b, "\n- %s", escapeMarkdown(option))
+	}
+	return b.String(), nil
+}
+
+// VoteHandler accepts a vote in a poll from a form POST and redirects back to
+// the poll.
+func VoteHandler(sl SlugReader, ps *PollStore) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		slug := r.PathValue("slug")
+		postMarkdown, err := sl.Read(slug)
+		if err != nil {
+			http.Error(w, "Post not found", http.StatusNotFound)
+			return
+		}
+		post, rest, err := parsePost(sl, slug, postMarkdown)
+		if err != nil || post.Visibility == VisibilityPrivate {
+			http.Error(w, "Post not found", http.StatusNotFound)
+			return
+		}
+		p, ok := findPoll(rest, r.PathValue("poll"))
+		if !ok {
+			http.Error(w, "Poll not found", http.StatusNotFound)
+			return
+		}
+		option := r.FormValue("option")
+		if !slices.Contains(p.Options, option) {
+			http.Error(w, "Unknown option", http.StatusBadRequest)
+			return
+		}
+		if !ps.limiter.Allow(clientIP(r)) {
+			http.Error(w, "Too many requests", http.StatusTooManyRequests)
+			return
+		}
+		visitor := visitorID(w, r, ps.Secret)
+		err = ps.Vote(slug, p, option, visitor, ipWindowKey(r, ps.Secret, ipWindow))
+		if errors.Is(err, errPollClosed) {
+			http.Error(w, "This poll is closed", http.StatusForbidden)
+			return
+		}
+		if err != nil && !errors.Is(err, errAlreadyCounted) {
+			http.Error(w, "Error saving vote", http.StatusInternalServerError)
+			return
+		}
+		http.Redirect(w, r, "/posts/"+slug+"#poll-"+p.ID, http.StatusSeeOther)
+	}
+}
+
+// AdminPollsCSVHandler serves the vote counts of every poll as CSV.
+func AdminPollsCSVHandler(ps *PollStore) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		var rows [][]string
+		ps.file.View(func(data *pollData) {
+			for slug, polls := range data.Votes {
+				for id, options := range polls {
+					for option, n := range options {
+						rows = append(rows, []string{slug, id, option, strconv.Itoa(n)})
+					}
+				}
+			}
+		})
+		sort.Slice(rows, func(i, j int) bool {
+			return slices.Compare(rows[i][:3], rows[j][:3]) < 0
+		})
+		w.Header().Set("Content-Type", "text/csv; charset=utf-8")
+		w.Header().Set("Content-Disposition", `attachment; filename="polls.csv"`)
+		cw := csv.NewWriter(w)
+		cw.Write([]string{"slug", "poll", "option", "votes"})
+		cw.WriteAll(rows)
+	}
+}
@@ -0,0 +1,181 @@
+package main
+
+import (
+	"errors"
+	"path/filepath"
+	"reflect"
+	"sort"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestParsePoll(t *testing.T) {
+	named := func(args map[string]string, inner string) Shortcode {
+		return Shortcode{Name: pollShortcode, Args: args, Inner: inner}
+	}
+	tests := []struct {
+		name    string
+		sc      Shortcode
+		want    Poll
+		wantErr string
+	}{
+		{
+			name: "named args",
+			sc:   named(map[string]string{"id": "editor", "question": "Which editor?", "closes": "2025-12-31"}, "VS Code\nVim\n"),
+			want: Poll{ID: "editor", Question: "Which editor?", Options: []string{"VS Code", "Vim"}, Closes: time.Date(2025, 12, 31, 0, 0, 0, 0, time.UTC)},
+		},
+		{
+			name: "positional args",
+			sc:   Shortcode{Name: pollShortcode, Args: map[string]string{}, Pos: []string{"editor", "Which editor?"}, Inner: "VS Code\nVim"},
+			want: Poll{ID: "editor", Question: "Which editor?", Options: []string{"VS Code", "Vim"}},
+		},
+		{
+			name: "list items, blank lines and duplicates",
+			sc:   named(map[string]string{"id": "os", "question": "Which OS?"}, "- Linux\n\n  - macOS  \n- Linux\n- Windows\n"),
+			want: Poll{ID: "os", Question: "Which OS?", Options: []string{"Linux", "macOS", "Windows"}},
+		},
+		{
+			name:    "missing id",
+			sc:      named(map[string]string{"question": "Which editor?"}, "VS Code\nVim"),
+			wantErr: "invalid id",
+		},
+		{
+			name:    "invalid id",
+			sc:      named(map[string]string{"id": "my poll", "question": "Which editor?"}, "VS Code\nVim"),
+			wantErr: "invalid id",
+		},
+		{
+			name:    "missing question",
+			sc:      named(map[string]string{"id": "editor"}, "VS Code\nVim"),
+			wantErr: "missing question",
+		},
+		{
+			name:    "one option",
+			sc:      named(map[string]string{"id": "editor", "question": "Which editor?"}, "Vim\n- Vim\n"),
+			wantErr: "at least two options",
+		},
+		{
+			name:    "invalid closes",
+			sc:      named(map[string]string{"id": "editor", "question": "Which editor?", "closes": "31/12/2025"}, "VS Code\nVim"),
+			wantErr: "invalid closes",
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := parsePoll(tt.sc)
+			if tt.wantErr != "" {
+				if err == nil || !strings.Contains(err.Error(), tt.wantErr) {
+					t.Fatalf("parsePoll() error = %v, want %q", err, tt.wantErr)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("parsePoll() error = %v", err)
+			}
+			if !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("parsePoll() = %+v, want %+v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestPollClosed(t *testing.T) {
+	today := time.Now().UTC().Truncate(24 * time.Hour)
+	tests := []struct {
+		name   string
+		closes time.Time
+		want   bool
+	}{
+		{"no close date", time.Time{}, false},
+		{"closes today", today, false},
+		{"closes tomorrow", today.AddDate(0, 0, 1), false},
+		{"closed yesterday", today.AddDate(0, 0, -1), true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := (Poll{Closes: tt.closes}).Closed(); got != tt.want {
+				t.Errorf("Closed() = %t, want %t", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestPollVoteOnce(t *testing.T) {
+	open := Poll{ID: "editor", Question: "Which editor?", Options: []string{"VS Code", "Vim"}}
+	tests := []struct {
+		name    string
+		poll    Poll
+		age     time.Duration
+		wantErr error
+	}{
+		{"same day", open, time.Hour, errAlreadyCounted},
+		{"after 31 days", open, 31 * 24 * time.Hour, errAlreadyCounted},
+		{"after a year", open, 365 * 24 * time.Hour, errAlreadyCounted},
+		{"closing poll after 31 days", Poll{ID: "os", Question: "Which OS?", Options: []string{"Linux", "macOS"}, Closes: time.Now().UTC().AddDate(0, 1, 0)}, 31 * 24 * time.Hour, errAlreadyCounted},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			ps, err := NewPollStore(filepath.Join(t.TempDir(), "polls.json"), "s3")
+			if err != nil {
+				t.Fatal(err)
+			}
+			err = ps.Vote("a", tt.poll, tt.poll.Options[0], "visitor", "ip-day-1")
+			if err != nil {
+				t.Fatalf("first Vote() error = %v", err)
+			}
+			// Age the vote, as if it had been cast tt.age ago, and vote again
+			// from another network.
+			ps.file.Update(func(data *pollData) error {
+				for k := range data.Seen {
+					data.Seen[k] = data.Seen[k].Add(-tt.age)
+				}
+				return nil
+			})
+			err = ps.Vote("a", tt.poll, tt.poll.Options[1], "visitor", "ip-day-2")
+			if !errors.Is(err, tt.wantErr) {
+				t.Errorf("second Vote() error = %v, want %v", err, tt.wantErr)
+			}
+			results, total := ps.Results("a", tt.poll)
+			if total != 1 || results[0].Votes != 1 {
+				t.Errorf("Results() = %+v, %d, want the first vote only", results, total)
+			}
+		})
+	}
+}
+
+func TestPrunePollSeen(t *testing.T) {
+	now := time.Date(2025, 6, 15, 12, 0, 0, 0, time.UTC)
+	data := &pollData{
+		Seen: map[string]time.Time{
+			"v|a|open|x":       now.AddDate(-1, 0, 0),
+			"v|a|closing|x":    now.AddDate(0, -2, 0),
+			"v|a|closed|x":     now.AddDate(0, 0, -3),
+			"v|a|unknown|x":    now.AddDate(-1, 0, 0),
+			"ip|a|open|recent": now.Add(-time.Hour),
+			"ip|a|open|old":    now.Add(-ipWindow - time.Hour),
+		},
+		Closes: map[string]time.Time{
+			"a|open":    {},
+			"a|closing": time.Date(2025, 6, 15, 0, 0, 0, 0, time.UTC),
+			"a|closed":  time.Date(2025, 6, 14, 0, 0, 0, 0, time.UTC),
+		},
+	}
+	prunePollSeen(data, now)
+	var seen, closes []string
+	for k := range data.Seen {
+		seen = append(seen, k)
+	}
+	for k := range data.Closes {
+		closes = append(closes, k)
+	}
+	sort.Strings(seen)
+	sort.Strings(closes)
+	wantSeen := []string{"ip|a|open|recent", "v|a|closing|x", "v|a|open|x", "v|a|unknown|x"}
+	if !reflect.DeepEqual(seen, wantSeen) {
+		t.Errorf("Seen after prunePollSeen() = %q, want %q", seen, wantSeen)
+	}
+	if wantCloses := []string{"a|closing", "a|open"}; !reflect.DeepEqual(closes, wantCloses) {
+		t.Errorf("Closes after prunePollSeen() = %q, want %q", closes, wantCloses)
+	}
+}
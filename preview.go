@@ -0,0 +1,410 @@
+package main
+
+import (
+	"archive/tar"
+	"bytes"
+	"context"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"html/template"
+	"io"
+	"log"
+	"net/http"
+	"net/url"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"regexp"
+	"slices"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Previews let reviewers read a branch before it is merged. Any ref in the
+// content repository can be viewed at /preview/{ref}/..., with slashes in the
+// ref escaped as %2F:
+//
+//	/preview/new-post/posts/my-new-post
+//	/preview/pull%2F12%2Fhead/docs/widget/install
+//
+// Each commit is extracted into its own snapshot directory with its own
+// caches, so nothing a preview renders touches the live site. Snapshots that
+// haven't been viewed for a while are deleted, along with any refs fetched
+// for them.
+//
+// Only content comes from the snapshot. Templates are always parsed from the
+// server's working directory, so a branch that changes a .gohtml file is
+// previewed with the live templates.
+type PreviewManager struct {
+	// Repo is the git repository holding the content.
+	Repo string
+	// Dir is where snapshots are extracted.
+	Dir       string
+	Idle      time.Duration
+	MediaDir  string
+	AlbumsDir string
+	// Secret and UserAgent are used by each snapshot's embed cache.
+	Secret    string
+	UserAgent string
+	// Icons are served by every snapshot. It is nil when icons aren't set
+	// up.
+	Icons *IconSet
+
+	mu        sync.Mutex
+	snapshots map[string]*snapshot
+	// locks serialize the work on each ref and commit, so a slow fetch only
+	// holds up requests for the same branch.
+	locks map[string]*keyLock
+}
+
+type keyLock struct {
+	sync.Mutex
+	waiting int
+}
+
+type snapshot struct {
+	commit   string
+	dir      string
+	handler  http.Handler
+	lastUsed time.Time
+	// inUse counts the requests being served from the snapshot, which keep
+	// it from being evicted.
+	inUse int
+	// fetched are the refs fetched into refs/previews/ that pointed to the
+	// commit.
+	fetched []string
+}
+
+var errUnknownRef = errors.New("unknown ref")
+
+// NewPreviewManager removes any snapshots left over from a previous run and
+// starts evicting idle ones.
+func NewPreviewManager(cfg Config) (*PreviewManager, error) {
+	pm := &PreviewManager{
+		Repo:      cfg.Previews.Repo,
+		Dir:       filepath.Join(cfg.CacheDir, "previews"),
+		Idle:      time.Duration(cfg.Previews.IdleMinutes) * time.Minute,
+		MediaDir:  cfg.MediaDir,
+		AlbumsDir: cfg.AlbumsDir,
+		Secret:    cfg.Secret,
+		UserAgent: "jonblog (+" + cfg.BaseURL + ")",
+		snapshots: make(map[string]*snapshot),
+		locks:     make(map[string]*keyLock),
+	}
+	err := os.RemoveAll(pm.Dir)
+	if err != nil {
+		return nil, err
+	}
+	go func() {
+		for range time.Tick(time.Minute) {
+			pm.evict(time.Now().Add(-pm.Idle))
+		}
+	}()
+	return pm, nil
+}
+
+func (pm *PreviewManager) git(args ...string) ([]byte, error) {
+	cmd := exec.Command("git", append([]string{"-C", pm.Repo}, args...)...)
+	var stderr bytes.Buffer
+	cmd.Stderr = &stderr
+	out, err := cmd.Output()
+	if err != nil {
+		return nil, fmt.Errorf("git %s: %w: %s", args[0], err, strings.TrimSpace(stderr.String()))
+	}
+	return out, nil
+}
+
+// refRe limits refs to the characters git allows in branch names, minus the
+// ones with special meaning to rev-parse.
+var refRe = regexp.MustCompile(`^[A-Za-z0-9][A-Za-z0-9._/-]*$`)
+
+// fetchedRef returns the local ref that ref is fetched into. Each ref gets
+// one of its own, since FETCH_HEAD is shared by every fetch.
+func fetchedRef(ref string) string {
+	return "refs/previews/" + hex.EncodeToString([]byte(ref))
+}
+
+// resolve returns the commit ref points to. Refs that aren't known locally,
+// such as pull/12/head, are fetched from origin into refs/previews/, in which
+// case fetched is true.
+func (pm *PreviewManager) resolve(ref string) (commit string, fetched bool, err error) {
+	if !refRe.MatchString(ref) || strings.Contains(ref, "..") {
+		return "", false, errUnknownRef
+	}
+	out, err := pm.git("rev-parse", "--verify", "--quiet", ref+"^{commit}")
+	if err == nil {
+		return strings.TrimSpace(string(out)), false, nil
+	}
+	local := fetchedRef(ref)
+	_, err = pm.git("fetch", "--quiet", "origin", "+"+ref+":"+local)
+	if err != nil {
+		log.Printf("preview: %v", err)
+		return "", false, errUnknownRef
+	}
+	out, err = pm.git("rev-parse", "--verify", "--quiet", local+"^{commit}")
+	if err != nil {
+		return "", false, errUnknownRef
+	}
+	return strings.TrimSpace(string(out)), true, nil
+}
+
+// lock locks key and returns a function that unlocks it.
+func (pm *PreviewManager) lock(key string) func() {
+	pm.mu.Lock()
+	l, ok := pm.locks[key]
+	if !ok {
+		l = &keyLock{}
+		pm.locks[key] = l
+	}
+	l.waiting++
+	pm.mu.Unlock()
+	l.Lock()
+	return func() {
+		l.Unlock()
+		pm.mu.Lock()
+		l.waiting--
+		if l.waiting == 0 {
+			delete(pm.locks, key)
+		}
+		pm.mu.Unlock()
+	}
+}
+
+// snapshot returns the snapshot of ref, extracting it if needed. It is
+// counted as in use until it is passed to release.
+func (pm *PreviewManager) snapshot(ref string) (*snapshot, error) {
+	unlock := pm.lock("ref:" + ref)
+	commit, fetched, err := pm.resolve(ref)
+	unlock()
+	if err != nil {
+		return nil, err
+	}
+	unlock = pm.lock("commit:" + commit)
+	defer unlock()
+	pm.mu.Lock()
+	s, ok := pm.snapshots[commit]
+	if ok {
+		s.use(ref, fetched)
+	}
+	pm.mu.Unlock()
+	if ok {
+		return s, nil
+	}
+	dir := filepath.Join(pm.Dir, commit)
+	err = pm.extract(commit, dir)
+	if err != nil {
+		os.RemoveAll(dir)
+		return nil, err
+	}
+	s = &snapshot{commit: commit, dir: dir, handler: pm.handler(dir)}
+	pm.mu.Lock()
+	s.use(ref, fetched)
+	pm.snapshots[commit] = s
+	pm.mu.Unlock()
+	return s, nil
+}
+
+// use marks the snapshot as used for ref. pm.mu must be held.
+func (s *snapshot) use(ref string, fetched bool) {
+	s.inUse++
+	s.lastUsed = time.Now()
+	if fetched && !slices.Contains(s.fetched, ref) {
+		s.fetched = append(s.fetched, ref)
+	}
+}
+
+// release marks a request for the snapshot as done.
+func (pm *PreviewManager) release(s *snapshot) {
+	pm.mu.Lock()
+	s.inUse--
+	s.lastUsed = time.Now()
+	pm.mu.Unlock()
+}
+
+// extract writes the tree of commit to dir/content using git archive.
+// Symlinks are skipped so a branch can't point outside its snapshot.
+func (pm *PreviewManager) extract(commit, dir string) error {
+	cmd := exec.Command("git", "-C", pm.Repo, "archive", "--format=tar", commit)
+	stdout, err := cmd.StdoutPipe()
+	if err != nil {
+		return err
+	}
+	err = cmd.Start()
+	if err != nil {
+		return err
+	}
+	root := filepath.Join(dir, "content")
+	tr := tar.NewReader(stdout)
+	for {
+		hdr, err := tr.Next()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			cmd.Wait()
+			return err
+		}
+		name := filepath.Clean(filepath.FromSlash(hdr.Name))
+		if !filepath.IsLocal(name) {
+			continue
+		}
+		path := filepath.Join(root, name)
+		switch hdr.Typeflag {
+		case tar.TypeDir:
+			err = os.MkdirAll(path, 0755)
+		case tar.TypeReg:
+			err = writeFile(path, tr)
+		}
+		if err != nil {
+			cmd.Wait()
+			return err
+		}
+	}
+	return cmd.Wait()
+}
+
+func writeFile(path string, r io.Reader) error {
+	err := os.MkdirAll(filepath.Dir(path), 0755)
+	if err != nil {
+		return err
+	}
+	f, err := os.Create(path)
+	if err != nil {
+		return err
+	}
+	_, err = io.Copy(f, r)
+	if cerr := f.Close(); err == nil {
+		err = cerr
+	}
+	return err
+}
+
+// handler serves the read only pages of the site from a snapshot, with its
+// own caches.
+func (pm *PreviewManager) handler(dir string) http.Handler {
+	embeds := &EmbedCache{Dir: filepath.Join(dir, "cache", "embeds"), UserAgent: pm.UserAgent, Secret: pm.Secret}
+	return readOnlyMux(filepath.Join(dir, "content"), filepath.Join(dir, "cache", "images"), pm.MediaDir, pm.AlbumsDir, "", embeds, pm.Icons)
+}
+
+// evict deletes snapshots last used before cutoff that aren't serving any
+// requests, along with the refs fetched for them. Files and refs are removed
+// without holding pm.mu, so other previews aren't held up.
+func (pm *PreviewManager) evict(cutoff time.Time) {
+	idle := func(s *snapshot) bool {
+		return s.inUse == 0 && !s.lastUsed.After(cutoff)
+	}
+	pm.mu.Lock()
+	var commits []string
+	for commit, s := range pm.snapshots {
+		if idle(s) {
+			commits = append(commits, commit)
+		}
+	}
+	pm.mu.Unlock()
+	for _, commit := range commits {
+		// The commit lock keeps the snapshot from being extracted again
+		// while its directory is removed.
+		unlock := pm.lock("commit:" + commit)
+		pm.mu.Lock()
+		s, ok := pm.snapshots[commit]
+		ok = ok && idle(s)
+		if ok {
+			delete(pm.snapshots, commit)
+		}
+		pm.mu.Unlock()
+		if ok {
+			pm.remove(s)
+		}
+		unlock()
+	}
+}
+
+// remove deletes the files of an evicted snapshot and the refs fetched for
+// it, unless they have since been fetched again and point somewhere else.
+func (pm *PreviewManager) remove(s *snapshot) {
+	err := os.RemoveAll(s.dir)
+	if err != nil {
+		log.Printf("preview: removing %s: %v", s.dir, err)
+	}
+	for _, ref := range s.fetched {
+		unlock := pm.lock("ref:" + ref)
+		pm.git("update-ref", "-d", fetchedRef(ref), s.commit)
+		unlock()
+	}
+}
+
+// Handler serves /preview/{ref}/{rest...}. Private posts are viewable, since
+// only admins can reach previews.
+func (pm *PreviewManager) Handler() http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		ref := r.PathValue("ref")
+		s, err := pm.snapshot(ref)
+		if errors.Is(err, errUnknownRef) {
+			http.Error(w, "Unknown ref", http.StatusNotFound)
+			return
+		}
+		if err != nil {
+			log.Printf("preview: %s: %v", ref, err)
+			http.Error(w, "Error creating preview", http.StatusInternalServerError)
+			return
+		}
+		defer pm.release(s)
+		r = r.Clone(context.WithValue(r.Context(), previewKey{}, true))
+		r.URL.Path = "/" + r.PathValue("rest")
+		r.URL.RawPath = ""
+		pw := &previewWriter{ResponseWriter: w, status: http.StatusOK}
+		s.handler.ServeHTTP(pw, r)
+		pw.finish(ref, s.commit)
+	}
+}
+
+// previewWriter buffers a response from a snapshot so that links in it can be
+// pointed back into the preview, and a banner added to HTML pages.
+type previewWriter struct {
+	http.ResponseWriter
+	status int
+	buf    bytes.Buffer
+}
+
+func (pw *previewWriter) WriteHeader(status int) {
+	pw.status = status
+}
+
+func (pw *previewWriter) Write(b []byte) (int, error) {
+	return pw.buf.Write(b)
+}
+
+// localURLRe matches attributes holding a site relative URL, but not a
+// protocol relative one.
+var localURLRe = regexp.MustCompile(`\b(href|src)="/([^/"])`)
+
+var previewBannerTpl = template.Must(template.New("banner").Parse(`<div class="bg-yellow-300 text-yellow-900 text-center text-sm p-2">Preview of <strong>{{.Ref}}</strong> at <code>{{.Commit}}</code>. This is not what readers see.</div>`))
+
+func (pw *previewWriter) finish(ref, commit string) {
+	prefix := "/preview/" + url.PathEscape(ref)
+	h := pw.Header()
+	if loc := h.Get("Location"); strings.HasPrefix(loc, "/") && !strings.HasPrefix(loc, "//") {
+		h.Set("Location", prefix+loc)
+	}
+	body := pw.buf.Bytes()
+	if h.Get("Content-Type") == "" && pw.status == http.StatusOK {
+		h.Set("Content-Type", http.DetectContentType(body))
+	}
+	if strings.HasPrefix(h.Get("Content-Type"), "text/html") {
+		body = localURLRe.ReplaceAll(body, []byte(`$1="`+prefix+`/$2`))
+		if i := bytes.Index(body, []byte("<body")); i >= 0 {
+			if j := bytes.IndexByte(body[i:], '>'); j >= 0 {
+				var out bytes.Buffer
+				out.Write(body[:i+j+1])
+				previewBannerTpl.Execute(&out, struct{ Ref, Commit string }{ref, commit[:7]})
+				out.Write(body[i+j+1:])
+				body = out.Bytes()
+			}
+		}
+		h.Del("Content-Length")
+	}
+	pw.ResponseWriter.WriteHeader(pw.status)
+	pw.ResponseWriter.Write(body)
+}
@@ -0,0 +1,92 @@
+package main
+
+import (
+	"os"
+	"os/exec"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+// gitRun runs git in dir, failing the test if it fails.
+func gitRun(t *testing.T, dir string, args ...string) string {
+	t.Helper()
+	cmd := exec.Command("git", append([]string{"-C", dir}, args...)...)
+	cmd.Env = append(os.Environ(),
+		"GIT_AUTHOR_NAME=test", "GIT_AUTHOR_EMAIL=test@example.com",
+		"GIT_COMMITTER_NAME=test", "GIT_COMMITTER_EMAIL=test@example.com",
+	)
+	out, err := cmd.CombinedOutput()
+	if err != nil {
+		t.Fatalf("git %v: %v: %s", args, err, out)
+	}
+	return string(out)
+}
+
+func TestPreviewEvict(t *testing.T) {
+	if _, err := exec.LookPath("git"); err != nil {
+		t.Skip("git is not installed")
+	}
+	origin := t.TempDir()
+	gitRun(t, origin, "init", "--quiet", "-b", "main")
+	writeFiles(t, origin, map[string]string{"post.md": "+++\ntitle = \"Post\"\n+++\nOn main.\n"})
+	gitRun(t, origin, "add", ".")
+	gitRun(t, origin, "commit", "--quiet", "-m", "main")
+	repo := filepath.Join(t.TempDir(), "repo")
+	gitRun(t, origin, "clone", "--quiet", origin, repo)
+	// The branch is only on origin, so previewing it fetches it.
+	gitRun(t, origin, "checkout", "--quiet", "-b", "feature")
+	writeFiles(t, origin, map[string]string{"post.md": "+++\ntitle = \"Post\"\n+++\nOn feature.\n"})
+	gitRun(t, origin, "commit", "--quiet", "-am", "feature")
+
+	pm := &PreviewManager{
+		Repo:      repo,
+		Dir:       t.TempDir(),
+		snapshots: make(map[string]*snapshot),
+		locks:     make(map[string]*keyLock),
+	}
+	s, err := pm.snapshot("feature")
+	if err != nil {
+		t.Fatalf("snapshot() error = %v", err)
+	}
+	refs := func() string {
+		return gitRun(t, repo, "for-each-ref", "refs/previews/")
+	}
+	if refs() == "" {
+		t.Fatalf("no ref was fetched for feature")
+	}
+
+	// The snapshot is still serving a request, so it stays.
+	pm.evict(time.Now().Add(time.Hour))
+	if _, err := os.Stat(s.dir); err != nil {
+		t.Fatalf("in use snapshot was evicted: %v", err)
+	}
+
+	pm.release(s)
+	pm.evict(time.Now().Add(-time.Hour))
+	if _, err := os.Stat(s.dir); err != nil {
+		t.Fatalf("recently used snapshot was evicted: %v", err)
+	}
+
+	pm.evict(time.Now().Add(time.Hour))
+	if _, err := os.Stat(s.dir); !os.IsNotExist(err) {
+		t.Errorf("snapshot directory still exists after eviction: %v", err)
+	}
+	if len(pm.snapshots) != 0 {
+		t.Errorf("snapshots = %v, want none", pm.snapshots)
+	}
+	if got := refs(); got != "" {
+		t.Errorf("refs left after eviction: %s", got)
+	}
+
+	// Previewing it again fetches it again.
+	s, err = pm.snapshot("feature")
+	if err != nil {
+		t.Fatalf("snapshot() after eviction error = %v", err)
+	}
+	pm.release(s)
+	data, err := os.ReadFile(filepath.Join(s.dir, "content", "post.md"))
+	if err != nil || string(data) != "+++\ntitle = \"Post\"\n+++\nOn feature.\n" {
+		t.Errorf("post.md = %q, %v, want the feature branch's", data, err)
+	}
+}
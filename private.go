@@ -0,0 +1,86 @@
+package main
+
+import (
+	"context"
+	"html/template"
+	"net/http"
+	"strings"
+)
+
+// Private blocks hold notes an author leaves for themselves, such as TODOs in
+// a draft:
+//
+//	{{< private >}}
+//	TODO: check these numbers against the benchmark.
+//	{{< /private >}}
+//
+// They are shown highlighted in dev mode and signed previews, and left out of
+// everything else, including the code files and cards built from the raw
+// markdown.
+const privateShortcode = "private"
+
+func init() {
+	shortcodes[privateShortcode] = shortcodeDef{paired: true, render: renderPrivate}
+}
+
+var privateTpl = template.Must(template.New("private").Parse(`<aside class="not-prose bg-yellow-100 border-l-4 border-yellow-400 text-yellow-900 p-4 my-4" title="Only shown in previews">
+  <p class="text-xs font-semibold uppercase">Private note</p>
+  <div class="prose max-w-full">{{.}}</div>
+</aside>`))
+
+func renderPrivate(sc Shortcode, rc *RenderContext) (template.HTML, error) {
+	if rc.Request == nil || !(isPreview(rc.Request) || isDev(rc.Request)) {
+		return "", nil
+	}
+	inner, err := renderFragment(rc, []byte(sc.Inner))
+	if err != nil {
+		return "", err
+	}
+	var b strings.Builder
+	err = privateTpl.Execute(&b, inner)
+	if err != nil {
+		return "", err
+	}
+	return template.HTML(b.String()), nil
+}
+
+// blankPrivate replaces the lines of every private block with empty lines, so
+// line numbers still match the source.
+func blankPrivate(src []byte) []byte {
+	lines := strings.Split(string(src), "\n")
+	for _, span := range findShortcodes(lines) {
+		if span.sc.Name != privateShortcode {
+			continue
+		}
+		for i := span.start; i <= span.end; i++ {
+			lines[i] = ""
+		}
+	}
+	return []byte(strings.Join(lines, "\n"))
+}
+
+// hasPrivate reports whether src contains a private block.
+func hasPrivate(src []byte) bool {
+	for _, span := range findShortcodes(strings.Split(string(src), "\n")) {
+		if span.sc.Name == privateShortcode {
+			return true
+		}
+	}
+	return false
+}
+
+type devKey struct{}
+
+// DevMode marks every request as coming from the author's own machine, so
+// private blocks are shown. It is enabled by setting dev = true in the config
+// and must never be used in production.
+func DevMode(next http.Handler) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		next.ServeHTTP(w, r.WithContext(context.WithValue(r.Context(), devKey{}, true)))
+	}
+}
+
+func isDev(r *http.Request) bool {
+	dev, _ := r.Context().Value(devKey{}).(bool)
+	return dev
+}
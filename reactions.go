@@ -0,0 +1,157 @@
+package main
+
+import (
+	"errors"
+	"net/http"
+	"slices"
+	"sort"
+	"strings"
+	"time"
+)
+
+// ipWindow is how long a hashed IP address blocks repeat votes from the same
+// network, which catches visitors that simply clear their cookies.
+const ipWindow = 24 * time.Hour
+
+const (
+	// visitorWindow is how long a visitor's reaction is remembered. After
+	// that they may react again, which keeps the record from growing forever.
+	visitorWindow = 30 * 24 * time.Hour
+	// maxSeen caps how many identities are remembered. The oldest are
+	// forgotten first.
+	maxSeen = 50000
+)
+
+var errAlreadyCounted = errors.New("already counted")
+
+// ReactionCount is a single emoji and how many readers reacted with it.
+type ReactionCount struct {
+	Emoji string
+	Count int
+}
+
+type reactionData struct {
+	// Counts maps slug to emoji to count.
+	Counts map[string]map[string]int `json:"counts"`
+	// Seen records which visitors and hashed IP windows have already reacted,
+	// keyed by slug, emoji and identity, along with when they did so. See
+	// pruneSeen for how long they are kept.
+	Seen map[string]time.Time `json:"seen"`
+}
+
+// ReactionStore counts per-post reactions from a configurable set of emoji.
+type ReactionStore struct {
+	Emoji  []string
+	Secret string
+
+	file    *JSONFile[reactionData]
+	limiter *RateLimiter
+}
+
+func NewReactionStore(path string, emoji []string, secret string) (*ReactionStore, error) {
+	file, err := OpenJSONFile[reactionData](path)
+	if err != nil {
+		return nil, err
+	}
+	return &ReactionStore{
+		Emoji:   emoji,
+		Secret:  secret,
+		file:    file,
+		limiter: &RateLimiter{Limit: 20, Window: time.Minute},
+	}, nil
+}
+
+// Counts returns the reaction counts for a post in the configured order.
+func (rs *ReactionStore) Counts(slug string) []ReactionCount {
+	counts := make([]ReactionCount, 0, len(rs.Emoji))
+	rs.file.View(func(data *reactionData) {
+		for _, e := range rs.Emoji {
+			counts = append(counts, ReactionCount{Emoji: e, Count: data.Counts[slug][e]})
+		}
+	})
+	return counts
+}
+
+// Add records a reaction unless the visitor or their hashed IP has already
+// used that emoji on the post.
+func (rs *ReactionStore) Add(slug, emoji, visitor, ipKey string) error {
+	return rs.file.Update(func(data *reactionData) error {
+		if data.Counts == nil {
+			data.Counts = make(map[string]map[string]int)
+			data.Seen = make(map[string]time.Time)
+		}
+		now := time.Now()
+		pruneSeen(data.Seen, now)
+		visitorKey := "v|" + slug + "|" + emoji + "|" + visitor
+		ipSeenKey := "ip|" + slug + "|" + emoji + "|" + ipKey
+		if _, ok := data.Seen[visitorKey]; ok {
+			return errAlreadyCounted
+		}
+		if _, ok := data.Seen[ipSeenKey]; ok {
+			return errAlreadyCounted
+		}
+		data.Seen[visitorKey] = now
+		data.Seen[ipSeenKey] = now
+		if data.Counts[slug] == nil {
+			data.Counts[slug] = make(map[string]int)
+		}
+		data.Counts[slug][emoji]++
+		return nil
+	})
+}
+
+// pruneSeen forgets the identities in seen that have expired, and the oldest
+// ones when there are more than maxSeen. Keys start with "ip|" for hashed IP
+// windows and "v|" for visitors.
+func pruneSeen(seen map[string]time.Time, now time.Time) {
+	for k, t := range seen {
+		window := visitorWindow
+		if strings.HasPrefix(k, "ip|") {
+			window = ipWindow
+		}
+		if now.Sub(t) > window {
+			delete(seen, k)
+		}
+	}
+	if len(seen) <= maxSeen {
+		return
+	}
+	keys := make([]string, 0, len(seen))
+	for k := range seen {
+		keys = append(keys, k)
+	}
+	sort.Slice(keys, func(i, j int) bool {
+		return seen[keys[i]].Before(seen[keys[j]])
+	})
+	for _, k := range keys[:len(keys)-maxSeen] {
+		delete(seen, k)
+	}
+}
+
+// ReactHandler accepts a reaction to a post from a form POST and redirects
+// back to the post.
+func ReactHandler(sl SlugReader, rs *ReactionStore) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		slug := r.PathValue("slug")
+		if _, err := sl.Read(slug); err != nil {
+			http.Error(w, "Post not found", http.StatusNotFound)
+			return
+		}
+		emoji := r.FormValue("emoji")
+		if !slices.Contains(rs.Emoji, emoji) {
+			http.Error(w, "Unknown reaction", http.StatusBadRequest)
+			return
+		}
+		if !rs.limiter.Allow(clientIP(r)) {
+			http.Error(w, "Too many requests", http.StatusTooManyRequests)
+			return
+		}
+		visitor := visitorID(w, r, rs.Secret)
+		err := rs.Add(slug, emoji, visitor, ipWindowKey(r, rs.Secret, ipWindow))
+		if err != nil && !errors.Is(err, errAlreadyCounted) {
+			http.Error(w, "Error saving reaction", http.StatusInternalServerError)
+			return
+		}
+		http.Redirect(w, r, "/posts/"+slug+"#reactions", http.StatusSeeOther)
+	}
+}
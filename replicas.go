@@ -0,0 +1,481 @@
+package main
+
+import (
+	"container/list"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"html/template"
+	"log"
+	"maps"
+	"net/http"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// When several servers serve the same content, each is a replica. Every
+// change to the content, whether made through the admin pages or deployed
+// with git and announced with `jonblog invalidate`, gets a new content
+// version. Replicas learn about new versions through a Coordinator and drop
+// anything they rendered from older content.
+//
+// Versions are the time they were created, in nanoseconds, so the newest one
+// always wins. The version "" is the content as it was when the replica
+// started.
+//
+// Cached renders are keyed by a hash of the post's source, so an edited post
+// never hits a render of its old source, version or not. The version covers
+// what a render reads besides its source: the shortcodes and plugins it runs,
+// which may come to depend on other content. Today they only see the post
+// they are in, so a new version mostly just empties the cache.
+//
+// Previews need no invalidating: each snapshot is the tree of a single
+// commit, and the branch being previewed is resolved again on every request,
+// so a push or deploy gets a new snapshot rather than changing an old one.
+type Coordinator interface {
+	// Publish tells every replica about version.
+	Publish(version string) error
+	// Watch calls fn with the newest version the replicas know of, if any,
+	// and again whenever a newer one may have been published. It returns
+	// after the first check.
+	Watch(fn func(version string))
+	// Ready reports whether this replica has caught up with the others.
+	Ready() bool
+}
+
+// NewCoordinator returns the Coordinator set up in cfg. Without one, content
+// changes only reach this replica.
+func NewCoordinator(cfg ReplicaConfig, secret string) (Coordinator, error) {
+	switch {
+	case cfg.Dir != "" && len(cfg.Peers) > 0:
+		return nil, errors.New("replicas: set either dir or peers, not both")
+	case cfg.Dir != "":
+		return &dirCoordinator{path: filepath.Join(cfg.Dir, "version")}, nil
+	case len(cfg.Peers) > 0:
+		return &peerCoordinator{peers: cfg.Peers, secret: secret, client: &http.Client{Timeout: 5 * time.Second}, id: randomSecret()}, nil
+	}
+	return localCoordinator{}, nil
+}
+
+func newVersion() string {
+	return strconv.FormatInt(time.Now().UnixNano(), 10)
+}
+
+// newerVersion reports whether version a is newer than b.
+func newerVersion(a, b string) bool {
+	x, _ := strconv.ParseInt(a, 10, 64)
+	y, _ := strconv.ParseInt(b, 10, 64)
+	return x > y
+}
+
+type localCoordinator struct{}
+
+func (localCoordinator) Publish(version string) error  { return nil }
+func (localCoordinator) Watch(fn func(version string)) {}
+func (localCoordinator) Ready() bool                   { return true }
+
+// dirCoordinator keeps the version in a file in a directory every replica
+// can reach, such as a network mount, and checks it every second. The
+// replica is ready once it has read the file, or found there is none yet.
+type dirCoordinator struct {
+	path string
+
+	mu    sync.Mutex
+	ready bool
+}
+
+func (dc *dirCoordinator) Publish(version string) error {
+	err := os.MkdirAll(filepath.Dir(dc.path), 0755)
+	if err != nil {
+		return err
+	}
+	tmp := fmt.Sprintf("%s.%d.tmp", dc.path, os.Getpid())
+	err = os.WriteFile(tmp, []byte(version+"\n"), 0644)
+	if err != nil {
+		return err
+	}
+	return os.Rename(tmp, dc.path)
+}
+
+func (dc *dirCoordinator) Watch(fn func(version string)) {
+	check := func() {
+		b, err := os.ReadFile(dc.path)
+		if err != nil && !errors.Is(err, os.ErrNotExist) {
+			log.Printf("replicas: %v", err)
+			return
+		}
+		if err == nil {
+			fn(strings.TrimSpace(string(b)))
+		}
+		dc.mu.Lock()
+		dc.ready = true
+		dc.mu.Unlock()
+	}
+	check()
+	go func() {
+		for range time.Tick(time.Second) {
+			check()
+		}
+	}()
+}
+
+func (dc *dirCoordinator) Ready() bool {
+	dc.mu.Lock()
+	defer dc.mu.Unlock()
+	return dc.ready
+}
+
+// peerCoordinator sends new versions to every replica over HTTP. Peers should
+// list every replica, this one included, and all of them must share the same
+// secret. Replicas also ask each other for their version on startup and every
+// half minute, so one that missed a broadcast catches up.
+//
+// A replica is ready once it hears from another one. If none answer after
+// maxFailedSyncs tries, it is ready anyway, since it may be the only one
+// running, such as after restarting while the others are drained.
+//
+// Each replica has a random id, which /readyz reports, so a replica can tell
+// which of the peers is itself and stop asking it.
+type peerCoordinator struct {
+	peers  []string
+	secret string
+	client *http.Client
+	id     string
+
+	mu sync.Mutex
+	fn func(version string)
+	// self is the peer found to be this replica, if any.
+	self string
+	// ready is set by the first sync that hears from another replica.
+	ready bool
+	// failedSyncs counts the syncs that heard from no one.
+	failedSyncs int
+}
+
+// maxFailedSyncs is how many syncs in a row may hear from no other replica
+// before a replica stops waiting for them. Syncs are two seconds apart until
+// then.
+const maxFailedSyncs = 5
+
+// others returns the peers other than this replica.
+func (pc *peerCoordinator) others() []string {
+	pc.mu.Lock()
+	defer pc.mu.Unlock()
+	var peers []string
+	for _, peer := range pc.peers {
+		if peer != pc.self {
+			peers = append(peers, peer)
+		}
+	}
+	return peers
+}
+
+// Publish sends version to every other peer, trying each a few times.
+func (pc *peerCoordinator) Publish(version string) error {
+	form := url.Values{"version": {version}, "sig": {sign(pc.secret, "version:"+version)}}
+	peers := pc.others()
+	errs := make([]error, len(peers))
+	var wg sync.WaitGroup
+	for i, peer := range peers {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for attempt := 0; attempt < 3; attempt++ {
+				if attempt > 0 {
+					time.Sleep(time.Duration(attempt) * time.Second)
+				}
+				var resp *http.Response
+				resp, errs[i] = pc.client.PostForm(strings.TrimSuffix(peer, "/")+"/replicas/version", form)
+				if errs[i] != nil {
+					continue
+				}
+				resp.Body.Close()
+				if resp.StatusCode != http.StatusNoContent {
+					errs[i] = fmt.Errorf("%s: %s", peer, resp.Status)
+					continue
+				}
+				break
+			}
+		}()
+	}
+	wg.Wait()
+	return errors.Join(errs...)
+}
+
+func (pc *peerCoordinator) Watch(fn func(version string)) {
+	pc.mu.Lock()
+	pc.fn = fn
+	pc.mu.Unlock()
+	pc.sync()
+	go func() {
+		for {
+			// Until it is ready, the replica keeps trying every few seconds,
+			// since its peers may have been starting up too.
+			wait := 30 * time.Second
+			if !pc.Ready() {
+				wait = 2 * time.Second
+			}
+			time.Sleep(wait)
+			pc.sync()
+		}
+	}()
+}
+
+func (pc *peerCoordinator) Ready() bool {
+	pc.mu.Lock()
+	defer pc.mu.Unlock()
+	return pc.ready
+}
+
+// sync asks the other peers for their version, all at once, and passes on
+// the newest. Peers that aren't ready yet still report their version, so
+// replicas starting together become ready together.
+func (pc *peerCoordinator) sync() {
+	peers := pc.others()
+	var mu sync.Mutex
+	newest, heard := "", false
+	var wg sync.WaitGroup
+	for _, peer := range peers {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			resp, err := pc.client.Get(strings.TrimSuffix(peer, "/") + "/readyz")
+			if err != nil {
+				return
+			}
+			defer resp.Body.Close()
+			var status readyStatus
+			err = json.NewDecoder(resp.Body).Decode(&status)
+			if err != nil {
+				return
+			}
+			mu.Lock()
+			defer mu.Unlock()
+			if status.Replica == pc.id {
+				pc.mu.Lock()
+				pc.self = peer
+				pc.mu.Unlock()
+				return
+			}
+			heard = true
+			if newerVersion(status.Version, newest) {
+				newest = status.Version
+			}
+		}()
+	}
+	wg.Wait()
+	if newest != "" {
+		pc.notify(newest)
+	}
+	pc.mu.Lock()
+	defer pc.mu.Unlock()
+	// A replica that is its only peer has no one to catch up with.
+	if heard || (pc.self != "" && len(pc.peers) == 1) {
+		pc.ready = true
+		return
+	}
+	pc.failedSyncs++
+	if !pc.ready && pc.failedSyncs >= maxFailedSyncs {
+		log.Printf("replicas: no other replica answered after %d tries, serving anyway", pc.failedSyncs)
+		pc.ready = true
+	}
+}
+
+func (pc *peerCoordinator) notify(version string) {
+	pc.mu.Lock()
+	fn := pc.fn
+	pc.mu.Unlock()
+	if fn != nil {
+		fn(version)
+	}
+}
+
+// Handler receives versions published by other replicas.
+func (pc *peerCoordinator) Handler() http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		version := r.FormValue("version")
+		if !verify(pc.secret, "version:"+version, r.FormValue("sig")) {
+			http.Error(w, "Invalid signature", http.StatusForbidden)
+			return
+		}
+		pc.notify(version)
+		w.WriteHeader(http.StatusNoContent)
+	}
+}
+
+// Replica tracks the content version this server is serving, and caches
+// posts rendered from it.
+type Replica struct {
+	coord Coordinator
+
+	mu      sync.Mutex
+	version string
+	renders renderCache
+}
+
+type cachedRender struct {
+	key      string
+	html     template.HTML
+	frameSrc map[string]bool
+}
+
+// maxCachedRenders bounds the render cache. Edited posts leave their old
+// renders behind until the next version, so the least recently used render
+// is dropped when it is full.
+const maxCachedRenders = 1000
+
+// renderCache holds rendered posts, most recently used first. The zero value
+// is an empty cache.
+type renderCache struct {
+	entries map[string]*list.Element
+	order   list.List
+}
+
+func (c *renderCache) get(key string) (cachedRender, bool) {
+	e, ok := c.entries[key]
+	if !ok {
+		return cachedRender{}, false
+	}
+	c.order.MoveToFront(e)
+	return e.Value.(cachedRender), true
+}
+
+func (c *renderCache) put(cr cachedRender) {
+	if c.entries == nil {
+		c.entries = make(map[string]*list.Element)
+	}
+	if e, ok := c.entries[cr.key]; ok {
+		e.Value = cr
+		c.order.MoveToFront(e)
+		return
+	}
+	if c.order.Len() >= maxCachedRenders {
+		oldest := c.order.Back()
+		c.order.Remove(oldest)
+		delete(c.entries, oldest.Value.(cachedRender).key)
+	}
+	c.entries[cr.key] = c.order.PushFront(cr)
+}
+
+func (c *renderCache) clear() {
+	clear(c.entries)
+	c.order.Init()
+}
+
+func (c *renderCache) len() int {
+	return c.order.Len()
+}
+
+// NewReplica returns a replica that follows the versions published through
+// coord.
+func NewReplica(coord Coordinator) *Replica {
+	rp := &Replica{coord: coord}
+	coord.Watch(rp.apply)
+	return rp
+}
+
+// apply switches to version if it is newer than the current one.
+func (rp *Replica) apply(version string) {
+	rp.mu.Lock()
+	defer rp.mu.Unlock()
+	if !newerVersion(version, rp.version) {
+		return
+	}
+	log.Printf("replicas: content version %s", version)
+	rp.version = version
+	rp.renders.clear()
+}
+
+// Changed records that the content changed on this replica and tells the
+// others.
+func (rp *Replica) Changed() {
+	version := newVersion()
+	rp.apply(version)
+	go func() {
+		err := rp.coord.Publish(version)
+		if err != nil {
+			log.Printf("replicas: publishing %s: %v", version, err)
+		}
+	}()
+}
+
+// Invalidates calls Changed after next handles a request successfully. It
+// wraps the admin actions that edit content, of which applying a correction
+// is the only one. Drafts sent by email go to the drafts directory, which is
+// never cached.
+func (rp *Replica) Invalidates(next http.Handler) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		sw := &statusWriter{ResponseWriter: w, status: http.StatusOK}
+		next.ServeHTTP(sw, r)
+		if sw.status < http.StatusBadRequest {
+			rp.Changed()
+		}
+	}
+}
+
+// renderMarkdown is renderMarkdown with a cache. Pages that depend on who is
+// reading them, such as previews and posts with polls, are never cached.
+func (rp *Replica) renderMarkdown(rc *RenderContext, src []byte) (template.HTML, error) {
+	if rp == nil || (rc.Request != nil && (isPreview(rc.Request) || isDev(rc.Request))) {
+		return renderMarkdown(rc, src)
+	}
+	sum := sha256.Sum256(src)
+	key := rc.Slug + "|" + rc.Style + "|" + hex.EncodeToString(sum[:])
+	rp.mu.Lock()
+	cached, ok := rp.renders.get(key)
+	version := rp.version
+	rp.mu.Unlock()
+	if ok {
+		for origin := range cached.frameSrc {
+			rc.allowFrame(origin)
+		}
+		return cached.html, nil
+	}
+	html, err := renderMarkdown(rc, src)
+	if err != nil || rc.noCache {
+		return html, err
+	}
+	rp.mu.Lock()
+	defer rp.mu.Unlock()
+	// A render that started before a new version may have read the old
+	// content, so it isn't kept.
+	if rp.version != version {
+		return html, nil
+	}
+	rp.renders.put(cachedRender{key: key, html: html, frameSrc: maps.Clone(rc.frameSrc)})
+	return html, nil
+}
+
+type readyStatus struct {
+	Version string `json:"version"`
+	// Replica is the id of a replica using peers.
+	Replica string `json:"replica,omitempty"`
+}
+
+// ReadyHandler serves /readyz, which reports the content version the replica
+// is serving. It responds with 503 Service Unavailable until the replica has
+// caught up with the others, so load balancers hold off sending it readers.
+// The body is the same either way, since peers read it to sync.
+func (rp *Replica) ReadyHandler() http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		rp.mu.Lock()
+		status := readyStatus{Version: rp.version}
+		rp.mu.Unlock()
+		if pc, ok := rp.coord.(*peerCoordinator); ok {
+			status.Replica = pc.id
+		}
+		w.Header().Set("Content-Type", "application/json")
+		w.Header().Set("Cache-Control", "no-store")
+		if !rp.coord.Ready() {
+			w.WriteHeader(http.StatusServiceUnavailable)
+		}
+		json.NewEncoder(w).Encode(status)
+	}
+}
@@ -0,0 +1,168 @@
+package main
+
+import (
+	"html/template"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"testing"
+	"time"
+)
+
+func TestReplicaRenderDuringNewVersion(t *testing.T) {
+	rp := &Replica{coord: localCoordinator{}}
+	// The shortcode stands in for a new version arriving mid-render.
+	shortcodes["zz-new-version"] = shortcodeDef{render: func(sc Shortcode, rc *RenderContext) (template.HTML, error) {
+		rp.apply(newVersion())
+		return "", nil
+	}}
+	t.Cleanup(func() { delete(shortcodes, "zz-new-version") })
+
+	r := httptest.NewRequest(http.MethodGet, "/posts/a", nil)
+	_, err := rp.renderMarkdown(&RenderContext{Slug: "a", Request: r}, []byte("Hello\n\n{{< zz-new-version >}}\n"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if rp.renders.len() != 0 {
+		t.Errorf("render from before the new version was cached")
+	}
+	_, err = rp.renderMarkdown(&RenderContext{Slug: "b", Request: r}, []byte("Hello"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if rp.renders.len() != 1 {
+		t.Errorf("render cache has %d entries, want 1", rp.renders.len())
+	}
+}
+
+// testPeers starts n replicas using peerCoordinators that list each other,
+// without their background syncs.
+func testPeers(t *testing.T, n int) ([]*Replica, []*peerCoordinator, []*httptest.Server) {
+	t.Helper()
+	var replicas []*Replica
+	var coords []*peerCoordinator
+	var servers []*httptest.Server
+	var peers []string
+	for i := 0; i < n; i++ {
+		mux := http.NewServeMux()
+		srv := httptest.NewServer(mux)
+		t.Cleanup(srv.Close)
+		pc := &peerCoordinator{secret: "s3", client: &http.Client{Timeout: time.Second}, id: randomSecret()}
+		rp := &Replica{coord: pc}
+		pc.fn = rp.apply
+		mux.HandleFunc("GET /readyz", rp.ReadyHandler())
+		mux.HandleFunc("POST /replicas/version", pc.Handler())
+		peers = append(peers, srv.URL)
+		replicas = append(replicas, rp)
+		coords = append(coords, pc)
+		servers = append(servers, srv)
+	}
+	for _, pc := range coords {
+		pc.peers = peers
+	}
+	return replicas, coords, servers
+}
+
+func readyz(t *testing.T, srv *httptest.Server) int {
+	t.Helper()
+	resp, err := http.Get(srv.URL + "/readyz")
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+	return resp.StatusCode
+}
+
+func TestPeerSync(t *testing.T) {
+	t.Run("catches up before ready", func(t *testing.T) {
+		replicas, coords, servers := testPeers(t, 3)
+		replicas[2].apply("1700000000000000000")
+		if got := readyz(t, servers[0]); got != http.StatusServiceUnavailable {
+			t.Errorf("readyz before sync = %d, want %d", got, http.StatusServiceUnavailable)
+		}
+		coords[0].sync()
+		if got := readyz(t, servers[0]); got != http.StatusOK {
+			t.Errorf("readyz after sync = %d, want %d", got, http.StatusOK)
+		}
+		if replicas[0].version != "1700000000000000000" {
+			t.Errorf("version = %q, want the newest peer's", replicas[0].version)
+		}
+		if coords[0].self != servers[0].URL {
+			t.Errorf("self = %q, want %q", coords[0].self, servers[0].URL)
+		}
+		if got := coords[0].others(); len(got) != 2 || got[0] != servers[1].URL || got[1] != servers[2].URL {
+			t.Errorf("others() = %q, want the other two peers", got)
+		}
+	})
+
+	t.Run("only peer", func(t *testing.T) {
+		_, coords, servers := testPeers(t, 1)
+		coords[0].sync()
+		if got := readyz(t, servers[0]); got != http.StatusOK {
+			t.Errorf("readyz = %d, want %d", got, http.StatusOK)
+		}
+	})
+
+	t.Run("other peers down", func(t *testing.T) {
+		_, coords, servers := testPeers(t, 2)
+		servers[1].Close()
+		coords[0].sync()
+		if got := readyz(t, servers[0]); got != http.StatusServiceUnavailable {
+			t.Errorf("readyz = %d, want %d", got, http.StatusServiceUnavailable)
+		}
+	})
+
+	t.Run("every peer unreachable", func(t *testing.T) {
+		_, coords, servers := testPeers(t, 3)
+		for _, srv := range servers {
+			srv.Close()
+		}
+		for i := 1; i <= maxFailedSyncs; i++ {
+			coords[0].sync()
+			if got, want := coords[0].Ready(), i == maxFailedSyncs; got != want {
+				t.Errorf("Ready() after %d syncs = %t, want %t", i, got, want)
+			}
+		}
+	})
+
+	t.Run("publish", func(t *testing.T) {
+		replicas, coords, _ := testPeers(t, 2)
+		coords[0].sync()
+		replicas[0].apply("1700000000000000001")
+		err := coords[0].Publish("1700000000000000001")
+		if err != nil {
+			t.Fatal(err)
+		}
+		if replicas[1].version != "1700000000000000001" {
+			t.Errorf("peer version = %q, want the published one", replicas[1].version)
+		}
+	})
+}
+
+func TestRenderCache(t *testing.T) {
+	var c renderCache
+	for i := 0; i < maxCachedRenders; i++ {
+		c.put(cachedRender{key: strconv.Itoa(i)})
+	}
+	// Using the oldest render makes the second oldest the one to go.
+	if _, ok := c.get("0"); !ok {
+		t.Fatal("get(0) missed")
+	}
+	c.put(cachedRender{key: "new"})
+	if c.len() != maxCachedRenders {
+		t.Errorf("len() = %d, want %d", c.len(), maxCachedRenders)
+	}
+	for key, want := range map[string]bool{"0": true, "1": false, "2": true, "new": true} {
+		if _, ok := c.get(key); ok != want {
+			t.Errorf("get(%s) found = %t, want %t", key, ok, want)
+		}
+	}
+	c.put(cachedRender{key: "new", html: "replaced"})
+	if got, _ := c.get("new"); got.html != "replaced" || c.len() != maxCachedRenders {
+		t.Errorf("put() of an existing key = %q with %d entries, want it replaced in place", got.html, c.len())
+	}
+	c.clear()
+	if _, ok := c.get("0"); ok || c.len() != 0 {
+		t.Errorf("clear() left %d entries", c.len())
+	}
+}
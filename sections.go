@@ -0,0 +1,247 @@
+package main
+
+import (
+	"errors"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Posts can be organised into sections: subdirectories of a FileReader's Dir
+// that contain an _index.toml or _index.md file. The index file sets defaults
+// for every post beneath it, and nested sections override their parents.
+// Directories without an index file, such as the drafts and media
+// directories, are never searched for posts.
+const (
+	indexTOML = "_index.toml"
+	indexMD   = "_index.md"
+)
+
+// SectionReader is implemented by SlugReaders that support section defaults.
+type SectionReader interface {
+	// Defaults returns the frontmatter of every section the post is in, from
+	// the outermost section to the innermost.
+	Defaults(slug string) ([]Defaults, error)
+}
+
+// Defaults is the frontmatter of a section index file.
+type Defaults struct {
+	Path string
+	// Frontmatter is in the same +++ delimited form used by posts.
+	Frontmatter string
+}
+
+func validSlug(slug string) bool {
+	return slug != "" && !strings.ContainsAny(slug, `/\`) && !strings.Contains(slug, "..")
+}
+
+func isSection(dir string) bool {
+	for _, name := range []string{indexTOML, indexMD} {
+		if _, err := os.Stat(filepath.Join(dir, name)); err == nil {
+			return true
+		}
+	}
+	return false
+}
+
+// isDocs reports whether dir is a docs section. Docs pages are served by
+// DocsHandler rather than as posts.
+func isDocs(dir string) bool {
+	idx, _, ok, err := readIndex(dir)
+	return err == nil && ok && idx.Type == docsType
+}
+
+// walk calls fn with the slug and path of every post in Dir and its sections,
+// in lexical order.
+func (fsr FileReader) walk(fn func(slug, path string)) error {
+	return fsr.walkDirs(fn, nil)
+}
+
+// walkDirs is walk that also calls dirFn with every directory it looks at,
+// whether it is a section or not.
+func (fsr FileReader) walkDirs(fn func(slug, path string), dirFn func(dir string)) error {
+	root := fsr.Dir
+	if root == "" {
+		root = "."
+	}
+	return filepath.WalkDir(root, func(path string, d fs.DirEntry, err error) error {
+		if err != nil {
+			return err
+		}
+		if d.IsDir() {
+			if dirFn != nil {
+				dirFn(path)
+			}
+			if path != root && (!isSection(path) || isDocs(path)) {
+				return filepath.SkipDir
+			}
+			return nil
+		}
+		name := d.Name()
+		if filepath.Ext(name) != ".md" || name == indexMD {
+			return nil
+		}
+		fn(strings.TrimSuffix(name, ".md"), path)
+		return nil
+	})
+}
+
+// files maps the slug of every post to its path. If several sections contain
+// the same slug, the one nearest Dir wins, then the first in lexical order.
+// `jonblog check` reports these duplicates. The map is shared, so it must not
+// be modified.
+func (fsr FileReader) files() (map[string]string, error) {
+	root := filepath.Clean(fsr.Dir)
+	postIndexes.Lock()
+	idx, ok := postIndexes.dirs[root]
+	postIndexes.Unlock()
+	if ok && idx.fresh() {
+		return idx.files, nil
+	}
+	idx = postIndex{files: make(map[string]string), modTimes: make(map[string]time.Time)}
+	err := fsr.walkDirs(func(slug, path string) {
+		if prev, ok := idx.files[slug]; !ok || pathDepth(path) < pathDepth(prev) {
+			idx.files[slug] = path
+		}
+	}, func(dir string) {
+		for _, path := range []string{dir, filepath.Join(dir, indexTOML), filepath.Join(dir, indexMD)} {
+			if info, err := os.Stat(path); err == nil {
+				idx.modTimes[path] = info.ModTime()
+			} else {
+				idx.modTimes[path] = time.Time{}
+			}
+		}
+	})
+	if err != nil {
+		return nil, err
+	}
+	postIndexes.Lock()
+	postIndexes.dirs[root] = idx
+	postIndexes.Unlock()
+	return idx.files, nil
+}
+
+// postIndexes caches files for each Dir, so looking up a post in a section,
+// or one that doesn't exist, doesn't walk every section. An index is rebuilt
+// once any directory or section index file it looked at has changed, which
+// adding, removing or renaming a post or section does.
+var postIndexes = struct {
+	sync.Mutex
+	dirs map[string]postIndex
+}{dirs: make(map[string]postIndex)}
+
+type postIndex struct {
+	files map[string]string
+	// modTimes has the modification time of every directory and index file
+	// looked at, or the zero time for index files that didn't exist.
+	modTimes map[string]time.Time
+}
+
+// fresh reports whether nothing in idx.modTimes has changed.
+func (idx postIndex) fresh() bool {
+	for path, modTime := range idx.modTimes {
+		info, err := os.Stat(path)
+		switch {
+		case err != nil && !modTime.IsZero():
+			return false
+		case err == nil && !info.ModTime().Equal(modTime):
+			return false
+		}
+	}
+	return true
+}
+
+// duplicates returns every file other than the winning one that has the same
+// slug as a post, keyed by slug.
+func (fsr FileReader) duplicates() (map[string][]string, error) {
+	files, err := fsr.files()
+	if err != nil {
+		return nil, err
+	}
+	dups := make(map[string][]string)
+	err = fsr.walk(func(slug, path string) {
+		if path != files[slug] {
+			dups[slug] = append(dups[slug], path)
+		}
+	})
+	return dups, err
+}
+
+func pathDepth(path string) int {
+	return strings.Count(filepath.Clean(path), string(filepath.Separator))
+}
+
+// path returns the file a post is stored in.
+func (fsr FileReader) path(slug string) (string, error) {
+	if !validSlug(slug) {
+		return "", os.ErrNotExist
+	}
+	// Most posts live at the top level, so avoid walking every section. A top
+	// level file always wins over sections, as it does in files.
+	path := filepath.Join(fsr.Dir, slug+".md")
+	if _, err := os.Stat(path); err == nil {
+		return path, nil
+	}
+	files, err := fsr.files()
+	if err != nil {
+		return "", err
+	}
+	path, ok := files[slug]
+	if !ok {
+		return "", os.ErrNotExist
+	}
+	return path, nil
+}
+
+func (fsr FileReader) Defaults(slug string) ([]Defaults, error) {
+	path, err := fsr.path(slug)
+	if err != nil {
+		return nil, err
+	}
+	return sectionDefaults(fsr.Dir, filepath.Dir(path))
+}
+
+// sectionDefaults returns the index frontmatter of root and every directory
+// between it and dir, outermost first.
+func sectionDefaults(root, dir string) ([]Defaults, error) {
+	if root == "" {
+		root = "."
+	}
+	rel, err := filepath.Rel(root, dir)
+	if err != nil {
+		return nil, err
+	}
+	dirs := []string{root}
+	if rel != "." {
+		dir := root
+		for _, part := range strings.Split(rel, string(filepath.Separator)) {
+			dir = filepath.Join(dir, part)
+			dirs = append(dirs, dir)
+		}
+	}
+	var defaults []Defaults
+	for _, dir := range dirs {
+		indexPath := filepath.Join(dir, indexTOML)
+		b, err := os.ReadFile(indexPath)
+		if err == nil {
+			defaults = append(defaults, Defaults{Path: indexPath, Frontmatter: "+++\n" + string(b) + "\n+++\n"})
+			continue
+		}
+		if !errors.Is(err, fs.ErrNotExist) {
+			return nil, err
+		}
+		indexPath = filepath.Join(dir, indexMD)
+		b, err = os.ReadFile(indexPath)
+		if err == nil {
+			defaults = append(defaults, Defaults{Path: indexPath, Frontmatter: string(b)})
+			continue
+		}
+		if !errors.Is(err, fs.ErrNotExist) {
+			return nil, err
+		}
+	}
+	return defaults, nil
+}
@@ -0,0 +1,97 @@
+package main
+
+import (
+	"errors"
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+)
+
+func TestFileReaderPostIndex(t *testing.T) {
+	dir := t.TempDir()
+	writeFiles(t, dir, map[string]string{
+		"top.md":                 "top",
+		"go/_index.toml":         `tags = ["go"]`,
+		"go/basics.md":           "basics",
+		"go/web/_index.md":       "+++\n+++\n",
+		"go/web/routing.md":      "routing",
+		"media/not-a-post.md":    "media",
+		"guides/_index.toml":     `type = "docs"`,
+		"guides/install-docs.md": "docs",
+	})
+	fsr := FileReader{Dir: dir}
+	read := func(slug string) string {
+		t.Helper()
+		s, err := fsr.Read(slug)
+		if errors.Is(err, os.ErrNotExist) {
+			return ""
+		}
+		if err != nil {
+			t.Fatalf("Read(%q) error = %v", slug, err)
+		}
+		return s
+	}
+	files := func() map[string]string {
+		t.Helper()
+		files, err := fsr.files()
+		if err != nil {
+			t.Fatal(err)
+		}
+		return files
+	}
+
+	for slug, want := range map[string]string{"top": "top", "basics": "basics", "routing": "routing", "not-a-post": "", "install-docs": "", "missing": ""} {
+		if got := read(slug); got != want {
+			t.Errorf("Read(%q) = %q, want %q", slug, got, want)
+		}
+	}
+	if a, b := files(), files(); reflect.ValueOf(a).UnsafePointer() != reflect.ValueOf(b).UnsafePointer() {
+		t.Errorf("files() was rebuilt without any changes")
+	}
+
+	tests := []struct {
+		name   string
+		change func() error
+		slug   string
+		want   string
+	}{
+		{"post added to a section", func() error {
+			return os.WriteFile(filepath.Join(dir, "go", "web", "middleware.md"), []byte("middleware"), 0644)
+		}, "middleware", "middleware"},
+		{"post removed from a section", func() error {
+			return os.Remove(filepath.Join(dir, "go", "basics.md"))
+		}, "basics", ""},
+		{"section added", func() error {
+			err := os.MkdirAll(filepath.Join(dir, "rust"), 0755)
+			if err == nil {
+				err = os.WriteFile(filepath.Join(dir, "rust", "ownership.md"), []byte("ownership"), 0644)
+			}
+			if err == nil {
+				err = os.WriteFile(filepath.Join(dir, "rust", indexTOML), nil, 0644)
+			}
+			return err
+		}, "ownership", "ownership"},
+		{"directory made a section", func() error {
+			return os.WriteFile(filepath.Join(dir, "media", indexMD), []byte("+++\n+++\n"), 0644)
+		}, "not-a-post", "media"},
+		{"section made docs", func() error {
+			// Editors usually save by renaming a new file over the old one.
+			tmp := filepath.Join(dir, "go", "web", "_index.md.tmp")
+			err := os.WriteFile(tmp, []byte("+++\ntype = \"docs\"\n+++\n"), 0644)
+			if err == nil {
+				err = os.Rename(tmp, filepath.Join(dir, "go", "web", indexMD))
+			}
+			return err
+		}, "routing", ""},
+	}
+	for _, tt := range tests {
+		err := tt.change()
+		if err != nil {
+			t.Fatalf("%s: %v", tt.name, err)
+		}
+		if got := read(tt.slug); got != tt.want {
+			t.Errorf("%s: Read(%q) = %q, want %q", tt.name, tt.slug, got, tt.want)
+		}
+	}
+}
@@ -0,0 +1,258 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"html/template"
+	"net/http"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+
+	"github.com/yuin/goldmark/parser"
+)
+
+// Shortcodes let posts include things markdown can't express. A shortcode is
+// written on a line of its own:
+//
+//	{{< youtube id="dQw4w9WgXcQ" >}}
+//
+// Paired shortcodes wrap content and are closed with {{< /name >}}. Arguments
+// are either key="value" pairs or positional values. Shortcodes inside fenced
+// code blocks are left alone so posts can show them as examples.
+type Shortcode struct {
+	Name  string
+	Args  map[string]string
+	Pos   []string
+	Inner string
+}
+
+// Arg returns the named argument, falling back to the positional argument at
+// index i.
+func (sc Shortcode) Arg(name string, i int) string {
+	if v, ok := sc.Args[name]; ok {
+		return v
+	}
+	if i < len(sc.Pos) {
+		return sc.Pos[i]
+	}
+	return ""
+}
+
+type shortcodeDef struct {
+	paired bool
+	render func(sc Shortcode, rc *RenderContext) (template.HTML, error)
+	// markdown, if set, returns plain markdown standing in for the shortcode
+	// in exports. Otherwise exports use the rendered HTML.
+	markdown func(sc Shortcode) (string, error)
+}
+
+// shortcodes is the registry of every shortcode we support. Shortcodes that
+// need no configuration, such as private, register themselves in init
+// functions next to their implementation. The rest, such as polls and embeds,
+// are registered by main once the config is loaded, followed by those of
+// plugins.
+var shortcodes = map[string]shortcodeDef{}
+
+// RenderContext carries per-request state through markdown rendering.
+type RenderContext struct {
+	Slug    string
+	Style   string
+	Request *http.Request
+	// frameSrc collects the origins embeds may load iframes from, so the
+	// Content-Security-Policy can allow exactly those.
+	frameSrc map[string]bool
+	// noCache is set by shortcodes whose output depends on the reader.
+	noCache bool
+}
+
+func (rc *RenderContext) allowFrame(origin string) {
+	if rc.frameSrc == nil {
+		rc.frameSrc = make(map[string]bool)
+	}
+	rc.frameSrc[origin] = true
+}
+
+// ContentSecurityPolicy returns the CSP for a page rendered with rc. Only
+// frame-src is restricted, since that is what embeds affect.
+func (rc *RenderContext) ContentSecurityPolicy() string {
+	origins := []string{"'self'"}
+	for o := range rc.frameSrc {
+		origins = append(origins, o)
+	}
+	sort.Strings(origins[1:])
+	return "frame-src " + strings.Join(origins, " ")
+}
+
+var (
+	shortcodeRe    = regexp.MustCompile(`^\s*\{\{<\s*(/?)([A-Za-z0-9_-]+)(.*?)\s*>\}\}\s*$`)
+	shortcodeArgRe = regexp.MustCompile(`([A-Za-z0-9_-]+)="([^"]*)"|"([^"]*)"|(\S+)`)
+	placeholderRe  = regexp.MustCompile(`(?:<p>)?JBSHORTCODE(\d+)X(?:</p>)?`)
+)
+
+func parseShortcodeArgs(s string) (map[string]string, []string) {
+	args := make(map[string]string)
+	var pos []string
+	for _, m := range shortcodeArgRe.FindAllStringSubmatch(s, -1) {
+		switch {
+		case m[1] != "":
+			args[m[1]] = m[2]
+		case m[3] != "":
+			pos = append(pos, m[3])
+		default:
+			pos = append(pos, m[4])
+		}
+	}
+	return args, pos
+}
+
+type shortcodeSpan struct {
+	start, end int // line indexes, end is inclusive
+	sc         Shortcode
+}
+
+// findShortcodes returns the shortcodes in src along with the lines they
+// cover. Unknown shortcodes are ignored.
+func findShortcodes(lines []string) []shortcodeSpan {
+	var spans []shortcodeSpan
+	fence := ""
+	for i := 0; i < len(lines); i++ {
+		trimmed := strings.TrimSpace(lines[i])
+		if fence != "" {
+			if strings.HasPrefix(trimmed, fence) && strings.Trim(trimmed, fence[:1]) == "" {
+				fence = ""
+			}
+			continue
+		}
+		if strings.HasPrefix(trimmed, "```") || strings.HasPrefix(trimmed, "~~~") {
+			fence = trimmed[:3]
+			continue
+		}
+		m := shortcodeRe.FindStringSubmatch(lines[i])
+		if m == nil || m[1] == "/" {
+			continue
+		}
+		def, ok := shortcodes[m[2]]
+		if !ok {
+			continue
+		}
+		sc := Shortcode{Name: m[2]}
+		sc.Args, sc.Pos = parseShortcodeArgs(m[3])
+		span := shortcodeSpan{start: i, end: i}
+		if def.paired {
+			depth := 1
+			for j := i + 1; j < len(lines); j++ {
+				m := shortcodeRe.FindStringSubmatch(lines[j])
+				if m == nil || m[2] != sc.Name {
+					continue
+				}
+				if m[1] == "/" {
+					depth--
+				} else {
+					depth++
+				}
+				if depth == 0 {
+					span.end = j
+					break
+				}
+			}
+			if span.end == i {
+				// Unclosed, so treat everything that follows as its content.
+				span.end = len(lines) - 1
+				sc.Inner = strings.Join(lines[i+1:], "\n")
+			} else {
+				sc.Inner = strings.Join(lines[i+1:span.end], "\n")
+			}
+		}
+		span.sc = sc
+		spans = append(spans, span)
+		i = span.end
+	}
+	return spans
+}
+
+// blankShortcodes replaces every line covered by a shortcode with an empty
+// line. Line numbers are preserved, which lets us map the remaining markdown
+// back to the original source.
+func blankShortcodes(src []byte) []byte {
+	lines := strings.Split(string(src), "\n")
+	for _, span := range findShortcodes(lines) {
+		for i := span.start; i <= span.end; i++ {
+			lines[i] = ""
+		}
+	}
+	return []byte(strings.Join(lines, "\n"))
+}
+
+// renderMarkdown renders the markdown of a post, including shortcodes, to
+// HTML. Paragraphs are given anchors.
+func renderMarkdown(rc *RenderContext, src []byte) (template.HTML, error) {
+	return renderPage(rc, src, paragraphAnchorsTransformer)
+}
+
+// renderPage renders the markdown of a whole page, passing it through the
+// pre_markdown and post_html hooks of any plugins.
+func renderPage(rc *RenderContext, src []byte, opts ...parser.Option) (template.HTML, error) {
+	src, err := runPlugins(hookPreMarkdown, src)
+	if err != nil {
+		return "", err
+	}
+	html, err := render(rc, src, opts...)
+	if err != nil {
+		return "", err
+	}
+	out, err := runPlugins(hookPostHTML, []byte(html))
+	if err != nil {
+		return "", err
+	}
+	return template.HTML(out), nil
+}
+
+// renderFragment renders markdown that is only part of a page, such as a
+// slide or the content of a paired shortcode, without paragraph anchors.
+func renderFragment(rc *RenderContext, src []byte) (template.HTML, error) {
+	return render(rc, src)
+}
+
+// render swaps each shortcode for a placeholder paragraph before goldmark sees
+// the markdown, and then replaces the placeholder with the shortcode's HTML.
+// opts are added to the markdown parser.
+func render(rc *RenderContext, src []byte, opts ...parser.Option) (template.HTML, error) {
+	lines := strings.Split(string(src), "\n")
+	var rendered []template.HTML
+	var out []string
+	last := 0
+	for _, span := range findShortcodes(lines) {
+		html, err := shortcodes[span.sc.Name].render(span.sc, rc)
+		if err != nil {
+			return "", fmt.Errorf("shortcode %s: %w", span.sc.Name, err)
+		}
+		out = append(out, lines[last:span.start]...)
+		out = append(out, "", fmt.Sprintf("JBSHORTCODE%dX", len(rendered)), "")
+		rendered = append(rendered, html)
+		last = span.end + 1
+	}
+	out = append(out, lines[last:]...)
+
+	md := newMarkdown(rc.Style)
+	md.Parser().AddOptions(opts...)
+	var buf bytes.Buffer
+	err := md.Convert([]byte(strings.Join(out, "\n")), &buf)
+	if err != nil {
+		return "", err
+	}
+	html := placeholderRe.ReplaceAllStringFunc(buf.String(), func(m string) string {
+		n, _ := strconv.Atoi(placeholderRe.FindStringSubmatch(m)[1])
+		if n >= len(rendered) {
+			return m
+		}
+		return string(rendered[n])
+	})
+	return template.HTML(html), nil
+}
+
+// isPlaceholder reports whether a paragraph's text is a shortcode placeholder.
+func isPlaceholder(text []byte) bool {
+	return placeholderRe.Match(text) && bytes.HasPrefix(text, []byte("JBSHORTCODE"))
+}
@@ -0,0 +1,21 @@
+package main
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/base64"
+)
+
+// sign returns a URL safe HMAC of value using secret.
+func sign(secret, value string) string {
+	mac := hmac.New(sha256.New, []byte(secret))
+	mac.Write([]byte(value))
+	return base64.RawURLEncoding.EncodeToString(mac.Sum(nil))
+}
+
+func verify(secret, value, sig string) bool {
+	if secret == "" {
+		return false
+	}
+	return hmac.Equal([]byte(sign(secret, value)), []byte(sig))
+}
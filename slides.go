@@ -0,0 +1,152 @@
+package main
+
+import (
+	"html/template"
+	"net/http"
+	"strings"
+)
+
+// Speaker notes are hidden blocks within a slide:
+//
+//	{{< notes >}}
+//	Ask who has used the race detector before.
+//	{{< /notes >}}
+//
+// They are shown in the speaker view of the deck and in the handout, and left
+// out of the post itself.
+const notesShortcode = "notes"
+
+func init() {
+	shortcodes[notesShortcode] = shortcodeDef{paired: true, render: renderNotes}
+}
+
+func renderNotes(sc Shortcode, rc *RenderContext) (template.HTML, error) {
+	return "", nil
+}
+
+// Slide is a single slide of a presentation along with its speaker notes.
+type Slide struct {
+	Number  int
+	Content template.HTML
+	Notes   template.HTML
+}
+
+// Deck is the data passed to the slides and handout templates.
+type Deck struct {
+	Post
+	Slides []Slide
+}
+
+// SlidesHandler renders a post with slides = true as a presentation using the
+// provided template.
+func SlidesHandler(sl SlugReader, tplName string) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		slug := r.PathValue("slug")
+		postMarkdown, err := sl.Read(slug)
+		if err != nil {
+			http.Error(w, "Post not found", http.StatusNotFound)
+			return
+		}
+		post, rest, err := parsePost(sl, slug, postMarkdown)
+		if err != nil {
+			http.Error(w, "Error parsing frontmatter", http.StatusInternalServerError)
+			return
+		}
+		if !post.Slides || (post.Visibility == VisibilityPrivate && !isPreview(r)) {
+			http.Error(w, "Post not found", http.StatusNotFound)
+			return
+		}
+		deck := Deck{Post: post}
+		rc := &RenderContext{Slug: slug, Style: post.HighlightStyle, Request: r}
+		// Private blocks are dropped before splitting: a --- or heading inside
+		// one would otherwise cut it in two and show its text on the slides.
+		if !isPreview(r) && !isDev(r) {
+			rest = blankPrivate(rest)
+		}
+		for _, src := range splitSlides(string(rest)) {
+			slide := Slide{Number: len(deck.Slides) + 1}
+			slide.Content, err = renderFragment(rc, []byte(src.content))
+			if err != nil {
+				http.Error(w, "Error converting markdown", http.StatusInternalServerError)
+				return
+			}
+			if src.notes != "" {
+				slide.Notes, err = renderFragment(rc, []byte(src.notes))
+				if err != nil {
+					http.Error(w, "Error converting markdown", http.StatusInternalServerError)
+					return
+				}
+			}
+			deck.Slides = append(deck.Slides, slide)
+		}
+		tpl, err := parseTemplate(tplName)
+		if err != nil {
+			http.Error(w, "Error parsing template", http.StatusInternalServerError)
+			return
+		}
+		w.Header().Set("Content-Security-Policy", rc.ContentSecurityPolicy())
+		err = tpl.Execute(w, deck)
+	}
+}
+
+type slideSource struct {
+	content string
+	notes   string
+}
+
+// splitSlides splits markdown into slides. A new slide starts at every `---`
+// line and at every level one or two heading. The notes blocks of a slide are
+// its speaker notes. Fenced code blocks and notes blocks are left alone so
+// they can contain any of these.
+func splitSlides(md string) []slideSource {
+	var slides []slideSource
+	var content, notes strings.Builder
+	lines := strings.Split(md, "\n")
+	notesAt := make(map[int]shortcodeSpan)
+	for _, span := range findShortcodes(lines) {
+		if span.sc.Name == notesShortcode {
+			notesAt[span.start] = span
+		}
+	}
+	fence := ""
+	flush := func() {
+		s := slideSource{
+			content: strings.TrimSpace(content.String()),
+			notes:   strings.TrimSpace(notes.String()),
+		}
+		if s.content != "" || s.notes != "" {
+			slides = append(slides, s)
+		}
+		content.Reset()
+		notes.Reset()
+	}
+	for i := 0; i < len(lines); i++ {
+		line := lines[i]
+		if span, ok := notesAt[i]; ok {
+			notes.WriteString(span.sc.Inner + "\n\n")
+			i = span.end
+			continue
+		}
+		trimmed := strings.TrimSpace(line)
+		if fence == "" {
+			switch {
+			case trimmed == "---":
+				flush()
+				continue
+			case strings.HasPrefix(line, "# "), strings.HasPrefix(line, "## "):
+				flush()
+			}
+		}
+		if strings.HasPrefix(trimmed, "```") || strings.HasPrefix(trimmed, "~~~") {
+			switch {
+			case fence == "":
+				fence = trimmed[:3]
+			case strings.HasPrefix(trimmed, fence) && strings.Trim(trimmed, fence[:1]) == "":
+				fence = ""
+			}
+		}
+		content.WriteString(line + "\n")
+	}
+	flush()
+	return slides
+}
@@ -0,0 +1,105 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func TestSplitSlides(t *testing.T) {
+	tests := []struct {
+		name string
+		md   string
+		want []slideSource
+	}{
+		{
+			name: "notes block",
+			md:   "# One\n\nText.\n\n{{< notes >}}\nSay hi.\n{{< /notes >}}\n\n# Two\n",
+			want: []slideSource{{"# One\n\nText.", "Say hi."}, {"# Two", ""}},
+		},
+		{
+			name: "Note: paragraphs stay on the slide",
+			md:   "# One\n\nNote: this is shown.\n",
+			want: []slideSource{{"# One\n\nNote: this is shown.", ""}},
+		},
+		{
+			name: "no splits within notes",
+			md:   "# One\n{{< notes >}}\nFirst.\n\n---\n\n## Not a slide\n{{< /notes >}}\nMore.\n---\nTwo\n",
+			want: []slideSource{{"# One\nMore.", "First.\n\n---\n\n## Not a slide"}, {"Two", ""}},
+		},
+		{
+			name: "several notes blocks",
+			md:   "# One\n{{< notes >}}\nA.\n{{< /notes >}}\nText.\n{{< notes >}}\nB.\n{{< /notes >}}\n",
+			want: []slideSource{{"# One\nText.", "A.\n\nB."}},
+		},
+		{
+			name: "notes in a fence are shown",
+			md:   "# One\n```\n{{< notes >}}\n---\n{{< /notes >}}\n```\n",
+			want: []slideSource{{"# One\n```\n{{< notes >}}\n---\n{{< /notes >}}\n```", ""}},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got := splitSlides(tt.md)
+			if !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("splitSlides() = %q, want %q", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestSlidesHandlerPrivate(t *testing.T) {
+	dir := t.TempDir()
+	writeFiles(t, dir, map[string]string{
+		"talk.md": `+++
+title = "A talk"
+slides = true
++++
+# First slide
+
+{{< private >}}
+Secret one.
+
+---
+
+## Secret heading
+
+{{< notes >}}
+secret two.
+{{< /notes >}}
+{{< /private >}}
+
+---
+
+# Last slide
+`,
+	})
+	fsr := FileReader{Dir: dir}
+	for _, tplName := range []string{"slides.gohtml", "handout.gohtml"} {
+		t.Run(tplName, func(t *testing.T) {
+			page := serve(t, "GET /posts/{slug}/slides", "/posts/talk/slides", SlidesHandler(fsr, tplName))
+			for _, secret := range []string{"Secret one", "Secret heading", "secret two", "private"} {
+				if strings.Contains(page, secret) {
+					t.Errorf("slides contain %q", secret)
+				}
+			}
+			for _, want := range []string{"First slide", "Last slide"} {
+				if !strings.Contains(page, want) {
+					t.Errorf("slides are missing %q", want)
+				}
+			}
+		})
+	}
+
+	t.Run("dev", func(t *testing.T) {
+		mux := http.NewServeMux()
+		mux.Handle("GET /posts/{slug}/slides", SlidesHandler(fsr, "slides.gohtml"))
+		rec := httptest.NewRecorder()
+		DevMode(mux).ServeHTTP(rec, httptest.NewRequest(http.MethodGet, "/posts/talk/slides", nil))
+		if !strings.Contains(rec.Body.String(), "Secret one") {
+			t.Errorf("dev mode slides are missing the private block")
+		}
+	})
+}
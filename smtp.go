@@ -0,0 +1,232 @@
+package main
+
+import (
+	"bufio"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"net"
+	"net/mail"
+	"net/textproto"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// maxMessageSize limits how much of a DATA section we are willing to read.
+const maxMessageSize = 25 << 20
+
+// maxCommandLength is the longest command line RFC 5321 requires servers to
+// accept, including the CRLF.
+const maxCommandLength = 512
+
+var errLineTooLong = errors.New("line too long")
+
+// SMTPServer is a deliberately small SMTP listener. It only understands
+// enough of the protocol for a mail client or relay to hand us a message,
+// which is then passed to Deliver.
+type SMTPServer struct {
+	Addr     string
+	Hostname string
+	// Deliver is called once per accepted message with the envelope sender,
+	// the envelope recipients, and the raw message. Messages are written to a
+	// temporary file as they are received rather than held in memory, and
+	// msg reads that file.
+	Deliver func(from string, to []string, msg io.Reader) error
+}
+
+func (s *SMTPServer) ListenAndServe() error {
+	l, err := net.Listen("tcp", s.Addr)
+	if err != nil {
+		return err
+	}
+	defer l.Close()
+	for {
+		conn, err := l.Accept()
+		if err != nil {
+			var ne net.Error
+			if errors.As(err, &ne) && ne.Timeout() {
+				continue
+			}
+			return err
+		}
+		go s.serve(conn)
+	}
+}
+
+func (s *SMTPServer) serve(conn net.Conn) {
+	defer conn.Close()
+	tp := textproto.NewConn(conn)
+	hostname := s.Hostname
+	if hostname == "" {
+		hostname = "localhost"
+	}
+
+	var from string
+	var to []string
+	reply := func(code int, msg string) {
+		tp.PrintfLine("%d %s", code, msg)
+	}
+	reply(220, hostname+" jonblog ESMTP ready")
+	for {
+		conn.SetDeadline(time.Now().Add(5 * time.Minute))
+		line, err := readCommand(tp.R)
+		if errors.Is(err, errLineTooLong) {
+			reply(500, "Line too long")
+			continue
+		}
+		if err != nil {
+			return
+		}
+		verb, arg, _ := strings.Cut(line, " ")
+		switch strings.ToUpper(verb) {
+		case "HELO":
+			reply(250, hostname)
+		case "EHLO":
+			tp.PrintfLine("250-%s", hostname)
+			tp.PrintfLine("250-SIZE %d", maxMessageSize)
+			reply(250, "8BITMIME")
+		case "MAIL":
+			addr, err := parsePath(arg, "FROM:")
+			if err != nil {
+				reply(501, "Syntax: MAIL FROM:<address>")
+				continue
+			}
+			// Turn away messages the client says are too large before it
+			// sends them.
+			if declaredSize(arg) > maxMessageSize {
+				reply(552, "Message too large")
+				continue
+			}
+			from, to = addr, nil
+			reply(250, "OK")
+		case "RCPT":
+			if from == "" {
+				reply(503, "Need MAIL before RCPT")
+				continue
+			}
+			addr, err := parsePath(arg, "TO:")
+			if err != nil {
+				reply(501, "Syntax: RCPT TO:<address>")
+				continue
+			}
+			to = append(to, addr)
+			reply(250, "OK")
+		case "DATA":
+			if len(to) == 0 {
+				reply(503, "Need RCPT before DATA")
+				continue
+			}
+			reply(354, "End data with <CR><LF>.<CR><LF>")
+			code, msg, ok := s.receive(tp, from, to)
+			if !ok {
+				return
+			}
+			reply(code, msg)
+			from, to = "", nil
+		case "RSET":
+			from, to = "", nil
+			reply(250, "OK")
+		case "NOOP":
+			reply(250, "OK")
+		case "QUIT":
+			reply(221, "Bye")
+			return
+		default:
+			reply(502, "Command not implemented")
+		}
+	}
+}
+
+// receive reads a DATA section into a temporary file and delivers it. ok is
+// false if the connection should be closed.
+func (s *SMTPServer) receive(tp *textproto.Conn, from string, to []string) (code int, msg string, ok bool) {
+	f, err := os.CreateTemp("", "jonblog-smtp-*.eml")
+	if err != nil {
+		log.Printf("smtp: %v", err)
+		// Drain the message so the connection stays in sync.
+		io.Copy(io.Discard, tp.DotReader())
+		return 451, "Error receiving message", true
+	}
+	defer os.Remove(f.Name())
+	defer f.Close()
+	n, err := io.Copy(f, io.LimitReader(tp.DotReader(), maxMessageSize+1))
+	if err != nil {
+		log.Printf("smtp: receiving message from %s: %v", from, err)
+		return 0, "", false
+	}
+	if n > maxMessageSize {
+		io.Copy(io.Discard, tp.DotReader())
+		return 552, "Message too large", true
+	}
+	_, err = f.Seek(0, io.SeekStart)
+	if err != nil {
+		log.Printf("smtp: %v", err)
+		return 451, "Error receiving message", true
+	}
+	err = s.Deliver(from, to, f)
+	if err != nil {
+		log.Printf("smtp: rejected message from %s: %v", from, err)
+		return 554, "Message rejected", true
+	}
+	return 250, "OK: queued as draft", true
+}
+
+// readCommand reads a command line without its CRLF. Lines longer than
+// maxCommandLength are read in full but return errLineTooLong, so a client
+// can't make us buffer an endless line.
+func readCommand(r *bufio.Reader) (string, error) {
+	var line []byte
+	tooLong := false
+	for {
+		b, err := r.ReadSlice('\n')
+		if !tooLong {
+			line = append(line, b...)
+			if len(line) > maxCommandLength {
+				tooLong, line = true, nil
+			}
+		}
+		if errors.Is(err, bufio.ErrBufferFull) {
+			continue
+		}
+		if err != nil {
+			return "", err
+		}
+		if tooLong {
+			return "", errLineTooLong
+		}
+		return strings.TrimRight(string(line), "\r\n"), nil
+	}
+}
+
+// declaredSize returns the SIZE parameter of a MAIL command (RFC 1870), or 0
+// if there isn't one.
+func declaredSize(arg string) int64 {
+	for _, param := range strings.Fields(arg) {
+		k, v, ok := strings.Cut(param, "=")
+		if ok && strings.EqualFold(k, "SIZE") {
+			n, _ := strconv.ParseInt(v, 10, 64)
+			return n
+		}
+	}
+	return 0
+}
+
+// parsePath parses arguments such as "FROM:<jon@calhoun.io> SIZE=123".
+func parsePath(arg, prefix string) (string, error) {
+	if len(arg) < len(prefix) || !strings.EqualFold(arg[:len(prefix)], prefix) {
+		return "", fmt.Errorf("missing %s", prefix)
+	}
+	path := strings.TrimSpace(arg[len(prefix):])
+	path, _, _ = strings.Cut(path, " ")
+	if path == "<>" {
+		return "", errors.New("null sender")
+	}
+	addr, err := mail.ParseAddress(path)
+	if err != nil {
+		return "", err
+	}
+	return strings.ToLower(addr.Address), nil
+}
@@ -0,0 +1,90 @@
+package main
+
+import (
+	"bufio"
+	"io"
+	"net"
+	"net/textproto"
+	"strings"
+	"testing"
+)
+
+func TestSMTPServer(t *testing.T) {
+	var delivered []string
+	s := &SMTPServer{Hostname: "test", Deliver: func(from string, to []string, msg io.Reader) error {
+		b, err := io.ReadAll(msg)
+		delivered = append(delivered, string(b))
+		return err
+	}}
+	client, server := net.Pipe()
+	done := make(chan struct{})
+	go func() {
+		s.serve(server)
+		close(done)
+	}()
+	tp := textproto.NewConn(client)
+	defer tp.Close()
+	expect := func(code int) {
+		t.Helper()
+		_, msg, err := tp.ReadResponse(code)
+		if err != nil {
+			t.Fatalf("reply %q, want %d: %v", msg, code, err)
+		}
+	}
+	send := func(line string, code int) {
+		t.Helper()
+		err := tp.PrintfLine("%s", line)
+		if err != nil {
+			t.Fatal(err)
+		}
+		expect(code)
+	}
+
+	expect(220)
+	send("HELO client", 250)
+	send("NOOP "+strings.Repeat("x", 10000), 500)
+	send("NOOP", 250)
+	send("MAIL FROM:<jon@example.com> SIZE=999999999", 552)
+	send("RCPT TO:<drafts@example.com>", 503)
+	send("MAIL FROM:<jon@example.com> SIZE=100", 250)
+	send("RCPT TO:<drafts@example.com>", 250)
+	send("DATA", 354)
+	w := tp.DotWriter()
+	io.WriteString(w, "Subject: Hi\r\n\r\nHello.\r\n")
+	w.Close()
+	expect(250)
+	send("QUIT", 221)
+	<-done
+
+	want := "Subject: Hi\n\nHello.\n"
+	if len(delivered) != 1 || delivered[0] != want {
+		t.Errorf("delivered %q, want [%q]", delivered, want)
+	}
+}
+
+func TestReadCommand(t *testing.T) {
+	long := strings.Repeat("x", maxCommandLength)
+	tests := []struct {
+		name    string
+		input   string
+		want    []string
+		wantErr []error
+	}{
+		{"lines", "HELO a\r\nNOOP\n", []string{"HELO a", "NOOP"}, []error{nil, nil}},
+		{"longest allowed", long[:maxCommandLength-2] + "\r\nNOOP\r\n", []string{long[:maxCommandLength-2], "NOOP"}, []error{nil, nil}},
+		{"too long", long + "\r\nNOOP\r\n", []string{"", "NOOP"}, []error{errLineTooLong, nil}},
+		{"longer than the buffer", strings.Repeat(long, 20) + "\r\nNOOP\r\n", []string{"", "NOOP"}, []error{errLineTooLong, nil}},
+		{"unterminated", "NOOP", []string{""}, []error{io.EOF}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			r := bufio.NewReader(strings.NewReader(tt.input))
+			for i := range tt.want {
+				got, err := readCommand(r)
+				if got != tt.want[i] || err != tt.wantErr[i] {
+					t.Errorf("readCommand() #%d = %.20q, %v, want %.20q, %v", i, got, err, tt.want[i], tt.wantErr[i])
+				}
+			}
+		})
+	}
+}
@@ -0,0 +1,494 @@
+package main
+
+import (
+	"bytes"
+	"errors"
+	"flag"
+	"fmt"
+	"html/template"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"os"
+	"path"
+	"path/filepath"
+	"regexp"
+	"slices"
+	"strings"
+	"time"
+
+	"golang.org/x/net/html"
+)
+
+// Static builds render the read only pages of the site to files that any web
+// server can host. Each build is written to its own release directory:
+//
+//	static/
+//	  current -> releases/20250102T150405Z
+//	  releases/
+//	    20250101T093000Z/
+//	    20250102T150405Z/
+//
+// The web server should serve static/current. A build only becomes current
+// once it is complete and every local link in it works, and the switch is a
+// single rename, so readers never see a half written site. The newest
+// releases are kept so `jonblog rollback` can switch back to one.
+//
+// Pages are found by following links from every published post, docs section
+// and album. Anything that needs the server, such as reactions and polls,
+// is rendered but won't work.
+const (
+	releasesDir = "releases"
+	currentLink = "current"
+)
+
+// readOnlyMux serves the pages of the site that don't store reader data,
+// from the content in dir. It is used for previews and static builds. icons is
+// nil when icons aren't set up.
+func readOnlyMux(dir, imageCache, mediaDir, albumsDir, baseURL string, embeds *EmbedCache, icons *IconSet) *http.ServeMux {
+	fsr := FileReader{Dir: dir}
+	albums := AlbumReader{Dir: filepath.Join(dir, albumsDir)}
+	images := ImageCache{Dir: imageCache}
+	media := filepath.Join(dir, mediaDir)
+	mux := http.NewServeMux()
+	mux.HandleFunc("GET /posts/{slug}", PostHandler(fsr, baseURL, nil, nil))
+	mux.HandleFunc("GET /posts/{slug}/slides", SlidesHandler(fsr, "slides.gohtml"))
+	mux.HandleFunc("GET /posts/{slug}/handout", SlidesHandler(fsr, "handout.gohtml"))
+	mux.HandleFunc("GET /posts/{slug}/code/{name...}", CodeHandler(fsr))
+	mux.HandleFunc("GET /posts/{slug}/examples.zip", ExamplesHandler(fsr))
+	mux.HandleFunc("GET /posts/{slug}/card", CardHandler(fsr, media))
+	mux.HandleFunc("GET /posts/{slug}/mf2.json", PostMF2Handler(fsr, baseURL))
+	mux.HandleFunc("GET /docs/{path...}", DocsHandler(DocsReader{Dir: dir}))
+	mux.HandleFunc("GET /albums", AlbumsHandler(albums))
+	mux.HandleFunc("GET /albums/feed.xml", AlbumsFeedHandler(albums, baseURL))
+	mux.HandleFunc("GET /albums/mf2.json", AlbumsMF2Handler(albums, baseURL))
+	mux.HandleFunc("GET /albums/{album}", AlbumHandler(albums))
+	mux.HandleFunc("GET /albums/{album}/mf2.json", AlbumMF2Handler(albums, baseURL))
+	mux.HandleFunc("GET /albums/{album}/photos/{photo}", PhotoHandler(albums))
+	mux.HandleFunc("GET /albums/{album}/images/{photo}", PhotoImageHandler(albums, images, photoSize))
+	mux.HandleFunc("GET /albums/{album}/thumbs/{photo}", PhotoImageHandler(albums, images, thumbSize))
+	mux.Handle("GET /media/", http.StripPrefix("/media/", http.FileServer(http.Dir(media))))
+	mux.HandleFunc("GET /embeds/facade.js", FacadeScriptHandler())
+	mux.HandleFunc("GET /embeds/youtube/{sig}/{file}", embeds.YouTubeThumbHandler())
+	mux.HandleFunc("GET /embeds/tiles/{sig}/{z}/{x}/{file}", embeds.TileHandler())
+	if icons != nil {
+		for _, name := range icons.Names() {
+			mux.Handle("GET /"+name, icons.Handler())
+		}
+	}
+	return mux
+}
+
+// runBuild implements `jonblog build [-o dir]`, which builds a new release
+// and makes it current.
+func runBuild(w io.Writer, cfg Config, args []string) error {
+	flags := flag.NewFlagSet("build", flag.ExitOnError)
+	root := flags.String("o", cfg.Static.Dir, "directory to keep releases in")
+	flags.Parse(args)
+
+	var icons *IconSet
+	var seeds []string
+	if cfg.Icons.Source != "" {
+		var err error
+		icons, err = NewIconSet(cfg.Icons)
+		if err != nil {
+			return err
+		}
+		for _, name := range icons.Names() {
+			seeds = append(seeds, "/"+name)
+		}
+		iconLinks = iconLinksHTML
+	}
+	// Images and embed thumbnails share the server's caches.
+	mux := readOnlyMux("", filepath.Join(cfg.CacheDir, "images"), cfg.MediaDir, cfg.AlbumsDir, cfg.BaseURL, NewEmbedCache(cfg), icons)
+	fsr := FileReader{}
+	slugs, err := fsr.List()
+	if err != nil {
+		return err
+	}
+	for _, slug := range slugs {
+		postMarkdown, err := fsr.Read(slug)
+		if err != nil {
+			return err
+		}
+		post, _, err := parsePost(fsr, slug, postMarkdown)
+		if err != nil {
+			return fmt.Errorf("%s: %w", slug, err)
+		}
+		if !post.Draft && post.Visibility != VisibilityPrivate {
+			seeds = append(seeds, "/posts/"+url.PathEscape(slug))
+		}
+	}
+	sections, err := DocsReader{}.Sections()
+	if err != nil {
+		return err
+	}
+	for _, section := range sections {
+		seeds = append(seeds, "/docs/"+section)
+	}
+	seeds = append(seeds, "/albums")
+
+	site, err := url.Parse(cfg.BaseURL)
+	if err != nil {
+		return fmt.Errorf("base_url: %w", err)
+	}
+	release := time.Now().UTC().Format("20060102T150405Z")
+	dir := filepath.Join(*root, releasesDir, release)
+	if _, err := os.Stat(dir); err == nil {
+		return fmt.Errorf("release %s already exists", release)
+	}
+	b := &staticBuild{
+		dir:     dir,
+		handler: mux,
+		site:    site,
+		written: make(map[string]bool),
+		from:    make(map[string]string),
+	}
+	for _, seed := range seeds {
+		b.add(seed, "")
+	}
+	for len(b.queue) > 0 {
+		p := b.queue[0]
+		b.queue = b.queue[1:]
+		b.fetch(p)
+	}
+	for _, seed := range seeds {
+		if !b.written[seed] {
+			b.problem("missing required page %s", seed)
+		}
+	}
+	if len(b.problems) > 0 {
+		os.RemoveAll(dir)
+		for _, p := range b.problems {
+			fmt.Fprintln(w, "error:", p)
+		}
+		if current := currentRelease(*root); current != "" {
+			return fmt.Errorf("build failed with %d problems, %s is still current", len(b.problems), current)
+		}
+		return fmt.Errorf("build failed with %d problems", len(b.problems))
+	}
+	fmt.Fprintf(w, "built %s: %d files\n", release, len(b.written))
+
+	err = switchRelease(*root, release)
+	if err != nil {
+		return err
+	}
+	fmt.Fprintf(w, "current is now %s\n", release)
+	return pruneReleases(w, *root, cfg.Static.Keep)
+}
+
+// staticBuild crawls the site, writing every page it finds to dir.
+type staticBuild struct {
+	dir     string
+	handler http.Handler
+	queue   []string
+	// site is the base URL, so absolute links to the site are followed too.
+	site *url.URL
+	// written records the paths that were saved. from records the page each
+	// path was first linked from, and every path ever queued.
+	written  map[string]bool
+	from     map[string]string
+	problems []string
+}
+
+func (b *staticBuild) problem(format string, args ...any) {
+	b.problems = append(b.problems, fmt.Sprintf(format, args...))
+}
+
+// add queues the escaped path p, linked from page.
+func (b *staticBuild) add(p, page string) {
+	if _, ok := b.from[p]; ok {
+		return
+	}
+	b.from[p] = page
+	b.queue = append(b.queue, p)
+}
+
+func (b *staticBuild) fetch(p string) {
+	rec := httptest.NewRecorder()
+	b.handler.ServeHTTP(rec, httptest.NewRequest(http.MethodGet, p, nil))
+	res := rec.Result()
+	body := rec.Body.Bytes()
+	switch {
+	case res.StatusCode >= 300 && res.StatusCode < 400:
+		loc, err := url.Parse(res.Header.Get("Location"))
+		if err != nil {
+			b.problem("%s redirects to an invalid location", p)
+			return
+		}
+		target := (&url.URL{Path: "/"}).ResolveReference(&url.URL{Path: unescapePath(p)}).ResolveReference(loc)
+		b.add(target.EscapedPath(), p)
+		var buf bytes.Buffer
+		redirectTpl.Execute(&buf, target.EscapedPath())
+		body = buf.Bytes()
+		res.Header.Set("Content-Type", "text/html; charset=utf-8")
+	case res.StatusCode != http.StatusOK:
+		if page := b.from[p]; page != "" {
+			b.problem("broken link to %s from %s: %s", p, page, res.Status)
+		} else {
+			b.problem("%s: %s", p, res.Status)
+		}
+		return
+	}
+	isHTML := strings.HasPrefix(res.Header.Get("Content-Type"), "text/html")
+	name, ok := staticFile(p, isHTML)
+	if !ok {
+		b.problem("%s can't be saved as a file", p)
+		return
+	}
+	err := writeFile(filepath.Join(b.dir, name), bytes.NewReader(body))
+	if err != nil {
+		b.problem("%s: %v", p, err)
+		return
+	}
+	b.written[p] = true
+	var links []string
+	switch {
+	case isHTML:
+		links = localLinks(p, body, b.site)
+	case strings.HasPrefix(res.Header.Get("Content-Type"), "text/css"):
+		links = cssLinks(p, body, b.site)
+	}
+	for _, link := range links {
+		b.add(link, p)
+	}
+}
+
+var redirectTpl = template.Must(template.New("redirect").Parse(`<!DOCTYPE html>
+<html lang="en">
+<head>
+  <meta charset="UTF-8">
+  <meta http-equiv="refresh" content="0; url={{.}}">
+  <link rel="canonical" href="{{.}}">
+</head>
+<body><a href="{{.}}">Continue</a></body>
+</html>
+`))
+
+func unescapePath(p string) string {
+	s, err := url.PathUnescape(p)
+	if err != nil {
+		return p
+	}
+	return s
+}
+
+// staticFile returns the file the escaped path p is saved as, relative to the
+// release. Pages are saved as index.html files so their URLs don't change.
+func staticFile(p string, isHTML bool) (string, bool) {
+	name := strings.TrimPrefix(path.Clean(unescapePath(p)), "/")
+	if isHTML {
+		name = path.Join(name, "index.html")
+	}
+	name = filepath.FromSlash(name)
+	return name, filepath.IsLocal(name)
+}
+
+// localLink returns the escaped path ref points to when it is within site,
+// resolved against the escaped path page. Links with a query string need the
+// server, so they are left out.
+func localLink(page, ref string, site *url.URL) (string, bool) {
+	u, err := url.Parse(strings.TrimSpace(ref))
+	if err != nil || u.RawQuery != "" {
+		return "", false
+	}
+	if u.Scheme != "" || u.Host != "" {
+		if site == nil || u.Host != site.Host || (u.Scheme != "" && u.Scheme != site.Scheme) {
+			return "", false
+		}
+		u = &url.URL{Path: u.Path, RawPath: u.RawPath}
+	}
+	if u.Path == "" {
+		return "", false
+	}
+	base := &url.URL{Path: unescapePath(page)}
+	return base.ResolveReference(u).EscapedPath(), true
+}
+
+// metaImages are the meta tags whose content is an image shown when a page
+// is shared.
+var metaImages = map[string]bool{"og:image": true, "og:image:url": true, "twitter:image": true}
+
+// localLinks returns the escaped paths of the links and embedded resources on
+// a page that point within the site: href, src and poster attributes, every
+// image in a srcset, url() in styles, and share images in meta tags.
+func localLinks(page string, body []byte, site *url.URL) []string {
+	var links []string
+	add := func(ref string) {
+		if link, ok := localLink(page, ref, site); ok {
+			links = append(links, link)
+		}
+	}
+	z := html.NewTokenizer(bytes.NewReader(body))
+	inStyle := false
+	for {
+		tt := z.Next()
+		switch tt {
+		case html.ErrorToken:
+			return links
+		case html.TextToken:
+			if inStyle {
+				for _, ref := range cssURLs(z.Text()) {
+					add(ref)
+				}
+			}
+			continue
+		case html.StartTagToken, html.SelfClosingTagToken:
+		default:
+			inStyle = false
+			continue
+		}
+		name, more := z.TagName()
+		inStyle = tt == html.StartTagToken && string(name) == "style"
+		attrs := make(map[string]string)
+		for more {
+			var key, val []byte
+			key, val, more = z.TagAttr()
+			attrs[string(key)] = string(val)
+		}
+		for _, key := range []string{"href", "src", "poster"} {
+			if ref, ok := attrs[key]; ok {
+				add(ref)
+			}
+		}
+		for _, key := range []string{"srcset", "imagesrcset"} {
+			// Each candidate is a URL, optionally followed by a width or
+			// density.
+			for _, candidate := range strings.Split(attrs[key], ",") {
+				if fields := strings.Fields(candidate); len(fields) > 0 {
+					add(fields[0])
+				}
+			}
+		}
+		for _, ref := range cssURLs([]byte(attrs["style"])) {
+			add(ref)
+		}
+		if string(name) == "meta" && (metaImages[attrs["property"]] || metaImages[attrs["name"]]) {
+			add(attrs["content"])
+		}
+	}
+}
+
+// cssLinks is localLinks for a stylesheet.
+func cssLinks(page string, body []byte, site *url.URL) []string {
+	var links []string
+	for _, ref := range cssURLs(body) {
+		if link, ok := localLink(page, ref, site); ok {
+			links = append(links, link)
+		}
+	}
+	return links
+}
+
+// cssURLRe matches url() and the string form of @import in CSS.
+var cssURLRe = regexp.MustCompile(`url\(\s*(?:"([^"]*)"|'([^']*)'|([^"')\s]*))\s*\)|@import\s+(?:"([^"]*)"|'([^']*)')`)
+
+// cssURLs returns the URLs referenced in CSS.
+func cssURLs(css []byte) []string {
+	var refs []string
+	for _, m := range cssURLRe.FindAllSubmatch(css, -1) {
+		for _, ref := range m[1:] {
+			if len(ref) > 0 {
+				refs = append(refs, string(ref))
+				break
+			}
+		}
+	}
+	return refs
+}
+
+// listReleases returns the releases in dir, oldest first.
+func listReleases(dir string) ([]string, error) {
+	entries, err := os.ReadDir(filepath.Join(dir, releasesDir))
+	if errors.Is(err, os.ErrNotExist) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	var releases []string
+	for _, e := range entries {
+		if e.IsDir() {
+			releases = append(releases, e.Name())
+		}
+	}
+	slices.Sort(releases)
+	return releases, nil
+}
+
+// currentRelease returns the release current points to, or "" if there is
+// none.
+func currentRelease(dir string) string {
+	target, err := os.Readlink(filepath.Join(dir, currentLink))
+	if err != nil {
+		return ""
+	}
+	return filepath.Base(target)
+}
+
+// switchRelease points current at release. The new link is made beside the
+// old one and renamed over it, which replaces it atomically.
+func switchRelease(dir, release string) error {
+	tmp := filepath.Join(dir, currentLink+".tmp")
+	os.Remove(tmp)
+	err := os.Symlink(filepath.Join(releasesDir, release), tmp)
+	if err != nil {
+		return err
+	}
+	return os.Rename(tmp, filepath.Join(dir, currentLink))
+}
+
+// pruneReleases deletes all but the newest keep releases. The current release
+// is always kept.
+func pruneReleases(w io.Writer, dir string, keep int) error {
+	releases, err := listReleases(dir)
+	if err != nil {
+		return err
+	}
+	current := currentRelease(dir)
+	for i := 0; i < len(releases)-max(keep, 1); i++ {
+		if releases[i] == current {
+			continue
+		}
+		err = os.RemoveAll(filepath.Join(dir, releasesDir, releases[i]))
+		if err != nil {
+			return err
+		}
+		fmt.Fprintf(w, "removed %s\n", releases[i])
+	}
+	return nil
+}
+
+// runRollback implements `jonblog rollback [-o dir] [release]`, which points
+// current at release, or at the release before the current one.
+func runRollback(w io.Writer, cfg StaticConfig, args []string) error {
+	flags := flag.NewFlagSet("rollback", flag.ExitOnError)
+	root := flags.String("o", cfg.Dir, "directory releases are kept in")
+	flags.Parse(args)
+
+	releases, err := listReleases(*root)
+	if err != nil {
+		return err
+	}
+	current := currentRelease(*root)
+	var release string
+	if flags.NArg() > 0 {
+		release = flags.Arg(0)
+		if !slices.Contains(releases, release) {
+			return fmt.Errorf("no release %s", release)
+		}
+	} else {
+		i := slices.Index(releases, current)
+		if i <= 0 {
+			return fmt.Errorf("no release before %s", current)
+		}
+		release = releases[i-1]
+	}
+	err = switchRelease(*root, release)
+	if err != nil {
+		return err
+	}
+	fmt.Fprintf(w, "current is now %s (was %s)\n", release, current)
+	return nil
+}
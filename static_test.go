@@ -0,0 +1,176 @@
+package main
+
+import (
+	"io"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestLocalLinks(t *testing.T) {
+	site, err := url.Parse("https://example.com")
+	if err != nil {
+		t.Fatal(err)
+	}
+	tests := []struct {
+		name string
+		body string
+		want []string
+	}{
+		{"href and src", `<a href="/about">About</a><img src="diagram.png">`, []string{"/about", "/posts/diagram.png"}},
+		{"poster", `<video poster="/media/still.jpg"></video>`, []string{"/media/still.jpg"}},
+		{
+			name: "srcset",
+			body: `<img srcset="/img/a.jpg 1x, /img/a@2x.jpg 2x"><source srcset="b.webp 400w,c.webp 800w">`,
+			want: []string{"/img/a.jpg", "/img/a@2x.jpg", "/posts/b.webp", "/posts/c.webp"},
+		},
+		{"preload imagesrcset", `<link rel="preload" as="image" imagesrcset="/img/hero.jpg 1x">`, []string{"/img/hero.jpg"}},
+		{"style attribute", `<div style="background: url('/img/bg.png') no-repeat"></div>`, []string{"/img/bg.png"}},
+		{
+			name: "style element",
+			body: `<style>@import "/css/base.css"; body { background: url(/img/bg.png) } h1 { background: url("h1.svg") }</style><p>url(/not-css)</p>`,
+			want: []string{"/css/base.css", "/img/bg.png", "/posts/h1.svg"},
+		},
+		{
+			name: "share images",
+			body: `<meta property="og:image" content="https://example.com/media/card.png"><meta name="twitter:image" content="/media/card.png"><meta property="og:title" content="/not-a-link">`,
+			want: []string{"/media/card.png", "/media/card.png"},
+		},
+		{"protocol relative", `<img src="//example.com/a.png"><img src="//cdn.example/b.png">`, []string{"/a.png"}},
+		{"other sites", `<a href="https://other.example/a"></a><a href="http://example.com/b"></a><a href="mailto:jon@example.com"></a>`, nil},
+		{"query and fragment", `<a href="/search?q=go"></a><a href="#top"></a><a href="/about#team"></a>`, []string{"/about"}},
+		{"escaped", `<a href="/posts/hello%20world">x</a>`, []string{"/posts/hello%20world"}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got := localLinks("/posts/go", []byte(tt.body), site)
+			if strings.Join(got, "|") != strings.Join(tt.want, "|") {
+				t.Errorf("localLinks() = %q, want %q", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestCSSLinks(t *testing.T) {
+	css := `@import url("fonts.css"); @font-face { src: url(/fonts/a.woff2) format("woff2"), url('data:font/woff;base64,AA') } .x { background: url(https://cdn.example/x.png) }`
+	got := cssLinks("/css/site.css", []byte(css), nil)
+	want := []string{"/css/fonts.css", "/fonts/a.woff2"}
+	if strings.Join(got, "|") != strings.Join(want, "|") {
+		t.Errorf("cssLinks() = %q, want %q", got, want)
+	}
+}
+
+// testReleases makes a releases directory holding releases, with current
+// pointing at current if it isn't "".
+func testReleases(t *testing.T, releases []string, current string) string {
+	t.Helper()
+	dir := t.TempDir()
+	for _, release := range releases {
+		err := os.MkdirAll(filepath.Join(dir, releasesDir, release), 0755)
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	if current != "" {
+		err := switchRelease(dir, current)
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	return dir
+}
+
+func TestPruneReleases(t *testing.T) {
+	releases := []string{"20250101T000000Z", "20250102T000000Z", "20250103T000000Z", "20250104T000000Z"}
+	tests := []struct {
+		name    string
+		current string
+		keep    int
+		want    []string
+	}{
+		{"keep 2", releases[3], 2, releases[2:]},
+		{"keep 1", releases[3], 1, releases[3:]},
+		{"keep 0 keeps 1", releases[3], 0, releases[3:]},
+		{"keep more than there are", releases[3], 10, releases},
+		{"old current kept", releases[0], 1, []string{releases[0], releases[3]}},
+		{"no current", "", 2, releases[2:]},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			dir := testReleases(t, releases, tt.current)
+			var out strings.Builder
+			err := pruneReleases(&out, dir, tt.keep)
+			if err != nil {
+				t.Fatalf("pruneReleases() error = %v", err)
+			}
+			got, err := listReleases(dir)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if strings.Join(got, "|") != strings.Join(tt.want, "|") {
+				t.Errorf("releases after pruneReleases() = %q, want %q", got, tt.want)
+			}
+			if removed := strings.Count(out.String(), "removed "); removed != len(releases)-len(tt.want) {
+				t.Errorf("pruneReleases() reported %d removals, want %d:\n%s", removed, len(releases)-len(tt.want), out.String())
+			}
+		})
+	}
+
+	t.Run("no releases", func(t *testing.T) {
+		err := pruneReleases(io.Discard, t.TempDir(), 2)
+		if err != nil {
+			t.Errorf("pruneReleases() error = %v", err)
+		}
+	})
+}
+
+func TestRunRollback(t *testing.T) {
+	releases := []string{"20250101T000000Z", "20250102T000000Z", "20250103T000000Z"}
+	tests := []struct {
+		name    string
+		current string
+		args    []string
+		want    string
+		wantErr string
+	}{
+		{"previous", releases[2], nil, releases[1], ""},
+		{"previous of a rolled back release", releases[1], nil, releases[0], ""},
+		{"named", releases[1], []string{releases[2]}, releases[2], ""},
+		{"named current", releases[2], []string{releases[2]}, releases[2], ""},
+		{"unknown release", releases[2], []string{"20240101T000000Z"}, releases[2], "no release 20240101T000000Z"},
+		{"oldest", releases[0], nil, releases[0], "no release before " + releases[0]},
+		{"no current", "", nil, "", "no release before"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			dir := testReleases(t, releases, tt.current)
+			err := runRollback(io.Discard, StaticConfig{}, append([]string{"-o", dir}, tt.args...))
+			if tt.wantErr != "" {
+				if err == nil || !strings.Contains(err.Error(), tt.wantErr) {
+					t.Errorf("runRollback() error = %v, want %q", err, tt.wantErr)
+				}
+			} else if err != nil {
+				t.Errorf("runRollback() error = %v", err)
+			}
+			if got := currentRelease(dir); got != tt.want {
+				t.Errorf("current = %q, want %q", got, tt.want)
+			}
+			if _, err := os.Stat(filepath.Join(dir, currentLink, ".")); tt.want != "" && err != nil {
+				t.Errorf("current doesn't resolve: %v", err)
+			}
+		})
+	}
+
+	t.Run("uses the configured dir", func(t *testing.T) {
+		dir := testReleases(t, releases, releases[2])
+		err := runRollback(io.Discard, StaticConfig{Dir: dir}, nil)
+		if err != nil {
+			t.Fatalf("runRollback() error = %v", err)
+		}
+		if got := currentRelease(dir); got != releases[1] {
+			t.Errorf("current = %q, want %q", got, releases[1])
+		}
+	})
+}
@@ -0,0 +1,70 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"sync"
+)
+
+// JSONFile keeps a value in memory and persists it as a JSON file after every
+// update. It is meant for the small amounts of data a blog collects, not as a
+// general purpose database.
+type JSONFile[T any] struct {
+	path string
+	mu   sync.Mutex
+	data T
+}
+
+// OpenJSONFile loads path into a JSONFile. A missing file results in the zero
+// value of T.
+func OpenJSONFile[T any](path string) (*JSONFile[T], error) {
+	f := &JSONFile[T]{path: path}
+	b, err := os.ReadFile(path)
+	if errors.Is(err, fs.ErrNotExist) {
+		return f, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	err = json.Unmarshal(b, &f.data)
+	if err != nil {
+		return nil, err
+	}
+	return f, nil
+}
+
+// View calls fn with the current data. fn must not modify it.
+func (f *JSONFile[T]) View(fn func(data *T)) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	fn(&f.data)
+}
+
+// Update calls fn with the current data and saves the result to disk unless fn
+// returns an error.
+func (f *JSONFile[T]) Update(fn func(data *T) error) error {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	err := fn(&f.data)
+	if err != nil {
+		return err
+	}
+	b, err := json.MarshalIndent(f.data, "", "  ")
+	if err != nil {
+		return err
+	}
+	err = os.MkdirAll(filepath.Dir(f.path), 0755)
+	if err != nil {
+		return err
+	}
+	// Write to a temp file and rename so a crash never leaves a partial file.
+	tmp := f.path + ".tmp"
+	err = os.WriteFile(tmp, b, 0644)
+	if err != nil {
+		return err
+	}
+	return os.Rename(tmp, f.path)
+}
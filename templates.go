@@ -0,0 +1,31 @@
+package main
+
+import (
+	"html/template"
+	"net/http"
+)
+
+// Page templates are .gohtml files in the working directory. They are parsed
+// on every request, so edits show up without a restart.
+
+// parseTemplate parses the page template in the file name, along with the
+// "icons" template pages include in their head.
+func parseTemplate(name string) (*template.Template, error) {
+	tpl, err := template.ParseFiles(name)
+	if err != nil {
+		return nil, err
+	}
+	_, err = tpl.New("icons").Parse(iconLinks)
+	return tpl, err
+}
+
+// renderTemplate writes the page template in the file name, executed with
+// data, to w.
+func renderTemplate(w http.ResponseWriter, name string, data any) {
+	tpl, err := parseTemplate(name)
+	if err != nil {
+		http.Error(w, "Error parsing template", http.StatusInternalServerError)
+		return
+	}
+	err = tpl.Execute(w, data)
+}
@@ -0,0 +1,130 @@
+package main
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"net"
+	"net/http"
+	"net/netip"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+const visitorCookie = "jb_visitor"
+
+// visitorID returns an anonymous ID for the visitor, stored in a signed
+// cookie. A new ID is issued when the cookie is missing or has been tampered
+// with.
+func visitorID(w http.ResponseWriter, r *http.Request, secret string) string {
+	if id := cookieVisitorID(r, secret); id != "" {
+		return id
+	}
+	b := make([]byte, 16)
+	rand.Read(b)
+	id := hex.EncodeToString(b)
+	http.SetCookie(w, &http.Cookie{
+		Name:     visitorCookie,
+		Value:    id + "." + sign(secret, "visitor:"+id),
+		Path:     "/",
+		MaxAge:   365 * 24 * 60 * 60,
+		HttpOnly: true,
+		SameSite: http.SameSiteLaxMode,
+	})
+	return id
+}
+
+// cookieVisitorID returns the visitor's ID if they already have a valid
+// cookie, or "" otherwise.
+func cookieVisitorID(r *http.Request, secret string) string {
+	if c, err := r.Cookie(visitorCookie); err == nil {
+		id, sig, ok := strings.Cut(c.Value, ".")
+		if ok && verify(secret, "visitor:"+id, sig) {
+			return id
+		}
+	}
+	return ""
+}
+
+// ipWindowKey hashes the client's IP along with the current time window so
+// that repeat requests can be recognised without storing IP addresses.
+func ipWindowKey(r *http.Request, secret string, window time.Duration) string {
+	bucket := time.Now().UnixNano() / int64(window)
+	return sign(secret, "ip:"+clientIP(r)+":"+strconv.FormatInt(bucket, 10))
+}
+
+// trustedProxies are the reverse proxies whose X-Forwarded-For headers are
+// believed. It is set from Config.TrustedProxies on startup.
+var trustedProxies []netip.Prefix
+
+// clientIP returns the address of the client making r. When r comes from a
+// trusted proxy, that is the last address in X-Forwarded-For that isn't a
+// trusted proxy itself, since earlier ones can be made up by the client.
+func clientIP(r *http.Request) string {
+	host, _, err := net.SplitHostPort(r.RemoteAddr)
+	if err != nil {
+		host = r.RemoteAddr
+	}
+	if !trustedProxy(host) {
+		return host
+	}
+	hops := strings.Split(strings.Join(r.Header.Values("X-Forwarded-For"), ","), ",")
+	for i := len(hops) - 1; i >= 0; i-- {
+		hop := strings.TrimSpace(hops[i])
+		if _, err := netip.ParseAddr(hop); err != nil {
+			break
+		}
+		host = hop
+		if !trustedProxy(hop) {
+			break
+		}
+	}
+	return host
+}
+
+func trustedProxy(ip string) bool {
+	addr, err := netip.ParseAddr(ip)
+	return err == nil && containsAddr(trustedProxies, addr.Unmap())
+}
+
+// RateLimiter allows up to Limit events per key in each Window.
+type RateLimiter struct {
+	Limit  int
+	Window time.Duration
+
+	mu      sync.Mutex
+	windows map[string]rateWindow
+}
+
+type rateWindow struct {
+	count int
+	reset time.Time
+}
+
+func (rl *RateLimiter) Allow(key string) bool {
+	rl.mu.Lock()
+	defer rl.mu.Unlock()
+	now := time.Now()
+	if rl.windows == nil {
+		rl.windows = make(map[string]rateWindow)
+	}
+	// Drop expired windows every so often so the map doesn't grow forever.
+	if len(rl.windows) > 10000 {
+		for k, w := range rl.windows {
+			if now.After(w.reset) {
+				delete(rl.windows, k)
+			}
+		}
+	}
+	w := rl.windows[key]
+	if now.After(w.reset) {
+		w = rateWindow{reset: now.Add(rl.Window)}
+	}
+	if w.count >= rl.Limit {
+		return false
+	}
+	w.count++
+	rl.windows[key] = w
+	return true
+}